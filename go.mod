@@ -4,12 +4,15 @@ go 1.21
 
 require (
 	github.com/allegro/bigcache v1.2.1
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.3.0
 	github.com/duke-git/lancet/v2 v2.3.2
 	github.com/efectn/fx-zerolog v1.1.0
 	github.com/fasthttp/router v1.5.2
 	github.com/go-redis/redismock/v9 v9.2.0
 	github.com/gohutool/boot4go-prometheus v1.0.2
+	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/gorilla/websocket v1.5.3
+	github.com/hashicorp/golang-lru/v2 v2.0.7
 	github.com/icza/huffman v0.0.0-20230330133829-d543610fbdd2
 	github.com/jackc/pgx v3.6.2+incompatible
 	github.com/knadh/koanf/maps v0.1.1
@@ -24,10 +27,12 @@ require (
 	github.com/rs/zerolog v1.33.0
 	github.com/streadway/amqp v1.1.0
 	github.com/xeipuuv/gojsonschema v1.2.0
+	go.etcd.io/bbolt v1.3.10
 	go.etcd.io/etcd/client/v3 v3.5.15
 	go.uber.org/automaxprocs v1.5.3
 	go.uber.org/fx v1.22.2
 	go.uber.org/mock v0.4.0
+	golang.org/x/crypto v0.26.0
 	gorm.io/driver/postgres v1.5.9
 	gorm.io/gorm v1.25.11
 )
@@ -44,7 +49,6 @@ require (
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/gohutool/log4go v1.0.2 // indirect
 	github.com/golang/protobuf v1.5.4 // indirect
-	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
 	github.com/icza/bitio v1.1.0 // indirect
 	github.com/lib/pq v1.10.9 // indirect
 	github.com/lufia/plan9stats v0.0.0-20240819163618-b1d8f4d146e7 // indirect
@@ -97,7 +101,6 @@ require (
 	go.uber.org/dig v1.18.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	go.uber.org/zap v1.27.0 // indirect
-	golang.org/x/crypto v0.26.0 // indirect
 	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.24.0 // indirect
@@ -21,12 +21,17 @@ var NewAgentModule = fx.Options(
 
 	// register service of agent module
 	fx.Provide(service.NewAgentService),
+	fx.Provide(service.NewCacheService),
 	fx.Provide(service.NewTenantService),
+	fx.Provide(service.NewTenantAdminService),
 	fx.Provide(service.NewEndpointService),
+	fx.Provide(service.NewAnonymousService),
+	fx.Provide(service.NewTxTrackerService),
 
 	// register controller of agent module
 	fx.Provide(controller.NewAgentController),
 	fx.Provide(controller.NewOtherController),
+	fx.Provide(controller.NewAdminController),
 
 	fx.Provide(core.NewClient),
 
@@ -0,0 +1,394 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/app/agent/service"
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+type adminControllerConfig struct {
+	Token string
+}
+
+type adminController struct {
+	logger        zerolog.Logger
+	conf          *config.Conf
+	cacheService  service.CacheService
+	tenantService service.TenantAdminService
+	config        adminControllerConfig
+}
+
+type AdminController interface {
+	Auth(next fasthttp.RequestHandler) fasthttp.RequestHandler
+	HandleCacheStats(ctx *fasthttp.RequestCtx)
+	HandleCacheEntry(ctx *fasthttp.RequestCtx)
+	HandleCachePurge(ctx *fasthttp.RequestCtx)
+	HandleCacheTTLs(ctx *fasthttp.RequestCtx)
+	HandleCacheSetTTL(ctx *fasthttp.RequestCtx)
+	HandleTenantList(ctx *fasthttp.RequestCtx)
+	HandleTenantGet(ctx *fasthttp.RequestCtx)
+	HandleTenantCreate(ctx *fasthttp.RequestCtx)
+	HandleTenantUpdate(ctx *fasthttp.RequestCtx)
+	HandleTenantDelete(ctx *fasthttp.RequestCtx)
+	HandleTenantRotateToken(ctx *fasthttp.RequestCtx)
+	HandleTenantResetBalance(ctx *fasthttp.RequestCtx)
+	HandleApiKeyList(ctx *fasthttp.RequestCtx)
+	HandleApiKeyCreate(ctx *fasthttp.RequestCtx)
+	HandleApiKeyDelete(ctx *fasthttp.RequestCtx)
+}
+
+func NewAdminController(
+	logger zerolog.Logger,
+	conf *config.Conf,
+	cacheService service.CacheService,
+	tenantService service.TenantAdminService,
+) AdminController {
+	controller := &adminController{
+		logger:        logger.With().Str("name", "admin_controller").Logger(),
+		conf:          conf,
+		cacheService:  cacheService,
+		tenantService: tenantService,
+		config: adminControllerConfig{
+			Token: conf.String("admin.token", ""),
+		},
+	}
+
+	return controller
+}
+
+func (a *adminController) respond(ctx *fasthttp.RequestCtx, statusCode int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		a.fail(ctx, common.InternalServerError("", err))
+		return
+	}
+	ctx.Response.Header.SetContentType("application/json; charset=utf-8")
+	ctx.SetStatusCode(statusCode)
+	ctx.SetBody(body)
+}
+
+func (a *adminController) fail(ctx *fasthttp.RequestCtx, err common.HTTPErrors) {
+	ctx.Response.Header.SetContentType("application/json; charset=utf-8")
+	ctx.SetStatusCode(err.StatusCode())
+	ctx.SetBody(err.Body())
+}
+
+// 校验管理接口的 token，未配置 admin.token 时管理接口不可用
+func (a *adminController) Auth(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if a.config.Token == "" {
+			a.fail(ctx, common.NotFoundError("Admin API is disabled"))
+			return
+		}
+
+		token := string(ctx.Request.Header.Peek("x-admin-token"))
+		if v := string(ctx.Request.Header.Peek("Authorization")); strings.HasPrefix(v, "Bearer ") {
+			token = strings.TrimPrefix(v, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.config.Token)) != 1 {
+			a.logger.Warn().Str("ip", ctx.RemoteIP().String()).Msgf("Unauthorized admin request %s %s", ctx.Method(), ctx.Path())
+			a.fail(ctx, common.ForbiddenError("Admin token is invalid"))
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// 服务内部错误不返回给客户端
+func (a *adminController) abort(ctx *fasthttp.RequestCtx, err error) {
+	if common.IsHTTPErrors(err) {
+		a.fail(ctx, err.(common.HTTPErrors))
+		return
+	}
+	a.logger.Error().Err(err).Msgf("%s %s", ctx.Method(), ctx.Path())
+	a.fail(ctx, common.InternalServerError("Internal Server Error"))
+}
+
+// 解析链 ID 或链代码
+func (a *adminController) chainId(v string) (common.ChainId, bool) {
+	if v == "" {
+		return 0, true
+	}
+	if chain, ok := a.conf.Get(helpers.Concat("chains.", v)).(common.EndpointChain); ok {
+		return chain.ChainID, true
+	}
+	if id, err := strconv.ParseUint(v, 10, 64); err == nil {
+		return id, true
+	}
+	return 0, false
+}
+
+func (a *adminController) HandleCacheStats(ctx *fasthttp.RequestCtx) {
+	a.respond(ctx, fasthttp.StatusOK, a.cacheService.Stats())
+}
+
+func (a *adminController) HandleCacheEntry(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	chainId, ok := a.chainId(string(args.Peek("chain")))
+	if !ok || chainId == 0 {
+		a.fail(ctx, common.BadRequestError("Invalid chain"))
+		return
+	}
+	method := string(args.Peek("method"))
+	if method == "" {
+		a.fail(ctx, common.BadRequestError("Method is required"))
+		return
+	}
+	params := []any{}
+	if v := args.Peek("params"); len(v) > 0 {
+		if err := json.Unmarshal(v, &params); err != nil {
+			a.fail(ctx, common.BadRequestError("Invalid params", err))
+			return
+		}
+	}
+
+	entry, ok := a.cacheService.Lookup(chainId, method, params)
+	if !ok {
+		a.fail(ctx, common.NotFoundError("Cache entry not found"))
+		return
+	}
+	a.respond(ctx, fasthttp.StatusOK, entry)
+}
+
+func (a *adminController) HandleCachePurge(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	if key := string(args.Peek("key")); key != "" {
+		a.respond(ctx, fasthttp.StatusOK, map[string]any{"purged": a.cacheService.PurgeKey(key)})
+		return
+	}
+
+	chainId, ok := a.chainId(string(args.Peek("chain")))
+	if !ok {
+		a.fail(ctx, common.BadRequestError("Invalid chain"))
+		return
+	}
+	method := string(args.Peek("method"))
+	// 避免误清空全部缓存，需要明确指定 all=true
+	if chainId == 0 && method == "" && !args.GetBool("all") {
+		a.fail(ctx, common.BadRequestError("One of key, chain, method or all=true is required"))
+		return
+	}
+
+	a.respond(ctx, fasthttp.StatusOK, map[string]any{"purged": a.cacheService.Purge(chainId, method)})
+}
+
+func (a *adminController) HandleCacheTTLs(ctx *fasthttp.RequestCtx) {
+	a.respond(ctx, fasthttp.StatusOK, a.cacheService.TTLs())
+}
+
+func (a *adminController) HandleCacheSetTTL(ctx *fasthttp.RequestCtx) {
+	var body struct {
+		service.CacheTTL
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &body); err != nil {
+		a.fail(ctx, common.BadRequestError("Invalid body", err))
+		return
+	}
+	if body.Method == "" {
+		a.fail(ctx, common.BadRequestError("Method is required"))
+		return
+	}
+	for _, v := range []string{body.TTL, body.Stale} {
+		if v == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(v); err != nil {
+			a.fail(ctx, common.BadRequestError("Invalid duration", err))
+			return
+		}
+	}
+
+	if err := a.cacheService.SetTTL(body.Method, body.CacheTTL); err != nil {
+		a.fail(ctx, err)
+		return
+	}
+	a.respond(ctx, fasthttp.StatusOK, a.cacheService.TTLs())
+}
+
+func (a *adminController) tenantId(ctx *fasthttp.RequestCtx) (uint64, bool) {
+	id, err := strconv.ParseUint(fmt.Sprint(ctx.UserValue("id")), 10, 64)
+	if err != nil || id == 0 {
+		a.fail(ctx, common.BadRequestError("Invalid tenant id"))
+		return 0, false
+	}
+	return id, true
+}
+
+func (a *adminController) HandleTenantList(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	offset, limit := args.GetUintOrZero("offset"), args.GetUintOrZero("limit")
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	tenants, total, err := a.tenantService.ListTenants(ctx, offset, limit)
+	if err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	a.respond(ctx, fasthttp.StatusOK, map[string]any{"total": total, "tenants": tenants})
+}
+
+func (a *adminController) HandleTenantGet(ctx *fasthttp.RequestCtx) {
+	id, ok := a.tenantId(ctx)
+	if !ok {
+		return
+	}
+
+	tenant, err := a.tenantService.GetTenant(ctx, id)
+	if err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	a.respond(ctx, fasthttp.StatusOK, tenant)
+}
+
+func (a *adminController) HandleTenantCreate(ctx *fasthttp.RequestCtx) {
+	var input service.TenantInput
+	if err := json.Unmarshal(ctx.PostBody(), &input); err != nil {
+		a.fail(ctx, common.BadRequestError("Invalid body", err))
+		return
+	}
+
+	tenant, err := a.tenantService.CreateTenant(ctx, input)
+	if err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	a.logger.Info().Msgf("Created tenant %d %s", tenant.ID, tenant.Name)
+	a.respond(ctx, fasthttp.StatusCreated, tenant)
+}
+
+func (a *adminController) HandleTenantUpdate(ctx *fasthttp.RequestCtx) {
+	id, ok := a.tenantId(ctx)
+	if !ok {
+		return
+	}
+	var input service.TenantInput
+	if err := json.Unmarshal(ctx.PostBody(), &input); err != nil {
+		a.fail(ctx, common.BadRequestError("Invalid body", err))
+		return
+	}
+	if input.Token != nil {
+		a.fail(ctx, common.BadRequestError("Use POST /admin/tenants/{id}/token to rotate the token"))
+		return
+	}
+
+	tenant, err := a.tenantService.UpdateTenant(ctx, id, input)
+	if err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	a.logger.Info().Msgf("Updated tenant %d %s", tenant.ID, tenant.Name)
+	a.respond(ctx, fasthttp.StatusOK, tenant)
+}
+
+func (a *adminController) HandleTenantDelete(ctx *fasthttp.RequestCtx) {
+	id, ok := a.tenantId(ctx)
+	if !ok {
+		return
+	}
+
+	if err := a.tenantService.DeleteTenant(ctx, id); err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	a.logger.Info().Msgf("Deleted tenant %d", id)
+	a.respond(ctx, fasthttp.StatusOK, map[string]any{"deleted": true})
+}
+
+func (a *adminController) HandleTenantRotateToken(ctx *fasthttp.RequestCtx) {
+	id, ok := a.tenantId(ctx)
+	if !ok {
+		return
+	}
+
+	tenant, err := a.tenantService.RotateToken(ctx, id)
+	if err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	a.logger.Info().Msgf("Rotated token of tenant %d", id)
+	a.respond(ctx, fasthttp.StatusOK, tenant)
+}
+
+func (a *adminController) HandleTenantResetBalance(ctx *fasthttp.RequestCtx) {
+	id, ok := a.tenantId(ctx)
+	if !ok {
+		return
+	}
+
+	n, err := a.tenantService.ResetBalance(ctx, id, string(ctx.QueryArgs().Peek("bucket")))
+	if err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	a.respond(ctx, fasthttp.StatusOK, map[string]any{"reset": n})
+}
+
+func (a *adminController) HandleApiKeyList(ctx *fasthttp.RequestCtx) {
+	id, ok := a.tenantId(ctx)
+	if !ok {
+		return
+	}
+
+	keys, err := a.tenantService.ListApiKeys(ctx, id)
+	if err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	a.respond(ctx, fasthttp.StatusOK, keys)
+}
+
+func (a *adminController) HandleApiKeyCreate(ctx *fasthttp.RequestCtx) {
+	id, ok := a.tenantId(ctx)
+	if !ok {
+		return
+	}
+	var input service.ApiKeyInput
+	if len(ctx.PostBody()) > 0 {
+		if err := json.Unmarshal(ctx.PostBody(), &input); err != nil {
+			a.fail(ctx, common.BadRequestError("Invalid body", err))
+			return
+		}
+	}
+
+	key, err := a.tenantService.CreateApiKey(ctx, id, input)
+	if err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	a.logger.Info().Msgf("Created api key %d (%s) of tenant %d", key.ID, key.Prefix, id)
+	a.respond(ctx, fasthttp.StatusCreated, key)
+}
+
+func (a *adminController) HandleApiKeyDelete(ctx *fasthttp.RequestCtx) {
+	id, ok := a.tenantId(ctx)
+	if !ok {
+		return
+	}
+	keyId, err := strconv.ParseUint(fmt.Sprint(ctx.UserValue("key")), 10, 64)
+	if err != nil {
+		a.fail(ctx, common.BadRequestError("Invalid api key id"))
+		return
+	}
+
+	if err := a.tenantService.DeleteApiKey(ctx, id, keyId); err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	a.logger.Info().Msgf("Deleted api key %d of tenant %d", keyId, id)
+	a.respond(ctx, fasthttp.StatusOK, map[string]any{"deleted": true})
+}
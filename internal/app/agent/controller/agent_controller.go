@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/DODOEX/web3rpcproxy/internal/app/agent/service"
@@ -13,6 +15,7 @@ import (
 	"github.com/DODOEX/web3rpcproxy/internal/common"
 	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
 	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
 	"github.com/DODOEX/web3rpcproxy/utils"
 	"github.com/DODOEX/web3rpcproxy/utils/config"
 	"github.com/DODOEX/web3rpcproxy/utils/helpers"
@@ -25,16 +28,22 @@ type agentControllerConfig struct {
 	AppName             string
 	EnableTenantFeature bool
 	AmqpExchange        string
+	// 是否返回限流、配额的响应头
+	RateLimitHeaders bool
+	QuotaHeaders     bool
+	AnonymousDeny    anonymousDenyConfig
 }
 
 type agentController struct {
-	logger          zerolog.Logger
-	conf            *config.Conf
-	amqp            *shared.Amqp
-	agentService    service.AgentService
-	tenantService   service.TenantService
-	endpointService service.EndpointService
-	config          agentControllerConfig
+	logger           zerolog.Logger
+	conf             *config.Conf
+	amqp             *shared.Amqp
+	agentService     service.AgentService
+	tenantService    service.TenantService
+	endpointService  service.EndpointService
+	anonymousService service.AnonymousService
+	config           agentControllerConfig
+	concurrency      *concurrencyLimiter
 }
 
 type AgentController interface {
@@ -48,20 +57,26 @@ func NewAgentController(
 	agentService service.AgentService,
 	tenantService service.TenantService,
 	endpointService service.EndpointService,
+	anonymousService service.AnonymousService,
 ) AgentController {
 	controller := &agentController{
-		conf:            conf,
-		amqp:            amqp,
-		logger:          logger.With().Str("name", "agent_controller").Logger(),
-		agentService:    agentService,
-		tenantService:   tenantService,
-		endpointService: endpointService,
+		conf:             conf,
+		amqp:             amqp,
+		logger:           logger.With().Str("name", "agent_controller").Logger(),
+		agentService:     agentService,
+		tenantService:    tenantService,
+		endpointService:  endpointService,
+		anonymousService: anonymousService,
 		config: agentControllerConfig{
 			AppName:             conf.String("app.name", "Web3 RPC Proxy"),
 			EnableTenantFeature: conf.Bool("tenant.enable", false),
 			AmqpExchange:        conf.String("amqp.exchange", "web3rpcproxy.query.topic"),
+			RateLimitHeaders:    conf.Bool("tenant.headers.rate_limit", true),
+			QuotaHeaders:        conf.Bool("tenant.headers.quota", true),
 		},
+		concurrency: newConcurrencyLimiter(conf),
 	}
+	conf.Unmarshal("anonymous.deny", &controller.config.AnonymousDeny)
 
 	return controller
 }
@@ -114,7 +129,16 @@ func (a *agentController) HandleCall(ctx *fasthttp.RequestCtx) {
 		if !ctx.Response.ConnectionClose() {
 			ctx.Response.Header.Set("Access-Control-Allow-Headers", "*")
 			ctx.Response.Header.Set("Access-Control-Allow-Methods", "*")
-			ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+			// 租户限制了 origin 时，只对匹配的 origin 开放跨域
+			switch origin := allowOrigin(rc); origin {
+			case "*":
+				ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+			case "":
+				ctx.Response.Header.Add("Vary", "Origin")
+			default:
+				ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+				ctx.Response.Header.Add("Vary", "Origin")
+			}
 			ctx.Response.Header.Set("Access-Control-Expose-Headers", "*")
 			ctx.Response.Header.Set("Referrer-Policy", "same-origin")
 			ctx.Response.Header.Set("Server", a.config.AppName)
@@ -133,6 +157,13 @@ func (a *agentController) HandleCall(ctx *fasthttp.RequestCtx) {
 	if app != nil {
 		if p.Status == common.Success || p.Status == common.Fail {
 			// 后端节点报错，也算正常消费
+			p.ComputeUnits = app.Cost
+			// 批量调用中在本地处理的调用不计费
+			if len(p.Intercepted) > 0 {
+				refund := min(a.tenantService.Cost(p.Intercepted), app.Cost)
+				p.ComputeUnits -= refund
+				go a.tenantService.Refund(app, refund)
+			}
 			go a.tenantService.Affected(app)
 		} else {
 			// 如果内部错误，则不算消费
@@ -158,6 +189,11 @@ func (a agentController) call(rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint)
 	ctx, cancel := context.WithTimeoutCause(rc, rc.Options().Timeout(), common.TimeoutError("Request timed out"))
 	defer cancel()
 
+	// 识别租户、计算消耗时需要解析请求，先检查请求体的大小
+	if err := service.CheckRequestBody(rc); err != nil {
+		return nil, err.(common.HTTPErrors)
+	}
+
 	// 解析 app
 	if a.config.EnableTenantFeature && rc.App() == nil {
 		app, err := a.getTenantApp(ctx, rc)
@@ -171,6 +207,24 @@ func (a agentController) call(rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint)
 		rc.SetApp(app)
 	}
 
+	// 未开启租户时按 IP 限制匿名访问
+	if !a.config.EnableTenantFeature && a.anonymousService.Enabled() {
+		if err := a.checkAnonymous(ctx, rc); err != nil {
+			return nil, err
+		}
+	}
+
+	// 限制租户的并发数，拒绝的请求不消耗余额
+	if app := rc.App(); app != nil {
+		release, err := a.concurrency.Acquire(ctx, app)
+		if err != nil {
+			rc.Logger().Warn().Msgf("%s(%s) %s", app.Name, app.Bucket, err.(common.HTTPErrors).Message())
+			rc.SetResponseHeader("Retry-After", "1")
+			return nil, err.(common.HTTPErrors)
+		}
+		defer release()
+	}
+
 	// 调用
 	data, err := a.agentService.Call(ctx, rc, endpoints)
 
@@ -187,11 +241,48 @@ func (a agentController) call(rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint)
 
 func (a agentController) getTenantApp(ctx context.Context, reqctx reqctx.Reqctxs) (*common.App, error) {
 	token := reqctx.AppKey()
-	if len(token) <= 0 {
+	// 未携带 token 时使用 Authorization: Bearer <JWT>
+	bearer, _ := strings.CutPrefix(reqctx.Header("Authorization"), "Bearer ")
+	if len(token) <= 0 && len(bearer) <= 0 {
 		return nil, common.ForbiddenError("Token is empty")
 	}
 
-	app, err := a.tenantService.Access(ctx, token, reqctx.AppBucket())
+	// 按请求中所有调用的方法计算消耗，无法解析时按默认值计算
+	methods, _, _ := rpc.UnmarshalMethods(*reqctx.Body())
+	cost := a.tenantService.Cost(methods)
+
+	// 限制请求来源，在扣除余额前检查，拒绝的请求不消耗余额
+	check := func(app *common.App) error {
+		if err := checkRestrictions(reqctx, app); err != nil {
+			reqctx.Logger().Warn().Str("ip", reqctx.Profile().IP).Msgf("%s restricted: %s", app.Name, err.(common.HTTPErrors).Message())
+			return err
+		}
+		return nil
+	}
+
+	var (
+		app *common.App
+		err error
+	)
+	if len(token) > 0 {
+		app, err = a.tenantService.Access(ctx, token, reqctx.AppBucket(), cost, check)
+	} else {
+		app, err = a.tenantService.AccessJWT(ctx, strings.TrimSpace(bearer), reqctx.AppBucket(), cost, check)
+	}
+	if app != nil && a.config.RateLimitHeaders && err == nil {
+		setRateLimitHeaders(reqctx, app)
+	}
+	if app != nil && a.config.QuotaHeaders {
+		setQuotaHeaders(reqctx, app.Quotas)
+	}
+	if err != nil && common.IsHTTPErrors(err) {
+		// 配额用尽、租户已停用
+		reqctx.Logger().Warn().Msg(err.(common.HTTPErrors).Message())
+		if app != nil && err.(common.HTTPErrors).StatusCode() == http.StatusTooManyRequests {
+			setQuotaRetryAfter(reqctx, app.Quotas, cost)
+		}
+		return nil, err
+	}
 	if err != nil {
 		reqctx.Logger().Error().Stack().Err(err).Msg("Get app error")
 		if err.Error() == "context deadline exceeded" {
@@ -208,7 +299,8 @@ func (a agentController) getTenantApp(ctx context.Context, reqctx reqctx.Reqctxs
 		// const overview = `⏳ ${app.balance}/${app.capacity} | ♻️ ${app.rate}/s | 🕛 ${app.last}`;
 		// const key = hidePrivacyInfo(app.token) + (app.bucket ? ', ' + hidePrivacyInfo(app.bucket) : '');
 		// this.logger.Warn(`[${ctx.state.id}] ${app.name}(${key}) requests overage. ${overview}`);
-		reqctx.Logger().Warn().Msgf("proxy overage. ⏳ %d/%f | ♻️ %f/s", app.Balance, app.Capacity, app.Rate)
+		reqctx.Logger().Warn().Msgf("proxy overage. ⏳ %d/%f | ♻️ %f/s | 💰 %d", app.Balance, app.Capacity, app.Rate, cost)
+		setBalanceRetryAfter(reqctx, app)
 		return nil, common.TooManyRequestsError("Token is overage")
 	}
 
@@ -216,6 +308,58 @@ func (a agentController) getTenantApp(ctx context.Context, reqctx reqctx.Reqctxs
 }
 
 // func (_i agentService) getRequestContext(ctx *fasthttp.RequestCtx, c net.Conn) reqctx.Reqctxs {
+// 返回令牌桶的余额，Reset 为恢复满额所需的秒数
+func setRateLimitHeaders(rc reqctx.Reqctxs, app *common.App) {
+	capacity, rate := app.Limits()
+	if capacity <= 0 || rate <= 0 {
+		return
+	}
+
+	remaining := float64(max(app.Balance, 0))
+	rc.SetResponseHeader("X-RateLimit-Limit", strconv.FormatInt(int64(capacity), 10))
+	rc.SetResponseHeader("X-RateLimit-Remaining", strconv.FormatInt(int64(remaining), 10))
+	rc.SetResponseHeader("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(max(capacity-remaining, 0)/rate)), 10))
+}
+
+// 余额不足时 Balance 为缺少的额度，等待恢复到足够的额度
+func setBalanceRetryAfter(rc reqctx.Reqctxs, app *common.App) {
+	retry := int64(1)
+	if _, rate := app.Limits(); rate > 0 {
+		retry = max(int64(math.Ceil(float64(-app.Balance)/rate)), 1)
+	}
+	rc.SetResponseHeader("Retry-After", strconv.FormatInt(retry, 10))
+}
+
+// 配额用尽时，等待到已用尽窗口的重置时间
+func setQuotaRetryAfter(rc reqctx.Reqctxs, quotas []common.Quota, cost int64) {
+	var reset int64
+	for _, q := range quotas {
+		// 超出配额时不计数，用量为本次请求之前的
+		if (q.Requests > 0 && q.UsedRequests+1 > q.Requests) || (q.Units > 0 && q.UsedUnits+cost > q.Units) {
+			reset = max(reset, q.Reset)
+		}
+	}
+	if reset > 0 {
+		rc.SetResponseHeader("Retry-After", strconv.FormatInt(max(reset-time.Now().Unix(), 1), 10))
+	}
+}
+
+// 返回各窗口配额的用量，如 X-Quota-Daily-Requests-Remaining
+func setQuotaHeaders(rc reqctx.Reqctxs, quotas []common.Quota) {
+	for _, q := range quotas {
+		prefix := helpers.Concat("X-Quota-", strings.ToUpper(q.Window[:1]), q.Window[1:])
+		if q.Requests > 0 {
+			rc.SetResponseHeader(prefix+"-Requests-Limit", strconv.FormatInt(q.Requests, 10))
+			rc.SetResponseHeader(prefix+"-Requests-Remaining", strconv.FormatInt(max(q.Requests-q.UsedRequests, 0), 10))
+		}
+		if q.Units > 0 {
+			rc.SetResponseHeader(prefix+"-Units-Limit", strconv.FormatInt(q.Units, 10))
+			rc.SetResponseHeader(prefix+"-Units-Remaining", strconv.FormatInt(max(q.Units-q.UsedUnits, 0), 10))
+		}
+		rc.SetResponseHeader(prefix+"-Reset", strconv.FormatInt(q.Reset, 10))
+	}
+}
+
 func (a agentController) getRequestContext(ctx *fasthttp.RequestCtx) reqctx.Reqctxs {
 	return reqctx.NewReqctx(ctx, a.conf.Copy(), a.logger)
 }
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+func newHeaderReqctx() (*fasthttp.RequestCtx, reqctx.Reqctxs) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/1")
+	ctx.SetUserValue("chain", "1")
+	return ctx, reqctx.NewReqctx(ctx, newConfig(map[string]any{}), zerolog.Nop())
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	app := &common.App{Balance: 40}
+	app.Capacity, app.Rate = 100, 10
+
+	ctx, rc := newHeaderReqctx()
+	setRateLimitHeaders(rc, app)
+	for k, v := range map[string]string{"X-RateLimit-Limit": "100", "X-RateLimit-Remaining": "40", "X-RateLimit-Reset": "6"} {
+		if h := string(ctx.Response.Header.Peek(k)); h != v {
+			t.Errorf("%s: expected %s, got %s", k, v, h)
+		}
+	}
+
+	// JWT 中调低的限流
+	app.MaxCapacity, app.MaxRate = 50, 5
+	ctx, rc = newHeaderReqctx()
+	setRateLimitHeaders(rc, app)
+	for k, v := range map[string]string{"X-RateLimit-Limit": "50", "X-RateLimit-Remaining": "40", "X-RateLimit-Reset": "2"} {
+		if h := string(ctx.Response.Header.Peek(k)); h != v {
+			t.Errorf("%s: expected %s, got %s", k, v, h)
+		}
+	}
+
+	// 不限流时不返回
+	ctx, rc = newHeaderReqctx()
+	setRateLimitHeaders(rc, &common.App{})
+	if h := ctx.Response.Header.Peek("X-RateLimit-Limit"); h != nil {
+		t.Errorf("expected no header, got %s", h)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	// 余额不足时等待恢复缺少的额度
+	app := &common.App{Balance: -25}
+	app.Capacity, app.Rate = 100, 10
+	ctx, rc := newHeaderReqctx()
+	setBalanceRetryAfter(rc, app)
+	if h := string(ctx.Response.Header.Peek("Retry-After")); h != "3" {
+		t.Errorf("expected %s, got %s", "3", h)
+	}
+
+	app.Balance = 0
+	ctx, rc = newHeaderReqctx()
+	setBalanceRetryAfter(rc, app)
+	if h := string(ctx.Response.Header.Peek("Retry-After")); h != "1" {
+		t.Errorf("expected %s, got %s", "1", h)
+	}
+
+	// 等待到已用尽窗口中最晚的重置时间
+	now := time.Now().Unix()
+	quotas := []common.Quota{
+		{Window: "daily", Requests: 10, UsedRequests: 10, Reset: now + 100},
+		{Window: "monthly", Units: 1000, UsedUnits: 995, Reset: now + 1000},
+		{Window: "hourly", Requests: 10, UsedRequests: 1, Reset: now + 5000},
+	}
+	ctx, rc = newHeaderReqctx()
+	setQuotaRetryAfter(rc, quotas, 10)
+	if h, _ := strconv.ParseInt(string(ctx.Response.Header.Peek("Retry-After")), 10, 64); h < 999 || h > 1000 {
+		t.Errorf("expected about %d, got %d", 1000, h)
+	}
+
+	ctx, rc = newHeaderReqctx()
+	setQuotaRetryAfter(rc, quotas, 1)
+	if h, _ := strconv.ParseInt(string(ctx.Response.Header.Peek("Retry-After")), 10, 64); h < 99 || h > 100 {
+		t.Errorf("expected about %d, got %d", 100, h)
+	}
+
+	ctx, rc = newHeaderReqctx()
+	setQuotaRetryAfter(rc, quotas[2:], 1)
+	if h := ctx.Response.Header.Peek("Retry-After"); h != nil {
+		t.Errorf("expected no header, got %s", h)
+	}
+}
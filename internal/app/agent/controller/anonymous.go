@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+)
+
+// 匿名访问的黑名单，IP 支持 CIDR，国家为可信代理传递的 cf-ipcountry 中的代码
+type anonymousDenyConfig struct {
+	IPs       []string `koanf:"ips"`
+	Countries []string `koanf:"countries"`
+}
+
+// 未开启租户时，按客户端 IP 限制匿名访问
+func (a agentController) checkAnonymous(ctx context.Context, rc reqctx.Reqctxs) common.HTTPErrors {
+	ip := rc.Profile().IP
+
+	if len(a.config.AnonymousDeny.IPs) > 0 && matchIP(a.config.AnonymousDeny.IPs, ip) {
+		rc.Logger().Warn().Str("ip", ip).Msg("Anonymous ip is denied")
+		return common.ForbiddenError("IP is not allowed")
+	}
+	if country := rc.Profile().IPCountry; country != "" {
+		for _, v := range a.config.AnonymousDeny.Countries {
+			if strings.EqualFold(v, country) {
+				rc.Logger().Warn().Str("ip", ip).Str("country", country).Msg("Anonymous country is denied")
+				return common.ForbiddenError("Country is not allowed")
+			}
+		}
+	}
+
+	methods, _, _ := rpc.UnmarshalMethods(*rc.Body())
+	access, err := a.anonymousService.Access(ctx, ip, rc.ChainID(), a.tenantService.Cost(methods))
+	if err != nil {
+		// 限流只是保护措施，读取失败时不影响请求
+		rc.Logger().Error().Err(err).Msg("Anonymous rate limit error")
+		return nil
+	}
+	if access == nil {
+		return nil
+	}
+
+	app := &common.App{Balance: access.Balance}
+	app.Capacity, app.Rate = access.Capacity, access.Rate
+	if a.config.RateLimitHeaders {
+		setRateLimitHeaders(rc, app)
+	}
+	if access.Balance < 0 {
+		rc.Logger().Warn().Str("ip", ip).Msgf("anonymous overage. ⏳ %d/%f | ♻️ %f/s", access.Balance, access.Capacity, access.Rate)
+		setBalanceRetryAfter(rc, app)
+		return common.TooManyRequestsError("IP is overage")
+	}
+	return nil
+}
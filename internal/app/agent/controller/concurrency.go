@@ -0,0 +1,198 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+)
+
+type concurrencyConfig struct {
+	// 整个实例的并发上限，达到上限后按租户的权重公平调度，0 表示不限制
+	Max int `koanf:"max"`
+	// 租户未配置时，每个租户最多排队的请求数
+	Queue int `koanf:"queue"`
+	// 排队的最长等待时间
+	Timeout time.Duration `koanf:"timeout"`
+}
+
+// 限制租户的并发请求数，租户 preferences 中的配置：
+//
+//	{"concurrency": {"max": 50, "bucket_max": 10, "queue": 20, "weight": 2}}
+//
+// max 为租户的并发上限，bucket_max 为每个 bucket 的并发上限，queue 为排队的请求数，
+// weight 为实例并发饱和时租户的调度权重
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	config   concurrencyConfig
+	inflight int
+	tenants  map[string]*tenantConcurrency
+}
+
+type tenantConcurrency struct {
+	inflight int
+	buckets  map[string]int
+	waiters  []*concurrencyWaiter
+}
+
+type concurrencyWaiter struct {
+	bucket    string
+	max       int
+	bucketMax int
+	weight    float64
+	ready     chan struct{}
+	granted   bool
+}
+
+func newConcurrencyLimiter(conf *config.Conf) *concurrencyLimiter {
+	c := concurrencyConfig{Queue: 16, Timeout: time.Second}
+	if conf != nil {
+		conf.Unmarshal("tenant.concurrency", &c)
+	}
+	return &concurrencyLimiter{
+		config:  c,
+		tenants: map[string]*tenantConcurrency{},
+	}
+}
+
+// 获取执行请求的名额，返回的 release 必须在请求结束后调用；名额不足时排队，队列已满或等待超时返回 TooManyRequestsError
+func (l *concurrencyLimiter) Acquire(ctx context.Context, app *common.App) (release func(), err error) {
+	w := &concurrencyWaiter{
+		bucket:    app.Bucket,
+		max:       int(app.PreferenceInt64("concurrency.max")),
+		bucketMax: int(app.PreferenceInt64("concurrency.bucket_max")),
+		weight:    1,
+		ready:     make(chan struct{}),
+	}
+	if weight := app.PreferenceInt64("concurrency.weight"); weight > 0 {
+		w.weight = float64(weight)
+	}
+	// 未做任何限制时不需要调度
+	if l.config.Max <= 0 && w.max <= 0 && w.bucketMax <= 0 {
+		return func() {}, nil
+	}
+
+	key := app.Token
+	queue := l.config.Queue
+	if v := app.PreferenceInt64("concurrency.queue"); v > 0 {
+		queue = int(v)
+	}
+
+	l.mu.Lock()
+	t, ok := l.tenants[key]
+	if !ok {
+		t = &tenantConcurrency{buckets: map[string]int{}}
+		l.tenants[key] = t
+	}
+
+	// 同一租户按先后顺序执行
+	if len(t.waiters) <= 0 && l.runnable(t, w) {
+		l.grant(t, w)
+		l.mu.Unlock()
+		return l.releaser(key, w), nil
+	}
+	if len(t.waiters) >= queue {
+		l.mu.Unlock()
+		return nil, common.TooManyRequestsError("Too many concurrent requests")
+	}
+	t.waiters = append(t.waiters, w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.config.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return l.releaser(key, w), nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// 超时的同时被调度
+	if w.granted {
+		return l.releaser(key, w), nil
+	}
+	for i := range t.waiters {
+		if t.waiters[i] == w {
+			t.waiters = append(t.waiters[:i], t.waiters[i+1:]...)
+			break
+		}
+	}
+	l.cleanup(key, t)
+	return nil, common.TooManyRequestsError("Too many concurrent requests")
+}
+
+func (l *concurrencyLimiter) runnable(t *tenantConcurrency, w *concurrencyWaiter) bool {
+	return (l.config.Max <= 0 || l.inflight < l.config.Max) &&
+		(w.max <= 0 || t.inflight < w.max) &&
+		(w.bucketMax <= 0 || t.buckets[w.bucket] < w.bucketMax)
+}
+
+func (l *concurrencyLimiter) grant(t *tenantConcurrency, w *concurrencyWaiter) {
+	l.inflight++
+	t.inflight++
+	t.buckets[w.bucket]++
+	w.granted = true
+	close(w.ready)
+}
+
+func (l *concurrencyLimiter) releaser(key string, w *concurrencyWaiter) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.inflight--
+			if t, ok := l.tenants[key]; ok {
+				t.inflight--
+				if t.buckets[w.bucket]--; t.buckets[w.bucket] <= 0 {
+					delete(t.buckets, w.bucket)
+				}
+			}
+			l.dispatch()
+			if t, ok := l.tenants[key]; ok {
+				l.cleanup(key, t)
+			}
+		})
+	}
+}
+
+// 从排队的请求中挑选可以执行的，优先调度 (并发数 + 1) / 权重 最小的租户
+func (l *concurrencyLimiter) dispatch() {
+	for {
+		var (
+			next  *tenantConcurrency
+			index int
+			share float64
+		)
+		for _, t := range l.tenants {
+			for i, w := range t.waiters {
+				if !l.runnable(t, w) {
+					continue
+				}
+				if s := float64(t.inflight+1) / w.weight; next == nil || s < share {
+					next, index, share = t, i, s
+				}
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+
+		w := next.waiters[index]
+		next.waiters = append(next.waiters[:index], next.waiters[index+1:]...)
+		l.grant(next, w)
+	}
+}
+
+func (l *concurrencyLimiter) cleanup(key string, t *tenantConcurrency) {
+	if t.inflight <= 0 && len(t.waiters) <= 0 {
+		delete(l.tenants, key)
+	}
+}
@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/jackc/pgx/pgtype"
+)
+
+func newConcurrencyApp(token string, preferences string) *common.App {
+	app := &common.App{Bucket: "default"}
+	app.Token = token
+	app.Preferences = &pgtype.JSONB{Bytes: []byte(preferences), Status: pgtype.Present}
+	return app
+}
+
+// 在后台获取名额，返回的 channel 在获取成功或失败后收到结果
+func acquireAsync(l *concurrencyLimiter, app *common.App) chan func() {
+	ch := make(chan func(), 1)
+	go func() {
+		release, err := l.Acquire(context.Background(), app)
+		if err != nil {
+			release = nil
+		}
+		ch <- release
+	}()
+	return ch
+}
+
+// 等待排队的请求数达到 n
+func waitQueued(t *testing.T, l *concurrencyLimiter, n int) {
+	for i := 0; i < 100; i++ {
+		l.mu.Lock()
+		queued := 0
+		for _, tenant := range l.tenants {
+			queued += len(tenant.waiters)
+		}
+		l.mu.Unlock()
+		if queued >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d queued requests", n)
+}
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	l := newConcurrencyLimiter(newConfig(map[string]any{"tenant.concurrency.timeout": "1s"}))
+	app := newConcurrencyApp("a", `{"concurrency": {"max": 1, "queue": 1}}`)
+
+	release, err := l.Acquire(context.Background(), app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting := acquireAsync(l, app)
+	waitQueued(t, l, 1)
+
+	// 队列已满
+	if _, err := l.Acquire(context.Background(), app); err == nil {
+		t.Errorf("expected queue full")
+	} else if e, ok := err.(common.HTTPErrors); !ok || e.StatusCode() != http.StatusTooManyRequests {
+		t.Errorf("expected too many requests, got %v", err)
+	}
+
+	// 释放后排队的请求获得名额，重复释放不影响计数
+	release()
+	release()
+	next := <-waiting
+	if next == nil {
+		t.Fatal("expected queued request granted")
+	}
+	next()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight != 0 || len(l.tenants) != 0 {
+		t.Errorf("expected limiter cleaned up, got %d inflight, %d tenants", l.inflight, len(l.tenants))
+	}
+}
+
+func TestConcurrencyLimiterTimeout(t *testing.T) {
+	l := newConcurrencyLimiter(newConfig(map[string]any{"tenant.concurrency.timeout": "20ms"}))
+	app := newConcurrencyApp("a", `{"concurrency": {"max": 1}}`)
+
+	release, err := l.Acquire(context.Background(), app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	start := time.Now()
+	if _, err := l.Acquire(context.Background(), app); err == nil {
+		t.Errorf("expected timeout")
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("expected waiting for the timeout, got %s", d)
+	}
+
+	// 请求取消时立即返回
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx, app); err == nil {
+		t.Errorf("expected canceled")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := len(l.tenants["a"].waiters); n != 0 {
+		t.Errorf("expected timed out waiters removed, got %d", n)
+	}
+}
+
+func TestConcurrencyLimiterFairness(t *testing.T) {
+	l := newConcurrencyLimiter(newConfig(map[string]any{"tenant.concurrency.max": 2, "tenant.concurrency.timeout": "1s"}))
+	a := newConcurrencyApp("a", `{}`)
+	b := newConcurrencyApp("b", `{}`)
+	c := newConcurrencyApp("c", `{"concurrency": {"weight": 4}}`)
+
+	// a 占满实例的并发
+	releaseA1, _ := l.Acquire(context.Background(), a)
+	releaseA2, _ := l.Acquire(context.Background(), a)
+	waitingA := acquireAsync(l, a)
+	waitQueued(t, l, 1)
+	waitingB := acquireAsync(l, b)
+	waitQueued(t, l, 2)
+
+	// 并发数少的租户先调度
+	releaseA1()
+	releaseB := <-waitingB
+	if releaseB == nil {
+		t.Fatal("expected b granted")
+	}
+	select {
+	case <-waitingA:
+		t.Fatal("expected a still queued")
+	default:
+	}
+
+	releaseA2()
+	if releaseA := <-waitingA; releaseA == nil {
+		t.Fatal("expected a granted")
+	} else {
+		releaseA()
+	}
+	releaseB()
+
+	// 并发数相同时，权重高的租户先调度
+	l = newConcurrencyLimiter(newConfig(map[string]any{"tenant.concurrency.max": 1, "tenant.concurrency.timeout": "1s"}))
+	releaseB, _ = l.Acquire(context.Background(), b)
+	waitingA = acquireAsync(l, a)
+	waitQueued(t, l, 1)
+	waitingC := acquireAsync(l, c)
+	waitQueued(t, l, 2)
+
+	releaseB()
+	releaseC := <-waitingC
+	if releaseC == nil {
+		t.Fatal("expected c granted")
+	}
+	releaseC()
+	if releaseA := <-waitingA; releaseA == nil {
+		t.Fatal("expected a granted")
+	} else {
+		releaseA()
+	}
+}
+
+func TestConcurrencyLimiterBucket(t *testing.T) {
+	l := newConcurrencyLimiter(newConfig(map[string]any{"tenant.concurrency.timeout": "20ms"}))
+	app := newConcurrencyApp("a", `{"concurrency": {"bucket_max": 1}}`)
+
+	release, err := l.Acquire(context.Background(), app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := l.Acquire(context.Background(), app); err == nil {
+		t.Errorf("expected bucket limited")
+	}
+
+	// 其它 bucket 不受影响
+	other := newConcurrencyApp("a", `{"concurrency": {"bucket_max": 1}}`)
+	other.Bucket = "other"
+	if release, err := l.Acquire(context.Background(), other); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	} else {
+		release()
+	}
+}
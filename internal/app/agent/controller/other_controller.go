@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/DODOEX/web3rpcproxy/internal/app/agent/service"
 	"github.com/DODOEX/web3rpcproxy/internal/app/database"
 	"github.com/DODOEX/web3rpcproxy/internal/app/shared"
 	prometheusfasthttp "github.com/gohutool/boot4go-prometheus/fasthttp"
@@ -18,6 +19,7 @@ type otherController struct {
 	amqp    *shared.Amqp
 	rclient *shared.RedisClient
 	db      *database.Database
+	tenants service.TenantService
 }
 
 type OtherController interface {
@@ -30,12 +32,14 @@ func NewOtherController(
 	amqp *shared.Amqp,
 	rclient *shared.RedisClient,
 	db *database.Database,
+	tenants service.TenantService,
 ) OtherController {
 	controller := &otherController{
 		logger:  logger.With().Str("name", "other_controller").Logger(),
 		amqp:    amqp,
 		rclient: rclient,
 		db:      db,
+		tenants: tenants,
 	}
 
 	return controller
@@ -46,6 +50,7 @@ func (o *otherController) HandleK8sHealthz(ctx *fasthttp.RequestCtx) {
 		_ctx, cancel = context.WithTimeoutCause(ctx, 3*time.Second, nil) // fasthttp 默认超时 3s
 		wg           sync.WaitGroup
 		err          error
+		mode         = o.tenants.RateLimitMode()
 	)
 
 	wg.Add(1)
@@ -53,6 +58,11 @@ func (o *otherController) HandleK8sHealthz(ctx *fasthttp.RequestCtx) {
 		defer wg.Done()
 
 		if _err := o.rclient.Client.Ping(_ctx).Err(); _err != nil {
+			// 已降级为本地限流时，Redis 不可用不影响服务
+			if mode == service.RATE_LIMIT_MODE_LOCAL {
+				o.logger.Warn().Err(_err).Msg("Redis is unavailable, using local rate limit")
+				return
+			}
 			if err != nil {
 				return
 			}
@@ -94,6 +104,7 @@ func (o *otherController) HandleK8sHealthz(ctx *fasthttp.RequestCtx) {
 	}
 
 	wg.Wait()
+	ctx.Response.Header.Set("X-Rate-Limit-Mode", mode)
 	if err != nil {
 		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
 	} else {
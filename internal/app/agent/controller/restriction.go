@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+)
+
+// 按租户 preferences 中的配置限制请求来源，未配置的项不限制：
+//
+//	{"restrictions": {
+//		"origins": ["https://*.example.com"],
+//		"referrers": ["https://app.example.com/*"],
+//		"ips": ["10.0.0.0/8", "1.2.3.4"],
+//		"user_agents": ["*Mozilla*"]
+//	}}
+func checkRestrictions(rc reqctx.Reqctxs, app *common.App) error {
+	if origins := app.PreferenceStrings("restrictions.origins"); origins != nil && !matchPatterns(origins, rc.Header("Origin")) {
+		return common.ForbiddenError("Origin is not allowed")
+	}
+
+	if referrers := app.PreferenceStrings("restrictions.referrers"); referrers != nil && !matchPatterns(referrers, rc.Header("Referer")) {
+		return common.ForbiddenError("Referrer is not allowed")
+	}
+
+	if ips := app.PreferenceStrings("restrictions.ips"); ips != nil && !matchIP(ips, rc.Profile().IP) {
+		return common.ForbiddenError("IP is not allowed")
+	}
+
+	if agents := app.PreferenceStrings("restrictions.user_agents"); agents != nil && !matchPatterns(agents, rc.Header("User-Agent")) {
+		return common.ForbiddenError("User agent is not allowed")
+	}
+
+	return nil
+}
+
+// 返回 Access-Control-Allow-Origin 的值，租户限制了 origin 时只允许匹配的 origin
+func allowOrigin(rc reqctx.Reqctxs) string {
+	app := rc.App()
+	if app == nil {
+		return "*"
+	}
+	origins := app.PreferenceStrings("restrictions.origins")
+	if origins == nil {
+		return "*"
+	}
+	if origin := rc.Header("Origin"); matchPatterns(origins, origin) {
+		return origin
+	}
+	return ""
+}
+
+func matchPatterns(patterns []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matchPattern(strings.ToLower(pattern), strings.ToLower(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 简单的通配符匹配，* 匹配任意字符（包括 /）
+func matchPattern(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// 支持 CIDR 和单个 IP
+func matchIP(ranges []string, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, r := range ranges {
+		if strings.Contains(r, "/") {
+			if prefix, err := netip.ParsePrefix(r); err == nil && prefix.Contains(addr) {
+				return true
+			}
+		} else if v, err := netip.ParseAddr(r); err == nil && v.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
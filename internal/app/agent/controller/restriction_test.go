@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"log"
+	"net"
+	"testing"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/knadh/koanf/providers/confmap"
+	"github.com/knadh/koanf/v2"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+func newConfig(value map[string]any) *config.Conf {
+	conf := &config.Conf{Koanf: koanf.New(".")}
+	if err := conf.Load(confmap.Provider(value, "."), nil); err != nil {
+		log.Fatal(err)
+	}
+	return conf
+}
+
+func newReqctx(conf *config.Conf, remote string, headers map[string]string) reqctx.Reqctxs {
+	req := &fasthttp.Request{}
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("/1")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(remote), Port: 443}, nil)
+	ctx.SetUserValue("chain", "1")
+	return reqctx.NewReqctx(ctx, conf, zerolog.Nop())
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		ok      bool
+	}{
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://app.example.com", "https://app.example.com.evil.io", false},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://app.example.com/*", "https://app.example.com/swap?x=1", true},
+		{"https://app.example.com/*", "https://app.example.com", false},
+		{"*mozilla*", "mozilla/5.0", true},
+		{"*mozilla*", "curl/8.0", false},
+		{"*", "", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "acb", false},
+	}
+	for _, test := range tests {
+		if ok := matchPattern(test.pattern, test.s); ok != test.ok {
+			t.Errorf("matchPattern(%q, %q): expected %v, got %v", test.pattern, test.s, test.ok, ok)
+		}
+	}
+
+	// 空值不匹配任何规则
+	if matchPatterns([]string{"*"}, "") {
+		t.Errorf("expected empty value not matched")
+	}
+}
+
+func TestMatchIP(t *testing.T) {
+	tests := []struct {
+		ranges []string
+		ip     string
+		ok     bool
+	}{
+		{[]string{"1.2.3.4"}, "1.2.3.4", true},
+		{[]string{"1.2.3.4"}, "1.2.3.5", false},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, "11.1.2.3", false},
+		{[]string{"10.0.0.0/8"}, "::ffff:10.1.2.3", true},
+		{[]string{"2001:db8::/32"}, "2001:db8::1", true},
+		{[]string{"2001:db8::/32"}, "2001:db9::1", false},
+		{[]string{"invalid", "1.2.3.4"}, "1.2.3.4", true},
+		{[]string{"1.2.3.4"}, "not an ip", false},
+	}
+	for _, test := range tests {
+		if ok := matchIP(test.ranges, test.ip); ok != test.ok {
+			t.Errorf("matchIP(%v, %q): expected %v, got %v", test.ranges, test.ip, test.ok, ok)
+		}
+	}
+}
+
+func TestRestrictionsTrustedProxy(t *testing.T) {
+	conf := newConfig(map[string]any{"app.trusted-proxies": []string{"173.245.48.0/20"}})
+	app := &common.App{}
+	app.Preferences = &pgtype.JSONB{Bytes: []byte(`{"restrictions": {"ips": ["1.2.3.4"]}}`), Status: pgtype.Present}
+	headers := map[string]string{"cf-connecting-ip": "1.2.3.4", "cf-ipcountry": "US"}
+
+	// 来自可信代理时使用代理传递的客户端 IP
+	rc := newReqctx(conf, "173.245.48.1", headers)
+	if err := checkRestrictions(rc, app); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if rc.Profile().IPCountry != "US" {
+		t.Errorf("expected %s, got %s", "US", rc.Profile().IPCountry)
+	}
+
+	// 直接访问时不能通过请求头伪造 IP 与国家
+	rc = newReqctx(conf, "5.6.7.8", headers)
+	if err := checkRestrictions(rc, app); err == nil {
+		t.Errorf("expected forged ip to be restricted")
+	}
+	if rc.Profile().IP != "5.6.7.8" || rc.Profile().IPCountry != "" {
+		t.Errorf("expected connection ip, got %s %s", rc.Profile().IP, rc.Profile().IPCountry)
+	}
+
+	rc = newReqctx(conf, "1.2.3.4", nil)
+	if err := checkRestrictions(rc, app); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
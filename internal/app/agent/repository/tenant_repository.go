@@ -2,13 +2,25 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"github.com/DODOEX/web3rpcproxy/internal/app/database"
 	"github.com/DODOEX/web3rpcproxy/internal/app/database/schema"
+	"gorm.io/gorm"
 )
 
 type ITenantRepository interface {
 	GetTenantByToken(ctx context.Context, token string, info *schema.Tenant) error
+	GetTenantByID(ctx context.Context, id uint64, info *schema.Tenant) error
+	ListTenants(ctx context.Context, offset, limit int) ([]schema.Tenant, int64, error)
+	CreateTenant(ctx context.Context, info *schema.Tenant) error
+	UpdateTenant(ctx context.Context, info *schema.Tenant, values map[string]any) error
+	DeleteTenant(ctx context.Context, id uint64) error
+	GetTenantByKey(ctx context.Context, hash string, info *schema.Tenant, key *schema.ApiKey) error
+	ListApiKeys(ctx context.Context, tenantId uint64) ([]schema.ApiKey, error)
+	CreateApiKey(ctx context.Context, key *schema.ApiKey) error
+	DeleteApiKey(ctx context.Context, id uint64) error
+	TouchApiKey(ctx context.Context, id uint64, t time.Time) error
 }
 
 type _TenantRepository struct {
@@ -24,3 +36,72 @@ func NewTenantRepository(db *database.Database) ITenantRepository {
 func (r *_TenantRepository) GetTenantByToken(ctx context.Context, token string, info *schema.Tenant) error {
 	return r.db.DB.WithContext(ctx).Take(info, "token = ?", token).Error
 }
+
+func (r *_TenantRepository) GetTenantByID(ctx context.Context, id uint64, info *schema.Tenant) error {
+	return r.db.DB.WithContext(ctx).Take(info, "id = ?", id).Error
+}
+
+func (r *_TenantRepository) ListTenants(ctx context.Context, offset, limit int) ([]schema.Tenant, int64, error) {
+	var (
+		tenants []schema.Tenant
+		count   int64
+	)
+	db := r.db.DB.WithContext(ctx).Model(&schema.Tenant{})
+	if err := db.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := db.Order("id").Offset(offset).Limit(limit).Find(&tenants).Error; err != nil {
+		return nil, 0, err
+	}
+	return tenants, count, nil
+}
+
+func (r *_TenantRepository) CreateTenant(ctx context.Context, info *schema.Tenant) error {
+	return r.db.DB.WithContext(ctx).Create(info).Error
+}
+
+// 只更新 values 中的字段，更新后重新读取到 info
+func (r *_TenantRepository) UpdateTenant(ctx context.Context, info *schema.Tenant, values map[string]any) error {
+	db := r.db.DB.WithContext(ctx)
+	if err := db.Model(info).Updates(values).Error; err != nil {
+		return err
+	}
+	return db.Take(info, "id = ?", info.ID).Error
+}
+
+// 同时删除租户的所有 API key
+func (r *_TenantRepository) DeleteTenant(ctx context.Context, id uint64) error {
+	return r.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&schema.ApiKey{}, "tenant_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&schema.Tenant{}, "id = ?", id).Error
+	})
+}
+
+// 按 API key 的 sha256 查询所属的租户
+func (r *_TenantRepository) GetTenantByKey(ctx context.Context, hash string, info *schema.Tenant, key *schema.ApiKey) error {
+	db := r.db.DB.WithContext(ctx)
+	if err := db.Take(key, "hash = ?", hash).Error; err != nil {
+		return err
+	}
+	return db.Take(info, "id = ?", key.TenantID).Error
+}
+
+func (r *_TenantRepository) ListApiKeys(ctx context.Context, tenantId uint64) ([]schema.ApiKey, error) {
+	var keys []schema.ApiKey
+	err := r.db.DB.WithContext(ctx).Order("id").Find(&keys, "tenant_id = ?", tenantId).Error
+	return keys, err
+}
+
+func (r *_TenantRepository) CreateApiKey(ctx context.Context, key *schema.ApiKey) error {
+	return r.db.DB.WithContext(ctx).Create(key).Error
+}
+
+func (r *_TenantRepository) DeleteApiKey(ctx context.Context, id uint64) error {
+	return r.db.DB.WithContext(ctx).Delete(&schema.ApiKey{}, "id = ?", id).Error
+}
+
+func (r *_TenantRepository) TouchApiKey(ctx context.Context, id uint64, t time.Time) error {
+	return r.db.DB.WithContext(ctx).Model(&schema.ApiKey{}).Where("id = ?", id).UpdateColumn("last_used_at", t).Error
+}
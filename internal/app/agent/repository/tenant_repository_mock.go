@@ -12,6 +12,7 @@ package repository
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	schema "github.com/DODOEX/web3rpcproxy/internal/app/database/schema"
 	gomock "go.uber.org/mock/gomock"
@@ -53,3 +54,146 @@ func (mr *MockITenantRepositoryMockRecorder) GetTenantByToken(ctx, token, info a
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTenantByToken", reflect.TypeOf((*MockITenantRepository)(nil).GetTenantByToken), ctx, token, info)
 }
+
+// GetTenantByID mocks base method.
+func (m *MockITenantRepository) GetTenantByID(ctx context.Context, id uint64, info *schema.Tenant) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTenantByID", ctx, id, info)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// GetTenantByID indicates an expected call of GetTenantByID.
+func (mr *MockITenantRepositoryMockRecorder) GetTenantByID(ctx, id, info any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTenantByID", reflect.TypeOf((*MockITenantRepository)(nil).GetTenantByID), ctx, id, info)
+}
+
+// ListTenants mocks base method.
+func (m *MockITenantRepository) ListTenants(ctx context.Context, offset, limit int) ([]schema.Tenant, int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListTenants", ctx, offset, limit)
+	ret0, _ := ret[0].([]schema.Tenant)
+	ret1, _ := ret[1].(int64)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ListTenants indicates an expected call of ListTenants.
+func (mr *MockITenantRepositoryMockRecorder) ListTenants(ctx, offset, limit any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListTenants", reflect.TypeOf((*MockITenantRepository)(nil).ListTenants), ctx, offset, limit)
+}
+
+// CreateTenant mocks base method.
+func (m *MockITenantRepository) CreateTenant(ctx context.Context, info *schema.Tenant) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateTenant", ctx, info)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateTenant indicates an expected call of CreateTenant.
+func (mr *MockITenantRepositoryMockRecorder) CreateTenant(ctx, info any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateTenant", reflect.TypeOf((*MockITenantRepository)(nil).CreateTenant), ctx, info)
+}
+
+// UpdateTenant mocks base method.
+func (m *MockITenantRepository) UpdateTenant(ctx context.Context, info *schema.Tenant, values map[string]any) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateTenant", ctx, info, values)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateTenant indicates an expected call of UpdateTenant.
+func (mr *MockITenantRepositoryMockRecorder) UpdateTenant(ctx, info, values any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateTenant", reflect.TypeOf((*MockITenantRepository)(nil).UpdateTenant), ctx, info, values)
+}
+
+// DeleteTenant mocks base method.
+func (m *MockITenantRepository) DeleteTenant(ctx context.Context, id uint64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteTenant", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteTenant indicates an expected call of DeleteTenant.
+func (mr *MockITenantRepositoryMockRecorder) DeleteTenant(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteTenant", reflect.TypeOf((*MockITenantRepository)(nil).DeleteTenant), ctx, id)
+}
+
+// GetTenantByKey mocks base method.
+func (m *MockITenantRepository) GetTenantByKey(ctx context.Context, hash string, info *schema.Tenant, key *schema.ApiKey) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTenantByKey", ctx, hash, info, key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// GetTenantByKey indicates an expected call of GetTenantByKey.
+func (mr *MockITenantRepositoryMockRecorder) GetTenantByKey(ctx, hash, info, key any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTenantByKey", reflect.TypeOf((*MockITenantRepository)(nil).GetTenantByKey), ctx, hash, info, key)
+}
+
+// ListApiKeys mocks base method.
+func (m *MockITenantRepository) ListApiKeys(ctx context.Context, tenantId uint64) ([]schema.ApiKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListApiKeys", ctx, tenantId)
+	ret0, _ := ret[0].([]schema.ApiKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListApiKeys indicates an expected call of ListApiKeys.
+func (mr *MockITenantRepositoryMockRecorder) ListApiKeys(ctx, tenantId any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListApiKeys", reflect.TypeOf((*MockITenantRepository)(nil).ListApiKeys), ctx, tenantId)
+}
+
+// CreateApiKey mocks base method.
+func (m *MockITenantRepository) CreateApiKey(ctx context.Context, key *schema.ApiKey) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateApiKey", ctx, key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateApiKey indicates an expected call of CreateApiKey.
+func (mr *MockITenantRepositoryMockRecorder) CreateApiKey(ctx, key any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateApiKey", reflect.TypeOf((*MockITenantRepository)(nil).CreateApiKey), ctx, key)
+}
+
+// DeleteApiKey mocks base method.
+func (m *MockITenantRepository) DeleteApiKey(ctx context.Context, id uint64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteApiKey", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteApiKey indicates an expected call of DeleteApiKey.
+func (mr *MockITenantRepositoryMockRecorder) DeleteApiKey(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteApiKey", reflect.TypeOf((*MockITenantRepository)(nil).DeleteApiKey), ctx, id)
+}
+
+// TouchApiKey mocks base method.
+func (m *MockITenantRepository) TouchApiKey(ctx context.Context, id uint64, t time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TouchApiKey", ctx, id, t)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TouchApiKey indicates an expected call of TouchApiKey.
+func (mr *MockITenantRepositoryMockRecorder) TouchApiKey(ctx, id, t any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TouchApiKey", reflect.TypeOf((*MockITenantRepository)(nil).TouchApiKey), ctx, id, t)
+}
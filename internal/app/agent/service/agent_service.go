@@ -2,13 +2,16 @@ package service
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"slices"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/DODOEX/web3rpcproxy/internal/app/shared"
 	"github.com/DODOEX/web3rpcproxy/internal/common"
 	"github.com/DODOEX/web3rpcproxy/internal/core"
 	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
@@ -19,18 +22,58 @@ import (
 	"github.com/DODOEX/web3rpcproxy/utils/helpers"
 	"github.com/allegro/bigcache"
 	"github.com/duke-git/lancet/v2/slice"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 )
 
 type CacheEntry struct {
 	V          any
 	T          int64
-	compressed bool
+	Compressed bool `json:",omitempty"`
 }
 type agentServiceConfig struct {
 	CacheMethods      map[string]string
 	MaxEntryCacheSize int
 	DisableCache      bool
+	// 缓存过期后仍可直接返回，并在后台刷新的时间窗口
+	StaleMethods map[string]time.Duration
+	// 所有节点不可用时，过期缓存最多还可以使用多久
+	MaxStale time.Duration
+	// 是否将规范化后的参数发给节点，否则只用于缓存 key
+	NormalizeRequests bool
+	// 落后最新高度超过该深度的区块才视为已确认，其结果才会写入持久化缓存，eth_getLogs 的分段才会单独缓存
+	FinalityDepth uint64
+	// 内存缓存条目的存活时间，缓存时间加上过期后可用的窗口不能超过它
+	LifeWindow time.Duration
+	// 运行时可通过管理接口修改缓存配置，修改时整体替换 map，不在原 map 上修改
+	rwm sync.RWMutex
+}
+
+func (c *agentServiceConfig) methods() map[string]string {
+	c.rwm.RLock()
+	defer c.rwm.RUnlock()
+	return c.CacheMethods
+}
+
+func (c *agentServiceConfig) stale(method string) time.Duration {
+	c.rwm.RLock()
+	defer c.rwm.RUnlock()
+	return c.StaleMethods[method]
+}
+
+// 过期缓存需要保留的时间
+func (c *agentServiceConfig) retention(method string) time.Duration {
+	return max(c.stale(method), c.MaxStale)
+}
+
+// 缓存条目需要保留的最长时间，即缓存时间与过期后可用窗口之和的最大值
+func cacheWindow(methods map[string]string, stales map[string]time.Duration, maxStale time.Duration) time.Duration {
+	var window time.Duration
+	for method, v := range methods {
+		ttl, _ := time.ParseDuration(v)
+		window = max(window, ttl+max(stales[method], maxStale))
+	}
+	return window
 }
 
 // AgentService
@@ -41,6 +84,26 @@ type agentService struct {
 	jrpcSchema *rpc.JSONRPCSchema
 	cache      *bigcache.BigCache
 	config     *agentServiceConfig
+	// 正在后台刷新的缓存 key
+	revalidating *sync.Map
+	// 各链、各方法的缓存命中统计
+	counters *sync.Map
+	// 持久化缓存，只保存不可变的结果
+	disk *shared.DiskCache
+	// 各链从 eth_blockNumber 结果中观察到的最新高度
+	heads *sync.Map
+	// 禁止调用的方法
+	firewall *methodFirewall
+	// 在本地返回结果的方法
+	responder *localResponder
+	// 发送交易与 bundle 的私有中继
+	relays *privateRelays
+	// 跟踪发出的交易
+	tracker TxTrackerService
+	// 用于向其它实例广播缓存的修改
+	redis *shared.RedisClient
+	// 当前实例的标识
+	instance string
 }
 
 // define interface of IAgentService
@@ -73,6 +136,9 @@ func NewAgentService(
 	jrpcSchema *rpc.JSONRPCSchema,
 	client core.Client,
 	endpointService EndpointService,
+	disk *shared.DiskCache,
+	tracker TxTrackerService,
+	redis *shared.RedisClient,
 ) AgentService {
 	logger = logger.With().Str("name", "agent_service").Logger()
 
@@ -80,6 +146,22 @@ func NewAgentService(
 	_config := &agentServiceConfig{
 		DisableCache:      config.Bool("cache.results.disable", false) || !existExpiryConfig,
 		MaxEntryCacheSize: 512 * 1024, // 512KB
+		StaleMethods:      map[string]time.Duration{},
+		MaxStale:          config.Duration("cache.results.max_stale", 0),
+		NormalizeRequests: config.Bool("jsonrpc.normalize_requests", false),
+		FinalityDepth:     uint64(config.Int64("cache.results.finality_depth", 128)),
+	}
+
+	if config.Exists("cache.results.stale_durations") {
+		staleConfig := map[string]string{}
+		config.Unmarshal("cache.results.stale_durations", &staleConfig)
+		for method, v := range staleConfig {
+			if d, err := time.ParseDuration(v); err == nil {
+				_config.StaleMethods[method] = d
+			} else {
+				logger.Warn().Err(err).Msgf("Invalid stale duration of %s", method)
+			}
+		}
 	}
 
 	if existExpiryConfig {
@@ -97,12 +179,15 @@ func NewAgentService(
 		shards = int(nearestPowerOfTwo(uint(totalCacheSize / 8)))
 	}
 
+	// 条目被淘汰前必须能覆盖过期后仍可使用的窗口
+	window := cacheWindow(_config.CacheMethods, _config.StaleMethods, _config.MaxStale)
+
 	_cacheConfig := bigcache.Config{
 		// number of shards (must be a power of 2)
 		Shards: shards,
 
 		// time after which entry can be evicted
-		LifeWindow: 15 * time.Minute,
+		LifeWindow: max(15*time.Minute, window),
 
 		// Interval between removing expired entries (clean up).
 		// If set to <= 0 then no action is p4erformed.
@@ -124,6 +209,10 @@ func NewAgentService(
 		HardMaxCacheSize: totalCacheSize / 1024 / 1024,
 	}
 	config.Unmarshal("agent.bigcache", &_cacheConfig)
+	if _cacheConfig.LifeWindow < window {
+		log.Fatalf("bigcache life window %s is shorter than the cache window %s", _cacheConfig.LifeWindow, window)
+	}
+	_config.LifeWindow = _cacheConfig.LifeWindow
 
 	cache, initErr := bigcache.NewBigCache(_cacheConfig)
 	if initErr != nil {
@@ -133,23 +222,42 @@ func NewAgentService(
 	logger.Info().Msgf("Cache size: %d MB", _cacheConfig.HardMaxCacheSize)
 
 	service := agentService{
-		config:     _config,
-		client:     client,
-		logger:     logger,
-		jrpcSchema: jrpcSchema,
-		cache:      cache,
-		es:         endpoint.NewSelector(),
+		config:       _config,
+		client:       client,
+		logger:       logger,
+		jrpcSchema:   jrpcSchema,
+		cache:        cache,
+		es:           endpoint.NewSelector(redis),
+		revalidating: &sync.Map{},
+		counters:     &sync.Map{},
+		disk:         disk,
+		heads:        &sync.Map{},
+		firewall:     newMethodFirewall(config),
+		responder:    newLocalResponder(config),
+		relays:       newPrivateRelays(config, logger),
+		tracker:      tracker,
+		redis:        redis,
+		instance:     uuid.NewString(),
 	}
 
 	return service
 }
 
-func (a agentService) Call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint) ([]byte, error) {
+func (a agentService) Call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint) (b []byte, err error) {
 	// 1. 解析到jsonrpc数组
+	limits := loadRequestLimits(rc)
+	if err := limits.checkBody(*rc.Body()); err != nil {
+		return nil, err
+	}
 	jsonrpcs, isBatchCall, err := rpc.UnmarshalJSONRPCs(*rc.Body())
 	if err != nil {
 		return nil, common.BadRequestError(err.Error(), err)
 	}
+	if isBatchCall {
+		if err := limits.checkBatch(len(jsonrpcs)); err != nil {
+			return nil, err
+		}
+	}
 	if len(jsonrpcs) == 0 {
 		if isBatchCall {
 			return rpc.MarshalJSONRPCResults([]rpc.SealedJSONRPCResult{})
@@ -161,6 +269,9 @@ func (a agentService) Call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*
 		if err := a.jrpcSchema.ValidateRequest(jsonrpcs[i].Method(), jsonrpcs[i].Raw()); err != nil {
 			return nil, common.BadRequestError(err.Error(), err)
 		}
+		if a.config.NormalizeRequests {
+			jsonrpcs[i] = rpc.Normalize(jsonrpcs[i])
+		}
 	}
 
 	// 发出实际调用请求
@@ -200,69 +311,181 @@ func (a agentService) Call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*
 		return rpc.MarshalJSONRPCResults(results)
 	}
 
-	// 2. 如果不使用缓存，则直接调用
-	if a.config.DisableCache || !rc.Options().Caches() {
-		return handle(jsonrpcs)
-	}
-
-	// 3. 从缓存中获取结果
 	var (
 		chainId   = rc.ChainID()
+		useCache  = !a.config.DisableCache && rc.Options().Caches()
 		mapping   = map[string][]int{}
 		_jsonrpcs = []rpc.JSONRPCer{}
 		results   = make([]rpc.SealedJSONRPCResult, len(jsonrpcs))
+		resolved  = make([]bool, len(jsonrpcs))
+		// 已过期但可在节点不可用时使用的缓存
+		stales = map[int]any{}
 	)
 
+	appName := "unknown"
+	if rc.App() != nil {
+		appName = rc.App().Name
+	}
+
+	// 按方法防火墙、租户的白名单与请求的大小限制拦截请求，被拦截的请求直接返回错误结果
+	intercepted := ""
+	head := func() uint64 { return a.knownHead(chainId, endpoints) }
+	for i := range jsonrpcs {
+		var (
+			reason = a.firewall.check(rc, jsonrpcs[i].Method())
+			code   = rpc.ERROR_CODE_METHOD_NOT_FOUND
+			by     = "firewall"
+		)
+		if reason == "" {
+			reason, code, by = checkAllowlist(rc, jsonrpcs[i]), rpc.ERROR_CODE_NOT_ALLOWED, "allowlist"
+		}
+		if reason == "" {
+			reason, code, by = limits.check(jsonrpcs[i], head), rpc.ERROR_CODE_LIMIT_EXCEEDED, "limits"
+		}
+		if reason != "" {
+			results[i], resolved[i] = jsonrpcs[i].MakeResult(nil, rpc.NewJSONRPCError(code, reason)), true
+			intercepted = reason
+			utils.TotalIntercepts.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), by).Inc()
+			continue
+		}
+
+		// 静态的方法与配置的规则在本地返回
+		if result, ok := a.responder.respond(rc, jsonrpcs[i]); ok {
+			results[i], resolved[i] = result, true
+			if intercepted == "" {
+				intercepted = helpers.Concat(jsonrpcs[i].Method(), " is answered locally")
+			}
+			utils.TotalIntercepts.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), "responder").Inc()
+		}
+	}
+	// 只有所有调用都在本地处理时才记为拦截并退还消耗；批量调用中有请求节点的调用时按正常请求计费，
+	// 只退还本地处理的调用，避免在批量调用中加入 eth_chainId 等调用绕过计费
+	if intercepted != "" && !slices.Contains(resolved, false) {
+		defer func() {
+			if err == nil {
+				b, err = nil, common.InterceptError(intercepted, b)
+			}
+		}()
+	} else if intercepted != "" {
+		for i := range jsonrpcs {
+			if resolved[i] {
+				rc.Profile().Intercepted = append(rc.Profile().Intercepted, jsonrpcs[i].Method())
+			}
+		}
+	}
+
+	// 2. 拆分大范围的 eth_getLogs，分段并发请求
+	for i := range jsonrpcs {
+		if resolved[i] {
+			continue
+		}
+		result, ok, err := a.getLogs(ctx, rc, endpoints, jsonrpcs[i], useCache)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results[i], resolved[i] = result, true
+		}
+	}
+
+	// 费用相关的方法聚合多个节点的结果
+	for i := range jsonrpcs {
+		if resolved[i] {
+			continue
+		}
+		result, ok, err := a.aggregateFee(ctx, rc, endpoints, jsonrpcs[i], useCache)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results[i], resolved[i] = result, true
+		}
+	}
+
+	// 交易与 bundle 发送到私有中继
+	for i := range jsonrpcs {
+		if resolved[i] {
+			continue
+		}
+		result, ok, err := a.sendPrivate(ctx, rc, jsonrpcs[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results[i], resolved[i] = result, true
+		}
+	}
+
+	// 校验交易并广播到多个节点
+	for i := range jsonrpcs {
+		if resolved[i] {
+			continue
+		}
+		result, ok, err := a.sendRawTransaction(ctx, rc, endpoints, jsonrpcs[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results[i], resolved[i] = result, true
+		}
+	}
+
+	// 3. 如果不使用缓存，则直接调用
+	if !useCache && !slices.Contains(resolved, true) {
+		return handle(jsonrpcs)
+	}
+
+	// 4. 从缓存中获取结果
 	for i := 0; i < len(jsonrpcs); i++ {
-		var v any
+		if resolved[i] {
+			continue
+		}
+
+		var (
+			v      any
+			status = "mem"
+		)
 		// 读 cache
-		if ok, ttl := _WithCache(a.config.CacheMethods, jsonrpcs[i]); ok {
-			key, entry := _CacheKey(chainId, jsonrpcs[i]), &CacheEntry{}
-			err := _GetCache(a.cache, key, entry)
-			if err == nil {
-				if time.UnixMilli(entry.T).Add(ttl).After(time.Now()) {
-					// 解压
-					if entry.compressed {
-						if _v, err := helpers.Decompress(entry.V.([]byte)); err != nil {
-							rc.Logger().Warn().Err(err).Msgf("Failed to compress cache %s", jsonrpcs[i].Method())
-						} else if err = json.Unmarshal(_v, &v); err != nil {
-							rc.Logger().Warn().Err(err).Msgf("Failed to unmarshal cache %s", jsonrpcs[i].Method())
-						}
-					} else {
-						v = entry.V
-					}
+		if ok, ttl := _WithCache(a.config.methods(), jsonrpcs[i]); ok && useCache {
+			key, method := _CacheKey(chainId, jsonrpcs[i]), jsonrpcs[i].Method()
+			if _v, age, ok := a.getCache(rc.Logger(), key, ttl+a.config.retention(method)); ok {
+				switch {
+				case age <= ttl:
+					v = _v
+				case age <= ttl+a.config.stale(method):
+					// 先返回过期的缓存，同时在后台刷新
+					v, status = _v, "stale"
+					rc.SetResponseHeader("X-Cache-Status", "stale")
+					a.revalidate(rc, endpoints, key, jsonrpcs[i])
+				case age <= ttl+a.config.MaxStale:
+					stales[i] = _v
+				}
 
-					if jsonrpcs[i].Method() == "eth_blockNumber" {
-						endpoint := slices.MaxFunc(endpoints, func(a *endpoint.Endpoint, b *endpoint.Endpoint) int {
-							return int(b.BlockNumber() - a.BlockNumber())
-						})
-						if height := endpoint.BlockNumber(); height > 0 {
-							if v == nil {
-								v = height
-							} else if n, err := strconv.ParseUint(v.(string), 16, 64); err == nil {
-								v = slices.Max([]uint64{height, n})
-							}
+				if v != nil && jsonrpcs[i].Method() == "eth_blockNumber" {
+					endpoint := slices.MaxFunc(endpoints, func(a *endpoint.Endpoint, b *endpoint.Endpoint) int {
+						return int(b.BlockNumber() - a.BlockNumber())
+					})
+					if height := endpoint.BlockNumber(); height > 0 {
+						if n, err := strconv.ParseUint(v.(string), 16, 64); err == nil {
+							v = slices.Max([]uint64{height, n})
 						}
 					}
-				} else {
-					go a.cache.Delete(key)
 				}
 			}
 		}
 
-		appName := "unknown"
-		if rc.App() != nil {
-			appName = rc.App().Name
-		}
-
 		if v != nil {
 			// hit, 组装结果
 			results[i] = jsonrpcs[i].MakeResult(v, nil)
-			utils.TotalCaches.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), "mem").Inc()
+			utils.TotalCaches.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), status).Inc()
+			a.counter(chainId, jsonrpcs[i].Method()).hits.Add(1)
 		} else {
 			// miss, 组装新请求
 			_jsonrpcs = append(_jsonrpcs, jsonrpcs[i])
-			utils.TotalCaches.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), "miss").Inc()
+			if useCache {
+				utils.TotalCaches.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), "miss").Inc()
+				a.counter(chainId, jsonrpcs[i].Method()).misses.Add(1)
+			}
 
 			id := fmt.Sprint(jsonrpcs[i].Raw()["id"])
 			if mapping[id] == nil {
@@ -285,7 +508,27 @@ func (a agentService) Call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*
 	data, err := dispatch(_jsonrpcs)
 
 	if err != nil {
-		return nil, err
+		// 所有节点都不可用时，返回仍在最大过期时间内的缓存
+		if len(stales) < len(_jsonrpcs) || !isUnavailableError(err) {
+			return nil, err
+		}
+
+		rc.Logger().Warn().Err(err).Msgf("Serve %d stale results", len(stales))
+		rc.SetResponseHeader("X-Cache-Status", "stale-if-error")
+		for i, v := range stales {
+			results[i] = jsonrpcs[i].MakeResult(v, nil)
+			utils.TotalCaches.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), "stale-if-error").Inc()
+		}
+
+		if isBatchCall {
+			return rpc.MarshalJSONRPCResults(results)
+		}
+		return rpc.MarshalJSONRPCResults(results[0])
+	}
+
+	// 批量调用中只有一个请求且出错时，dispatch 返回的是单个结果
+	if result, ok := data.(rpc.SealedJSONRPCResult); ok && isBatchCall {
+		data = []rpc.SealedJSONRPCResult{result}
 	}
 
 	// 将请求结果填充到最终结果中
@@ -317,6 +560,42 @@ func (a agentService) call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*
 		return nil, common.InternalServerError("No available endpoints")
 	}
 
+	results, err = a.request(ctx, rc, _endpoints, jsonrpcs)
+	if err != nil {
+		return nil, err
+	}
+
+	// 将结果写入缓存
+	if !a.config.DisableCache {
+		for i := range results {
+			// 批量写入缓存
+			if jsonrpc, ok := slice.Find(jsonrpcs, func(_ int, jsonrpc rpc.JSONRPCer) bool {
+				return jsonrpc.Raw()["id"] == results[i].ID
+			}); ok && results[i].Error == nil {
+				if (*jsonrpc).Method() == "eth_blockNumber" {
+					a.observeHead(chainId, results[i].Result)
+				}
+				// 节点落后时返回的 null 不能缓存
+				if results[i].Result == nil && a.client.NullRetryable((*jsonrpc).Method()) {
+					continue
+				}
+				// 如果客户端指定使用缓存参数，才写缓存
+				if ok, _ := _WithCache(a.config.methods(), *jsonrpc); ok {
+					key := _CacheKey(chainId, *jsonrpc)
+					a.setCache(key, results[i].Result)
+					if a.disk.Enabled() && _IsImmutable(*jsonrpc, results[i].Result, a.final(chainId, endpoints)) {
+						a.setDiskCache(key, results[i].Result)
+					}
+				}
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// 向已选好的节点发出请求，不读写缓存
+func (a agentService) request(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpcs []rpc.JSONRPCer) (results []rpc.SealedJSONRPCResult, err error) {
 	// 改写 ID
 	var (
 		prefix    = helpers.Short(rc.ReqID())
@@ -329,7 +608,7 @@ func (a agentService) call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*
 	}
 
 	// 请求节点（没有命中缓存的jsonrpc）
-	_results, err := a.client.Request(ctx, rc, _endpoints, _jsonrpcs)
+	_results, err := a.client.Request(ctx, rc, endpoints, _jsonrpcs)
 
 	if err != nil {
 		return nil, err
@@ -360,53 +639,136 @@ func (a agentService) call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*
 		}
 	}
 
-	// 将结果写入缓存
-	if !a.config.DisableCache {
-		for i := range results {
-			// 批量写入缓存
-			if jsonrpc, ok := slice.Find(jsonrpcs, func(_ int, jsonrpc rpc.JSONRPCer) bool {
-				return jsonrpc.Raw()["id"] == results[i].ID
-			}); ok && _results[i].Type() == rpc.JSONRPC_RESPONSE {
-				// 如果客户端指定使用缓存参数，才写缓存
-				if ok, _ := _WithCache(a.config.CacheMethods, *jsonrpc); ok {
-					key := _CacheKey(chainId, *jsonrpc)
-					if data, err := json.Marshal(results[i].Result); err == nil {
-						if len(data) > a.config.MaxEntryCacheSize {
-							// 压缩
-							go func(k string, v []byte) {
-								defer func() {
-									if err := recover(); err != nil {
-										a.logger.Error().Interface("error", err).Msg("Failed to set cache result")
-									}
-								}()
-
-								if compressed, err := helpers.Compress(v); err != nil {
-									a.logger.Error().Err(err).Msg("Failed to compress")
-								} else {
-									// skip set cache, data is bigger than cache size after compression
-									if len(compressed) > a.config.MaxEntryCacheSize {
-										return
-									}
-									v = compressed
-								}
-
-								// 写内存
-								if err := _SetCache(a.cache, k, &CacheEntry{V: v, T: time.Now().UnixMilli(), compressed: true}); err != nil {
-									a.logger.Error().Err(err).Msg("Cache set error")
-								}
-							}(key, data)
-						} else {
-							if err := _SetCache(a.cache, key, &CacheEntry{V: results[i].Result, T: time.Now().UnixMilli()}); err != nil {
-								a.logger.Error().Err(err).Msg("Cache set error")
-							}
-						}
+	return results, nil
+}
 
-						a.logger.Debug().Msgf("Cache capacity: %d, len: %d", a.cache.Capacity(), a.cache.Len())
-					}
+// 读缓存，返回缓存的值及已缓存的时长，超过保留时长的缓存会被异步删除
+func (a agentService) getCache(logger *zerolog.Logger, key string, retention time.Duration) (v any, age time.Duration, ok bool) {
+	entry := &CacheEntry{}
+	if err := _GetCache(a.cache, key, entry); err != nil {
+		// 内存中没有时从持久化缓存中读取，并写回内存
+		if data, ok := a.disk.Get(key); ok {
+			if err := json.Unmarshal(data, &v); err != nil {
+				logger.Warn().Err(err).Msgf("Failed to unmarshal disk cache %s", key)
+				return nil, 0, false
+			}
+			a.setCache(key, v)
+			return v, 0, true
+		}
+		return nil, 0, false
+	}
+
+	age = time.Since(time.UnixMilli(entry.T))
+	if age >= retention {
+		go a.cache.Delete(key)
+		return nil, 0, false
+	}
+
+	// 解压，压缩后的数据经过 json 序列化后是 base64 字符串
+	if entry.Compressed {
+		if b, err := base64.StdEncoding.DecodeString(fmt.Sprint(entry.V)); err != nil {
+			logger.Warn().Err(err).Msgf("Failed to decode cache %s", key)
+		} else if _v, err := helpers.Decompress(b); err != nil {
+			logger.Warn().Err(err).Msgf("Failed to compress cache %s", key)
+		} else if err = json.Unmarshal(_v, &v); err != nil {
+			logger.Warn().Err(err).Msgf("Failed to unmarshal cache %s", key)
+		}
+	} else {
+		v = entry.V
+	}
+
+	return v, age, true
+}
+
+// 判断区块是否已确认，最新高度未知时都视为未确认
+func (a agentService) final(chainId common.ChainId, endpoints []*endpoint.Endpoint) func(uint64) bool {
+	head := a.knownHead(chainId, endpoints)
+	return func(n uint64) bool {
+		return head > 0 && n+a.config.FinalityDepth <= head
+	}
+}
+
+func (a agentService) setDiskCache(key string, value any) {
+	if !a.disk.Enabled() {
+		return
+	}
+	if data, err := json.Marshal(value); err == nil {
+		a.disk.Set(key, data)
+	}
+}
+
+// 后台刷新缓存，同一个 key 同时只会刷新一次
+func (a agentService) revalidate(rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, key string, jsonrpc rpc.JSONRPCer) {
+	if _, loaded := a.revalidating.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	// 请求结束后 fasthttp 会复用请求上下文，后台任务需要使用独立的上下文
+	_rc := reqctx.Detach(rc)
+	go func() {
+		defer a.revalidating.Delete(key)
+		defer func() {
+			if err := recover(); err != nil {
+				a.logger.Error().Interface("error", err).Msg("Failed to revalidate cache")
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), _rc.Options().Timeout())
+		defer cancel()
+
+		if _, err := a.call(ctx, _rc, endpoints, []rpc.JSONRPCer{jsonrpc}); err != nil {
+			_rc.Logger().Warn().Err(err).Msgf("Failed to revalidate %s", key)
+		}
+	}()
+}
+
+// 节点不可用导致的错误，而不是请求本身的问题
+func isUnavailableError(err error) bool {
+	if e, ok := err.(common.HTTPErrors); ok {
+		switch e.QueryStatus() {
+		case common.Reject, common.Intercept:
+			return false
+		}
+	}
+	return true
+}
+
+// 写缓存，超过单条缓存大小的结果会先压缩
+func (a agentService) setCache(key string, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+
+	if len(data) > a.config.MaxEntryCacheSize {
+		// 压缩
+		go func(k string, v []byte) {
+			defer func() {
+				if err := recover(); err != nil {
+					a.logger.Error().Interface("error", err).Msg("Failed to set cache result")
+				}
+			}()
+
+			if compressed, err := helpers.Compress(v); err != nil {
+				a.logger.Error().Err(err).Msg("Failed to compress")
+			} else {
+				// skip set cache, data is bigger than cache size after compression
+				if len(compressed) > a.config.MaxEntryCacheSize {
+					return
 				}
+				v = compressed
 			}
+
+			// 写内存
+			if err := _SetCache(a.cache, k, &CacheEntry{V: v, T: time.Now().UnixMilli(), Compressed: true}); err != nil {
+				a.logger.Error().Err(err).Msg("Cache set error")
+			}
+		}(key, data)
+	} else {
+		if err := _SetCache(a.cache, key, &CacheEntry{V: value, T: time.Now().UnixMilli()}); err != nil {
+			a.logger.Error().Err(err).Msg("Cache set error")
 		}
 	}
 
-	return results, nil
+	a.logger.Debug().Msgf("Cache capacity: %d, len: %d", a.cache.Capacity(), a.cache.Len())
 }
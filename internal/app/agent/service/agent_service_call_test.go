@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/allegro/bigcache"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+// 按请求逐个返回结果的节点客户端，记录每次请求的方法
+type fakeClient struct {
+	mu      sync.Mutex
+	methods []string
+	handle  func(e *endpoint.Endpoint, jsonrpc rpc.SealedJSONRPC) map[string]any
+}
+
+func (c *fakeClient) Request(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpcs []rpc.SealedJSONRPC) ([]rpc.JSONRPCResulter, error) {
+	raws := make([]map[string]any, len(jsonrpcs))
+	for i := range jsonrpcs {
+		c.mu.Lock()
+		c.methods = append(c.methods, jsonrpcs[i].Method)
+		c.mu.Unlock()
+
+		raws[i] = c.handle(endpoints[0], jsonrpcs[i])
+		if raws[i] == nil {
+			return nil, common.UpstreamServerError("Endpoint is unavailable")
+		}
+		raws[i]["jsonrpc"], raws[i]["id"] = "2.0", jsonrpcs[i].ID
+	}
+	b, _ := json.Marshal(raws)
+	results, _, err := rpc.UnmarshalJSONRPCResults(b)
+	return results, err
+}
+
+func (c *fakeClient) NullRetryable(method string) bool {
+	return method == "eth_getTransactionReceipt"
+}
+
+func (c *fakeClient) called() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.methods...)
+}
+
+func newTestEndpoints(urls ...string) []*endpoint.Endpoint {
+	endpoints := make([]*endpoint.Endpoint, len(urls))
+	for i := range urls {
+		u, _ := url.Parse(urls[i])
+		endpoints[i] = endpoint.New(u)
+	}
+	return endpoints
+}
+
+func newTestReqctx(conf *config.Conf, body string) reqctx.Reqctxs {
+	return newTestReqctxWithURI(conf, "/1", body)
+}
+
+func newTestReqctxWithURI(conf *config.Conf, uri string, body string) reqctx.Reqctxs {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.SetBodyString(body)
+	ctx.SetUserValue("chain", "1")
+	return reqctx.NewReqctx(ctx, conf, zerolog.Nop())
+}
+
+func newTestAgentService(t *testing.T, conf *config.Conf, client *fakeClient, methods map[string]string) agentService {
+	cache, err := bigcache.NewBigCache(bigcache.DefaultConfig(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return agentService{
+		logger:       zerolog.Nop(),
+		client:       client,
+		es:           endpoint.NewSelector(nil),
+		cache:        cache,
+		config:       &agentServiceConfig{CacheMethods: methods, DisableCache: len(methods) <= 0, MaxEntryCacheSize: 512 * 1024, StaleMethods: map[string]time.Duration{}, LifeWindow: time.Hour},
+		revalidating: &sync.Map{},
+		counters:     &sync.Map{},
+		heads:        &sync.Map{},
+		firewall:     newMethodFirewall(conf),
+		responder:    newLocalResponder(conf),
+		relays:       newPrivateRelays(conf, zerolog.Nop()),
+	}
+}
+
+func TestCallMixedBatch(t *testing.T) {
+	conf := newConfig(map[string]any{})
+	client := &fakeClient{handle: func(e *endpoint.Endpoint, jsonrpc rpc.SealedJSONRPC) map[string]any {
+		return map[string]any{"result": "0x10"}
+	}}
+	a := newTestAgentService(t, conf, client, nil)
+	endpoints := newTestEndpoints("http://a")
+
+	// 批量调用中有请求节点的调用，按正常请求计费
+	body := `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]},{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber","params":[]},{"jsonrpc":"2.0","id":3,"method":"admin_peers","params":[]}]`
+	rc := newTestReqctx(conf, body)
+	b, err := a.Call(context.Background(), rc, endpoints)
+	if err != nil {
+		t.Fatalf("mixed batch should not be intercepted: %v", err)
+	}
+	var results []map[string]any
+	if err := json.Unmarshal(b, &results); err != nil || len(results) != 3 {
+		t.Fatalf("unexpected results: %s", b)
+	}
+	if results[0]["result"] != "0x1" || results[1]["result"] != "0x10" || results[2]["error"] == nil {
+		t.Errorf("unexpected results: %s", b)
+	}
+	if called := client.called(); len(called) != 1 || called[0] != "eth_blockNumber" {
+		t.Errorf("only eth_blockNumber should be dispatched, got %v", called)
+	}
+	// 本地处理的调用记录在 profile 中，由控制器退还
+	if p := rc.Profile().Intercepted; len(p) != 2 || p[0] != "eth_chainId" || p[1] != "admin_peers" {
+		t.Errorf("unexpected intercepted methods %v", p)
+	}
+
+	// 所有调用都在本地处理时记为拦截
+	body = `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]},{"jsonrpc":"2.0","id":2,"method":"admin_peers","params":[]}]`
+	_, err = a.Call(context.Background(), newTestReqctx(conf, body), endpoints)
+	if e, ok := err.(common.HTTPErrors); !ok || e.QueryStatus() != common.Intercept {
+		t.Errorf("local batch should be intercepted, got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+)
+
+// 按租户的白名单检查请求，返回不允许的原因，允许时返回空字符串；
+// 白名单配置在租户的 preferences 中：
+//
+//	{"allowlist": {"chains": ["1", "bsc"], "methods": ["eth_*"], "contracts": ["0x..."]}}
+func checkAllowlist(rc reqctx.Reqctxs, jsonrpc rpc.JSONRPCer) string {
+	options := rc.Options()
+
+	if chains := options.AllowChainIDs(); chains != nil && !allowChain(rc, chains) {
+		return "chain is not allowed"
+	}
+
+	if methods := options.AllowMethods(); methods != nil && !allowMethod(methods, jsonrpc.Method()) {
+		return helpers.Concat("method ", jsonrpc.Method(), " is not allowed")
+	}
+
+	// API key、JWT 的权限范围在租户白名单的基础上进一步限制
+	if app := rc.App(); app != nil {
+		if chains := app.Scope("chains"); chains != nil && !allowChain(rc, chains) {
+			return "chain is out of the credential scopes"
+		}
+		if methods := app.Scope("methods"); methods != nil && !allowMethod(methods, jsonrpc.Method()) {
+			return helpers.Concat("method ", jsonrpc.Method(), " is out of the credential scopes")
+		}
+	}
+
+	if contracts := options.AllowContractAddresses(); contracts != nil {
+		addresses, ok := contractAddresses(jsonrpc)
+		if !ok {
+			return "contract address is required"
+		}
+		for _, address := range addresses {
+			if !slices.Contains(contracts, address) {
+				return helpers.Concat("contract ", address, " is not allowed")
+			}
+		}
+	}
+
+	return ""
+}
+
+// 白名单中可以是链 ID，也可以是链代码
+func allowChain(rc reqctx.Reqctxs, chains []string) bool {
+	chainId := rc.ChainID()
+	for _, chain := range chains {
+		if chain == fmt.Sprint(chainId) {
+			return true
+		}
+		if v, ok := rc.Config().Get(helpers.Concat("chains.", chain)).(common.EndpointChain); ok && v.ChainID == chainId {
+			return true
+		}
+	}
+	return false
+}
+
+// 支持通配符，如 eth_*、debug_trace*
+func allowMethod(methods []string, method string) bool {
+	for _, pattern := range methods {
+		if ok, err := path.Match(pattern, method); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回请求访问的合约地址（小写），不访问合约的方法返回 nil；
+// 访问合约但无法确定地址时 ok 为 false，如不指定 address 的 eth_getLogs
+func contractAddresses(jsonrpc rpc.JSONRPCer) (addresses []string, ok bool) {
+	params := jsonrpc.Params()
+
+	switch jsonrpc.Method() {
+	// 参数为交易对象的方法，按 to 确定访问的合约
+	case "eth_call", "eth_estimateGas", "eth_createAccessList", "debug_traceCall", "trace_call":
+		if len(params) == 0 {
+			return nil, false
+		}
+		tx, _ := params[0].(map[string]any)
+		to, _ := tx["to"].(string)
+		if to == "" {
+			return nil, false
+		}
+		return []string{strings.ToLower(to)}, true
+	// 第一个参数为地址的方法
+	case "eth_getCode", "eth_getStorageAt", "eth_getBalance", "eth_getProof":
+		if len(params) == 0 {
+			return nil, false
+		}
+		address, _ := params[0].(string)
+		if address == "" {
+			return nil, false
+		}
+		return []string{strings.ToLower(address)}, true
+	case "eth_getLogs", "eth_newFilter":
+		if len(params) == 0 {
+			return nil, false
+		}
+		filter, _ := params[0].(map[string]any)
+		switch address := filter["address"].(type) {
+		case string:
+			return []string{strings.ToLower(address)}, true
+		case []any:
+			if len(address) == 0 {
+				return nil, false
+			}
+			for i := range address {
+				s, _ := address[i].(string)
+				if s == "" {
+					return nil, false
+				}
+				addresses = append(addresses, strings.ToLower(s))
+			}
+			return addresses, true
+		}
+		return nil, false
+	// 一次访问多个合约的方法，以及经私有中继发送的交易与 bundle，不逐个解析，有合约白名单时拒绝
+	case "eth_callMany", "eth_simulateV1", "debug_traceCallMany", "trace_callMany", "eth_callBundle",
+		"eth_sendBundle", "mev_sendBundle", "eth_sendPrivateTransaction", "eth_sendPrivateRawTransaction":
+		return nil, false
+	case "eth_sendRawTransaction":
+		if len(params) == 0 {
+			return nil, false
+		}
+		raw, _ := params[0].(string)
+		tx, err := rpc.DecodeRawTransaction(raw)
+		// 创建合约的交易没有 to
+		if err != nil || tx.To == "" {
+			return nil, false
+		}
+		return []string{tx.To}, true
+	}
+
+	return nil, true
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/jackc/pgx/pgtype"
+)
+
+func TestContractAddresses(t *testing.T) {
+	const contract = "0x6B175474E89094C44Da98b954EedeAC495271d0F"
+	tests := []struct {
+		method    string
+		params    []any
+		addresses []string
+		ok        bool
+	}{
+		{"eth_blockNumber", []any{}, nil, true},
+		{"eth_call", []any{map[string]any{"to": contract}, "latest"}, []string{"0x6b175474e89094c44da98b954eedeac495271d0f"}, true},
+		{"eth_call", []any{map[string]any{"data": "0x"}, "latest"}, nil, false},
+		{"eth_estimateGas", []any{map[string]any{"to": contract}}, []string{"0x6b175474e89094c44da98b954eedeac495271d0f"}, true},
+		{"eth_estimateGas", []any{map[string]any{"data": "0x60"}}, nil, false},
+		{"eth_createAccessList", []any{map[string]any{"to": contract}, "latest"}, []string{"0x6b175474e89094c44da98b954eedeac495271d0f"}, true},
+		{"debug_traceCall", []any{map[string]any{"to": contract}, "latest", map[string]any{}}, []string{"0x6b175474e89094c44da98b954eedeac495271d0f"}, true},
+		{"eth_getCode", []any{contract, "latest"}, []string{"0x6b175474e89094c44da98b954eedeac495271d0f"}, true},
+		{"eth_getStorageAt", []any{contract, "0x0", "latest"}, []string{"0x6b175474e89094c44da98b954eedeac495271d0f"}, true},
+		{"eth_getBalance", []any{contract, "latest"}, []string{"0x6b175474e89094c44da98b954eedeac495271d0f"}, true},
+		{"eth_getBalance", []any{}, nil, false},
+		{"eth_getLogs", []any{map[string]any{"address": []any{contract, "0xA"}}}, []string{"0x6b175474e89094c44da98b954eedeac495271d0f", "0xa"}, true},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x1"}}, nil, false},
+		{"eth_newFilter", []any{map[string]any{"address": contract}}, []string{"0x6b175474e89094c44da98b954eedeac495271d0f"}, true},
+		{"eth_simulateV1", []any{map[string]any{}}, nil, false},
+		{"eth_sendBundle", []any{map[string]any{"txs": []any{"0x02"}}}, nil, false},
+		{"mev_sendBundle", []any{map[string]any{}}, nil, false},
+		{"eth_sendPrivateTransaction", []any{map[string]any{"tx": "0x02"}}, nil, false},
+		{"eth_sendPrivateRawTransaction", []any{"0x02"}, nil, false},
+	}
+
+	for _, test := range tests {
+		addresses, ok := contractAddresses(rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1, "method": test.method, "params": test.params}))
+		if ok != test.ok || !slices.Equal(addresses, test.addresses) {
+			t.Errorf("%s %v: expected %v %v, got %v %v", test.method, test.params, test.addresses, test.ok, addresses, ok)
+		}
+	}
+}
+
+func TestCallAllowlistMixedBatch(t *testing.T) {
+	conf := newConfig(map[string]any{})
+	client := &fakeClient{handle: func(e *endpoint.Endpoint, jsonrpc rpc.SealedJSONRPC) map[string]any {
+		return map[string]any{"result": "0x10"}
+	}}
+	a := newTestAgentService(t, conf, client, nil)
+
+	app := &common.App{TenantInfo: createTenant("abc")}
+	app.Preferences = &pgtype.JSONB{
+		Bytes:  []byte(`{"allowlist": {"methods": ["eth_blockNumber", "eth_call"]}}`),
+		Status: pgtype.Present,
+	}
+	body := `[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]},{"jsonrpc":"2.0","id":2,"method":"eth_getBalance","params":["0x6b175474e89094c44da98b954eedeac495271d0f","latest"]}]`
+	rc := newTestReqctx(conf, body)
+	rc.SetApp(app)
+
+	// 被白名单拦截的调用不计费，批量调用仍按请求节点的调用计费
+	if _, err := a.Call(context.Background(), rc, newTestEndpoints("http://a")); err != nil {
+		t.Fatalf("mixed batch should not be intercepted: %v", err)
+	}
+	if p := rc.Profile().Intercepted; len(p) != 1 || p[0] != "eth_getBalance" {
+		t.Errorf("unexpected intercepted methods %v", p)
+	}
+}
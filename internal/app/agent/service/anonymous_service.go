@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/app/shared"
+	rdbscripts "github.com/DODOEX/web3rpcproxy/internal/app/shared/redis_scripts"
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+	"github.com/rs/zerolog"
+)
+
+// 未开启租户时，按客户端 IP 匿名限流
+type AnonymousService interface {
+	Enabled() bool
+	Access(ctx context.Context, ip string, chainId common.ChainId, cost int64) (*AnonymousAccess, error)
+}
+
+// 匿名访问的限流结果，Balance 为负数时表示缺少的额度
+type AnonymousAccess struct {
+	Capacity float64
+	Rate     float64
+	Balance  int64
+}
+
+type anonymousLimit struct {
+	Capacity float64 `koanf:"capacity"`
+	Rate     float64 `koanf:"rate"`
+}
+
+type anonymousConfig struct {
+	Enable bool `koanf:"enable"`
+	// redis 为多个实例共享，local 为每个实例单独限流；Redis 不可用时使用 local
+	Store string `koanf:"store"`
+	// 默认的令牌桶容量与恢复速率，为 0 时不限制
+	Capacity float64 `koanf:"capacity"`
+	Rate     float64 `koanf:"rate"`
+	// 按链覆盖默认的限流，可以是链 ID 或链代码
+	Chains map[string]anonymousLimit `koanf:"chains"`
+}
+
+type anonymousService struct {
+	logger    zerolog.Logger
+	config    *config.Conf
+	redis     *shared.RedisClient
+	scripts   shared.Scripts
+	limiter   *localLimiter
+	anonymous anonymousConfig
+}
+
+func NewAnonymousService(config *config.Conf, logger zerolog.Logger, redis *shared.RedisClient, scripts shared.Scripts) AnonymousService {
+	c := anonymousConfig{Store: "redis"}
+	if config != nil && !config.Bool("tenant.enable", false) {
+		config.Unmarshal("anonymous", &c)
+	}
+
+	service := &anonymousService{
+		logger:    logger.With().Str("name", "anonymous_service").Logger(),
+		config:    config,
+		redis:     redis,
+		scripts:   scripts,
+		limiter:   newLocalLimiter(1),
+		anonymous: c,
+	}
+
+	if c.Enable {
+		go service.prune()
+	}
+
+	return service
+}
+
+func (s *anonymousService) Enabled() bool {
+	return s.anonymous.Enable
+}
+
+// 链的限流配置，未单独配置的链使用默认值
+func (s *anonymousService) limit(chainId common.ChainId) anonymousLimit {
+	for chain, limit := range s.anonymous.Chains {
+		if chain == fmt.Sprint(chainId) {
+			return limit
+		}
+		if v, ok := s.config.Get(helpers.Concat("chains.", chain)).(common.EndpointChain); ok && v.ChainID == chainId {
+			return limit
+		}
+	}
+	return anonymousLimit{Capacity: s.anonymous.Capacity, Rate: s.anonymous.Rate}
+}
+
+func _AnonymousKey(ip string, chainId common.ChainId) string {
+	return helpers.Concat("anonymous#", ip, ":", fmt.Sprint(chainId))
+}
+
+// 扣除 IP 在该链上的额度，未配置限流时返回 nil
+func (s *anonymousService) Access(ctx context.Context, ip string, chainId common.ChainId, cost int64) (*AnonymousAccess, error) {
+	limit := s.limit(chainId)
+	if limit.Capacity <= 0 || limit.Rate <= 0 {
+		return nil, nil
+	}
+
+	access := &AnonymousAccess{Capacity: limit.Capacity, Rate: limit.Rate}
+	key := _AnonymousKey(ip, chainId)
+
+	if s.anonymous.Store == "local" {
+		access.Balance = s.limiter.take(key, int64(limit.Capacity), int64(limit.Rate), cost)
+		return access, nil
+	}
+
+	balance, err := s.scripts.Balance(ctx, key, int64(limit.Capacity), int64(limit.Rate), cost)
+	if err != nil {
+		if !isRedisUnavailable(ctx, err) {
+			return nil, err
+		}
+		s.logger.Warn().Err(err).Msg("Redis is unavailable, fall back to local rate limit")
+		access.Balance = s.limiter.take(key, int64(limit.Capacity), int64(limit.Rate), cost)
+		return access, nil
+	}
+	access.Balance = balance
+
+	go s.touch(key)
+
+	return access, nil
+}
+
+// 记录最后访问的时间用于计算恢复量，长时间不访问的 IP 自动过期
+func (s *anonymousService) touch(key string) {
+	defer func() {
+		if err := recover(); err != nil {
+			s.logger.Error().Interface("error", err).Msg("Panic to touch() goroutine")
+		}
+	}()
+
+	pipeline := s.redis.Client.Pipeline()
+	pipeline.HSet(context.Background(), key, rdbscripts.CacheFieldLastTime, time.Now().UnixMilli())
+	pipeline.Expire(context.Background(), key, 24*time.Hour)
+	if _, err := pipeline.Exec(context.Background()); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to save anonymous balance")
+	}
+}
+
+func (s *anonymousService) prune() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.limiter.prune(10 * time.Minute)
+	}
+}
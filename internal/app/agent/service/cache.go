@@ -15,10 +15,8 @@ import (
 )
 
 func _CacheKey(chainId common.ChainId, jsonrpc rpc.JSONRPCer) string {
-	params := jsonrpc.Raw()["params"]
-	if params == nil {
-		params = []any{}
-	}
+	// 规范化参数，使写法不同但语义相同的请求命中同一个缓存
+	params := rpc.NormalizeParams(jsonrpc.Method(), jsonrpc.Params())
 	_params := ""
 	if b, err := json.Marshal(params); err == nil && len(b) > 0 {
 		_params = helpers.Short(string(b))
@@ -33,6 +31,8 @@ func _WithCache(config map[string]string, jsonrpc rpc.JSONRPCer) (ok bool, ttl t
 		notCacheTags = []string{"earliest", "latest", "pending"}
 		v            = config[jsonrpc.Method()]
 	)
+	// 省略的区块参数会补全为 latest
+	jsonrpc = rpc.Normalize(jsonrpc)
 
 	if v != "" {
 		ok := true
@@ -113,3 +113,77 @@ func _GetCache[T any](cache *bigcache.BigCache, k string, i T) error {
 	}
 	return err
 }
+
+// 按哈希查询的数据不会变化
+var immutableMethods = []string{
+	"eth_chainId",
+	"net_version",
+	"eth_getBlockByHash",
+	"eth_getBlockTransactionCountByHash",
+	"eth_getUncleCountByBlockHash",
+	"eth_getUncleByBlockHashAndIndex",
+	"eth_getTransactionByBlockHashAndIndex",
+}
+
+// 按区块号查询的方法，值为区块参数的位置，区块已确认时结果不会变化
+var blockParamMethods = map[string]int{
+	"eth_getBlockByNumber":                    0,
+	"eth_getBlockReceipts":                    0,
+	"eth_getBlockTransactionCountByNumber":    0,
+	"eth_getTransactionByBlockNumberAndIndex": 0,
+	"eth_getUncleByBlockNumberAndIndex":       0,
+	"eth_getUncleCountByBlockNumber":          0,
+	"eth_getBalance":                          1,
+	"eth_getCode":                             1,
+	"eth_getTransactionCount":                 1,
+	"eth_call":                                1,
+	"eth_getStorageAt":                        2,
+	"eth_getProof":                            2,
+}
+
+// 判断结果是否不可变，可以写入持久化缓存；final 判断区块是否已确认
+func _IsImmutable(jsonrpc rpc.JSONRPCer, result any, final func(uint64) bool) bool {
+	if result == nil {
+		return false
+	}
+
+	jsonrpc = rpc.Normalize(jsonrpc)
+	method, params := jsonrpc.Method(), jsonrpc.Params()
+	if slice.Contain(immutableMethods, method) {
+		return true
+	}
+
+	isFinal := func(block any) bool {
+		switch v := block.(type) {
+		case string:
+			n, ok := helpers.ParseHexUint64(v)
+			return ok && final(n)
+		case map[string]any:
+			// EIP-1898
+			return v["blockHash"] != nil
+		}
+		return false
+	}
+
+	switch method {
+	case "eth_getTransactionByHash", "eth_getTransactionReceipt":
+		// 交易所在的区块被重组时结果会变化
+		if v, ok := result.(map[string]any); ok {
+			return isFinal(v["blockNumber"])
+		}
+		return false
+	case "eth_getLogs":
+		if len(params) != 1 {
+			return false
+		}
+		if filter, ok := params[0].(map[string]any); ok {
+			return filter["blockHash"] != nil || isFinal(filter["toBlock"])
+		}
+		return false
+	}
+
+	if i, ok := blockParamMethods[method]; ok && i < len(params) {
+		return isFinal(params[i])
+	}
+	return false
+}
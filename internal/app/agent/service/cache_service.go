@@ -0,0 +1,373 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+)
+
+// 结果缓存的管理接口，由 agentService 实现
+type CacheService interface {
+	Stats() CacheStats
+	Lookup(chainId common.ChainId, method string, params []any) (*CacheLookup, bool)
+	Purge(chainId common.ChainId, method string) int
+	PurgeKey(key string) bool
+	TTLs() map[string]CacheTTL
+	SetTTL(method string, ttl CacheTTL) common.HTTPErrors
+	Subscribe(ctx context.Context) error
+}
+
+// 清除缓存、修改缓存时间后，通知其它实例执行同样的操作
+const cacheInvalidateChannel = "cache#invalidate"
+
+const (
+	cacheInvalidatePurge    = "purge"
+	cacheInvalidatePurgeKey = "purge_key"
+	cacheInvalidateTTL      = "ttl"
+)
+
+type cacheInvalidation struct {
+	// 发出通知的实例，收到自己的通知时忽略
+	Origin  string         `json:"origin"`
+	Op      string         `json:"op"`
+	ChainID common.ChainId `json:"chainId,omitempty"`
+	Method  string         `json:"method,omitempty"`
+	Key     string         `json:"key,omitempty"`
+	TTL     *CacheTTL      `json:"ttl,omitempty"`
+}
+
+type CacheStats struct {
+	Entries    int                `json:"entries"`
+	Capacity   int                `json:"capacity"` // bytes
+	Hits       int64              `json:"hits"`
+	Misses     int64              `json:"misses"`
+	DelHits    int64              `json:"delHits"`
+	DelMisses  int64              `json:"delMisses"`
+	Collisions int64              `json:"collisions"`
+	Methods    []CacheMethodStats `json:"methods"`
+}
+
+type CacheMethodStats struct {
+	ChainID common.ChainId `json:"chainId"`
+	Method  string         `json:"method"`
+	Entries int            `json:"entries"`
+	Bytes   int            `json:"bytes"`
+	Hits    int64          `json:"hits"`
+	Misses  int64          `json:"misses"`
+	HitRate float64        `json:"hitRate"`
+}
+
+type CacheLookup struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+	Age   string `json:"age"`
+	TTL   string `json:"ttl"`
+	Stale bool   `json:"stale"`
+}
+
+type CacheTTL struct {
+	TTL   string `json:"ttl"`
+	Stale string `json:"stale,omitempty"`
+}
+
+type cacheCounter struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func NewCacheService(agentService AgentService) CacheService {
+	return agentService.(CacheService)
+}
+
+func _CounterKey(chainId common.ChainId, method string) string {
+	return strconv.FormatUint(chainId, 10) + ":" + method
+}
+
+// 解析缓存 key 中的链和方法，见 _CacheKey
+func _ParseCacheKey(key string) (chainId common.ChainId, method string, ok bool) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) < 3 {
+		return 0, "", false
+	}
+	chainId, err := strconv.ParseUint(parts[0], 36, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return chainId, parts[1], true
+}
+
+func (a agentService) counter(chainId common.ChainId, method string) *cacheCounter {
+	v, _ := a.counters.LoadOrStore(_CounterKey(chainId, method), &cacheCounter{})
+	return v.(*cacheCounter)
+}
+
+func (a agentService) Stats() CacheStats {
+	s := a.cache.Stats()
+	stats := CacheStats{
+		Entries:    a.cache.Len(),
+		Capacity:   a.cache.Capacity(),
+		Hits:       s.Hits,
+		Misses:     s.Misses,
+		DelHits:    s.DelHits,
+		DelMisses:  s.DelMisses,
+		Collisions: s.Collisions,
+	}
+
+	methods := map[string]*CacheMethodStats{}
+	it := a.cache.Iterator()
+	for it.SetNext() {
+		e, err := it.Value()
+		if err != nil {
+			continue
+		}
+		chainId, method, ok := _ParseCacheKey(e.Key())
+		if !ok {
+			continue
+		}
+		k := _CounterKey(chainId, method)
+		if methods[k] == nil {
+			methods[k] = &CacheMethodStats{ChainID: chainId, Method: method}
+		}
+		methods[k].Entries++
+		methods[k].Bytes += len(e.Value())
+	}
+
+	a.counters.Range(func(key, value any) bool {
+		parts := strings.SplitN(key.(string), ":", 2)
+		chainId, _ := strconv.ParseUint(parts[0], 10, 64)
+		if methods[key.(string)] == nil {
+			methods[key.(string)] = &CacheMethodStats{ChainID: chainId, Method: parts[1]}
+		}
+		m, c := methods[key.(string)], value.(*cacheCounter)
+		m.Hits, m.Misses = c.hits.Load(), c.misses.Load()
+		if total := m.Hits + m.Misses; total > 0 {
+			m.HitRate = float64(m.Hits) / float64(total)
+		}
+		return true
+	})
+
+	stats.Methods = make([]CacheMethodStats, 0, len(methods))
+	for _, m := range methods {
+		stats.Methods = append(stats.Methods, *m)
+	}
+	slices.SortFunc(stats.Methods, func(a, b CacheMethodStats) int {
+		if a.ChainID != b.ChainID {
+			return cmp.Compare(a.ChainID, b.ChainID)
+		}
+		return strings.Compare(a.Method, b.Method)
+	})
+	return stats
+}
+
+func (a agentService) Lookup(chainId common.ChainId, method string, params []any) (*CacheLookup, bool) {
+	jsonrpc := rpc.NewJSONRPC(map[string]any{
+		"jsonrpc": rpc.JSONRPC_VERSION_2,
+		"method":  method,
+		"params":  params,
+	})
+	ttl := time.Duration(0)
+	if v, ok := a.config.methods()[method]; ok {
+		ttl, _ = time.ParseDuration(v)
+	}
+
+	retention := ttl + a.config.retention(method)
+	if retention <= 0 {
+		return nil, false
+	}
+
+	key := _CacheKey(chainId, jsonrpc)
+	v, age, ok := a.getCache(&a.logger, key, retention)
+	if !ok {
+		return nil, false
+	}
+	return &CacheLookup{
+		Key:   key,
+		Value: v,
+		Age:   age.String(),
+		TTL:   ttl.String(),
+		Stale: age > ttl,
+	}, true
+}
+
+// 按链和方法清除所有实例的缓存，chainId 为 0 或 method 为空时表示不限，返回当前实例清除的数量
+func (a agentService) Purge(chainId common.ChainId, method string) int {
+	n := a.purge(chainId, method)
+	a.publish(cacheInvalidation{Op: cacheInvalidatePurge, ChainID: chainId, Method: method})
+	return n
+}
+
+func (a agentService) purge(chainId common.ChainId, method string) int {
+	keys := []string{}
+	it := a.cache.Iterator()
+	for it.SetNext() {
+		e, err := it.Value()
+		if err != nil {
+			continue
+		}
+		_chainId, _method, ok := _ParseCacheKey(e.Key())
+		if !ok || (chainId != 0 && _chainId != chainId) || (method != "" && _method != method) {
+			continue
+		}
+		keys = append(keys, e.Key())
+	}
+
+	for i := range keys {
+		a.cache.Delete(keys[i])
+	}
+
+	// 持久化缓存中的数据也要清除，否则读取时会回填到内存缓存
+	prefix := ""
+	if chainId != 0 {
+		prefix = helpers.Concat(strconv.FormatUint(chainId, 36), ":")
+		if method != "" {
+			prefix = helpers.Concat(prefix, method, ":")
+		}
+	}
+	n := a.disk.DeletePrefix(prefix, func(key string) bool {
+		_, _method, ok := _ParseCacheKey(key)
+		return ok && (method == "" || _method == method)
+	})
+
+	a.logger.Info().Msgf("Purged %d cache entries, %d disk cache entries, chain: %d, method: %s", len(keys), n, chainId, method)
+	// 两层缓存中可能有同一个 key，返回较多的一层
+	return max(len(keys), n)
+}
+
+func (a agentService) PurgeKey(key string) bool {
+	ok := a.purgeKey(key)
+	a.publish(cacheInvalidation{Op: cacheInvalidatePurgeKey, Key: key})
+	return ok
+}
+
+func (a agentService) purgeKey(key string) bool {
+	deleted := a.cache.Delete(key) == nil
+	return a.disk.Delete(key) || deleted
+}
+
+func (a agentService) TTLs() map[string]CacheTTL {
+	ttls := map[string]CacheTTL{}
+	for method, ttl := range a.config.methods() {
+		v := CacheTTL{TTL: ttl}
+		if stale := a.config.stale(method); stale > 0 {
+			v.Stale = stale.String()
+		}
+		ttls[method] = v
+	}
+	return ttls
+}
+
+// 修改所有实例中方法的缓存时间，ttl 为空时表示不再缓存该方法
+func (a agentService) SetTTL(method string, ttl CacheTTL) common.HTTPErrors {
+	if err := a.setTTL(method, ttl); err != nil {
+		return err
+	}
+	a.publish(cacheInvalidation{Op: cacheInvalidateTTL, Method: method, TTL: &ttl})
+	return nil
+}
+
+func (a agentService) setTTL(method string, ttl CacheTTL) common.HTTPErrors {
+	a.config.rwm.Lock()
+	defer a.config.rwm.Unlock()
+
+	methods, stales := maps.Clone(a.config.CacheMethods), maps.Clone(a.config.StaleMethods)
+	if methods == nil {
+		methods = map[string]string{}
+	}
+	if stales == nil {
+		stales = map[string]time.Duration{}
+	}
+	if ttl.TTL == "" {
+		delete(methods, method)
+	} else {
+		methods[method] = ttl.TTL
+	}
+	if d, err := time.ParseDuration(ttl.Stale); err == nil && d > 0 {
+		stales[method] = d
+	} else {
+		delete(stales, method)
+	}
+	// 内存缓存的存活时间在启动时确定，超出后条目会在可用窗口结束前被淘汰
+	if window := cacheWindow(methods, stales, a.config.MaxStale); window > a.config.LifeWindow {
+		return common.BadRequestError(fmt.Sprintf("Cache window %s exceeds the life window %s", window, a.config.LifeWindow))
+	}
+	a.config.CacheMethods, a.config.StaleMethods = methods, stales
+
+	a.logger.Info().Msgf("Cache ttl of %s changed to %s, stale %s", method, ttl.TTL, ttl.Stale)
+	return nil
+}
+
+// 通知其它实例，没有连接 redis 时只对当前实例生效
+func (a agentService) publish(msg cacheInvalidation) {
+	if a.redis == nil || a.redis.Client == nil {
+		return
+	}
+
+	msg.Origin = a.instance
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.redis.Client.Publish(ctx, cacheInvalidateChannel, b).Err(); err != nil {
+		a.logger.Error().Err(err).Msgf("Failed to publish cache %s", msg.Op)
+	}
+}
+
+// 执行其它实例的通知
+func (a agentService) apply(payload string) {
+	msg := cacheInvalidation{}
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		a.logger.Warn().Err(err).Msg("Invalid cache invalidation")
+		return
+	}
+	if msg.Origin == a.instance {
+		return
+	}
+
+	switch msg.Op {
+	case cacheInvalidatePurge:
+		a.purge(msg.ChainID, msg.Method)
+	case cacheInvalidatePurgeKey:
+		a.purgeKey(msg.Key)
+	case cacheInvalidateTTL:
+		if msg.TTL == nil {
+			return
+		}
+		if err := a.setTTL(msg.Method, *msg.TTL); err != nil {
+			a.logger.Error().Err(err).Msgf("Failed to change cache ttl of %s", msg.Method)
+		}
+	}
+}
+
+// 订阅其它实例的缓存通知，需要在连接 redis 之后调用
+func (a agentService) Subscribe(ctx context.Context) error {
+	if a.redis == nil || a.redis.Client == nil {
+		return errors.New("redis is not connected")
+	}
+
+	pubsub := a.redis.Client.Subscribe(ctx, cacheInvalidateChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			a.apply(msg.Payload)
+		}
+	}()
+	return nil
+}
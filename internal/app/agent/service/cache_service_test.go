@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/app/shared"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/go-redis/redismock/v9"
+	"github.com/rs/zerolog"
+)
+
+func newTestDiskCache(t *testing.T) *shared.DiskCache {
+	disk := shared.NewDiskCache(newConfig(map[string]any{
+		"cache.disk.enable": true,
+		"cache.disk.path":   filepath.Join(t.TempDir(), "cache.db"),
+	}), zerolog.Nop())
+	if err := disk.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { disk.Close() })
+	return disk
+}
+
+// 持久化缓存是异步写入的，等待写入完成
+func waitDiskCache(t *testing.T, disk *shared.DiskCache, key string) {
+	for i := 0; i < 100; i++ {
+		if _, ok := disk.Get(key); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("disk cache %s is not written", key)
+}
+
+func TestPurgeDiskCache(t *testing.T) {
+	a := newTestAgentService(t, newConfig(map[string]any{}), &fakeClient{}, map[string]string{"eth_getBlockByHash": "10m"})
+	a.disk = newTestDiskCache(t)
+
+	keys := map[string]string{}
+	for _, v := range []struct {
+		chainId uint64
+		method  string
+	}{{1, "eth_getBlockByHash"}, {1, "eth_chainId"}, {56, "eth_getBlockByHash"}} {
+		key := _CacheKey(v.chainId, rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "method": v.method, "params": []any{"0x1"}}))
+		keys[key] = v.method
+		a.setCache(key, "0x1")
+		a.setDiskCache(key, "0x1")
+		waitDiskCache(t, a.disk, key)
+	}
+
+	if n := a.Purge(1, "eth_getBlockByHash"); n != 1 {
+		t.Errorf("expected %d, got %d", 1, n)
+	}
+	for key, method := range keys {
+		// 清除后不会再从持久化缓存回填
+		_, _, ok := a.getCache(&a.logger, key, time.Hour)
+		if purged := key[:2] == "1:" && method == "eth_getBlockByHash"; ok == purged {
+			t.Errorf("%s: expected purged %v", key, purged)
+		}
+	}
+
+	for key := range keys {
+		a.PurgeKey(key)
+		if _, _, ok := a.getCache(&a.logger, key, time.Hour); ok {
+			t.Errorf("%s: expected purged", key)
+		}
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	rdb, mock := redismock.NewClientMock()
+	a := newTestAgentService(t, newConfig(map[string]any{}), &fakeClient{}, map[string]string{"eth_getBlockByHash": "10m"})
+	a.redis, a.instance = &shared.RedisClient{Client: rdb}, "a"
+
+	// 当前实例的修改广播给其它实例
+	ttl := CacheTTL{TTL: "1m"}
+	for _, msg := range []cacheInvalidation{
+		{Origin: "a", Op: cacheInvalidatePurge, ChainID: 1, Method: "eth_getBlockByHash"},
+		{Origin: "a", Op: cacheInvalidatePurgeKey, Key: "1:eth_chainId:abc"},
+		{Origin: "a", Op: cacheInvalidateTTL, Method: "eth_getBlockByHash", TTL: &ttl},
+	} {
+		b, _ := json.Marshal(msg)
+		mock.ExpectPublish(cacheInvalidateChannel, b).SetVal(1)
+	}
+	a.Purge(1, "eth_getBlockByHash")
+	a.PurgeKey("1:eth_chainId:abc")
+	if err := a.SetTTL("eth_getBlockByHash", ttl); err != nil {
+		t.Fatal(err)
+	}
+	// 被拒绝的修改不广播
+	if err := a.SetTTL("eth_getBlockByHash", CacheTTL{TTL: "2h"}); err == nil {
+		t.Errorf("expected cache window exceeded")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// 执行其它实例的通知
+	key := _CacheKey(1, rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "method": "eth_getBlockByHash", "params": []any{"0x1"}}))
+	a.setCache(key, "0x1")
+	a.apply(`{"origin":"b","op":"purge_key","key":"` + key + `"}`)
+	if _, _, ok := a.getCache(&a.logger, key, time.Hour); ok {
+		t.Errorf("expected %s purged", key)
+	}
+
+	a.setCache(key, "0x1")
+	a.apply(`{"origin":"b","op":"purge","chainId":1}`)
+	if _, _, ok := a.getCache(&a.logger, key, time.Hour); ok {
+		t.Errorf("expected %s purged", key)
+	}
+
+	a.apply(`{"origin":"b","op":"ttl","method":"eth_getLogs","ttl":{"ttl":"5m","stale":"1m"}}`)
+	if v := a.TTLs()["eth_getLogs"]; v.TTL != "5m" || v.Stale != "1m0s" {
+		t.Errorf("unexpected ttl %v", v)
+	}
+
+	// 忽略自己发出的通知
+	a.setCache(key, "0x1")
+	a.apply(`{"origin":"a","op":"purge_key","key":"` + key + `"}`)
+	if _, _, ok := a.getCache(&a.logger, key, time.Hour); !ok {
+		t.Errorf("expected %s not purged", key)
+	}
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+)
+
+type feeAggregationConfig struct {
+	Enable bool `koanf:"enable"`
+	// 同时查询的节点数
+	Endpoints int `koanf:"endpoints"`
+	// 取各节点结果的百分位，50 为中位数
+	Percentile float64 `koanf:"percentile"`
+	// 聚合结果的缓存时间
+	TTL time.Duration `koanf:"ttl"`
+	// 聚合的方法
+	Methods []string `koanf:"methods"`
+}
+
+var defaultFeeMethods = []string{
+	"eth_gasPrice",
+	"eth_maxPriorityFeePerGas",
+	"eth_feeHistory",
+}
+
+// 读取费用聚合配置，链的配置会覆盖全局配置
+func loadFeeAggregationConfig(conf *config.Conf, chainId common.ChainId) feeAggregationConfig {
+	c := feeAggregationConfig{Endpoints: 3, Percentile: 50, TTL: 3 * time.Second}
+	conf.Unmarshal("agent.fee-aggregation", &c)
+	conf.Unmarshal(helpers.Concat("agent.fee-aggregation.chains.", fmt.Sprint(chainId)), &c)
+	if !conf.Exists("agent.fee-aggregation.methods") && !conf.Exists(helpers.Concat("agent.fee-aggregation.chains.", fmt.Sprint(chainId), ".methods")) {
+		c.Methods = defaultFeeMethods
+	}
+	return c
+}
+
+// 按百分位从小到大取值（nearest-rank）
+func percentileIndex(n int, percentile float64) int {
+	i := int(math.Ceil(min(max(percentile, 0), 100)/100*float64(n))) - 1
+	return min(max(i, 0), n-1)
+}
+
+// 十六进制数值的百分位，无法解析的值被忽略
+func percentileQuantity(values []any, percentile float64) (string, bool) {
+	numbers := make([]*big.Int, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok || len(s) < 3 {
+			continue
+		}
+		if n, ok := new(big.Int).SetString(s[2:], 16); ok {
+			numbers = append(numbers, n)
+		}
+	}
+	if len(numbers) <= 0 {
+		return "", false
+	}
+	slices.SortFunc(numbers, func(a, b *big.Int) int {
+		return a.Cmp(b)
+	})
+	return "0x" + numbers[percentileIndex(len(numbers), percentile)].Text(16), true
+}
+
+func percentileFloat(values []any, percentile float64) (float64, bool) {
+	numbers := make([]float64, 0, len(values))
+	for _, v := range values {
+		if f, ok := v.(float64); ok {
+			numbers = append(numbers, f)
+		}
+	}
+	if len(numbers) <= 0 {
+		return 0, false
+	}
+	sort.Float64s(numbers)
+	return numbers[percentileIndex(len(numbers), percentile)], true
+}
+
+// 逐项聚合 eth_feeHistory 的结果；节点高度不同时 oldestBlock 不同，只聚合最多节点一致的那一组
+func aggregateFeeHistory(results []any, percentile float64) (any, bool) {
+	groups := map[string][]map[string]any{}
+	for _, result := range results {
+		if v, ok := result.(map[string]any); ok {
+			oldest := fmt.Sprint(v["oldestBlock"])
+			groups[oldest] = append(groups[oldest], v)
+		}
+	}
+	var (
+		histories []map[string]any
+		newest    uint64
+	)
+	for oldest, group := range groups {
+		n, _ := helpers.ParseHexUint64(oldest)
+		if len(group) > len(histories) || (len(group) == len(histories) && n > newest) {
+			histories, newest = group, n
+		}
+	}
+	if len(histories) <= 0 {
+		return nil, false
+	}
+
+	aggregated := map[string]any{}
+	for key, value := range histories[0] {
+		aggregated[key] = value
+	}
+
+	// 所有结果中该字段都是同样长度的数组时才聚合
+	columns := func(key string) ([][]any, bool) {
+		var columns [][]any
+		for _, history := range histories {
+			values, ok := history[key].([]any)
+			if !ok || (columns != nil && len(values) != len(columns)) {
+				return nil, false
+			}
+			if columns == nil {
+				columns = make([][]any, len(values))
+			}
+			for i := range values {
+				columns[i] = append(columns[i], values[i])
+			}
+		}
+		return columns, columns != nil
+	}
+
+	for _, key := range []string{"baseFeePerGas", "baseFeePerBlobGas"} {
+		if columns, ok := columns(key); ok {
+			values := make([]any, len(columns))
+			for i := range columns {
+				values[i], _ = percentileQuantity(columns[i], percentile)
+			}
+			aggregated[key] = values
+		}
+	}
+	for _, key := range []string{"gasUsedRatio", "blobGasUsedRatio"} {
+		if columns, ok := columns(key); ok {
+			values := make([]any, len(columns))
+			for i := range columns {
+				values[i], _ = percentileFloat(columns[i], percentile)
+			}
+			aggregated[key] = values
+		}
+	}
+	if columns, ok := columns("reward"); ok {
+		rewards := make([]any, len(columns))
+		for i := range columns {
+			var cells [][]any
+			for _, row := range columns[i] {
+				values, ok := row.([]any)
+				if !ok || (cells != nil && len(values) != len(cells)) {
+					cells = nil
+					break
+				}
+				if cells == nil {
+					cells = make([][]any, len(values))
+				}
+				for j := range values {
+					cells[j] = append(cells[j], values[j])
+				}
+			}
+			if cells == nil {
+				rewards[i] = columns[i][0]
+				continue
+			}
+			row := make([]any, len(cells))
+			for j := range cells {
+				row[j], _ = percentileQuantity(cells[j], percentile)
+			}
+			rewards[i] = row
+		}
+		aggregated["reward"] = rewards
+	}
+
+	return aggregated, true
+}
+
+// 同时向多个健康的节点查询费用，返回各节点结果的百分位，避免单个节点配置异常导致估算偏差
+func (a agentService) aggregateFee(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpc rpc.JSONRPCer, useCache bool) (result rpc.SealedJSONRPCResult, ok bool, err error) {
+	config := loadFeeAggregationConfig(rc.Config(), rc.ChainID())
+	if !config.Enable || !slices.Contains(config.Methods, jsonrpc.Method()) {
+		return result, false, nil
+	}
+
+	key := helpers.Concat(_CacheKey(rc.ChainID(), jsonrpc), ":aggregated")
+	if useCache && config.TTL > 0 {
+		if v, _, ok := a.getCache(rc.Logger(), key, config.TTL); ok {
+			return jsonrpc.MakeResult(v, nil), true, nil
+		}
+	}
+
+	_endpoints, ok := a.es.Select(ctx, rc, endpoints, []rpc.JSONRPCer{jsonrpc})
+	if !ok {
+		return result, false, nil
+	}
+	_endpoints = slices.DeleteFunc(slices.Clone(_endpoints), func(e *endpoint.Endpoint) bool {
+		return !e.Health()
+	})
+	_endpoints = _endpoints[:min(len(_endpoints), max(config.Endpoints, 1))]
+	// 只有一个节点时没有可以比较的结果
+	if len(_endpoints) <= 1 {
+		return result, false, nil
+	}
+
+	var (
+		results = make([]any, len(_endpoints))
+		wg      sync.WaitGroup
+	)
+	for i := range _endpoints {
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				if err := recover(); err != nil {
+					a.logger.Error().Interface("error", err).Msg("Failed to aggregate fee")
+				}
+				wg.Done()
+			}()
+
+			_results, err := a.request(ctx, rc, _endpoints[i:i+1], []rpc.JSONRPCer{jsonrpc})
+			if err == nil && len(_results) > 0 && _results[0].Error == nil {
+				results[i] = _results[0].Result
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	results = slices.DeleteFunc(results, func(v any) bool {
+		return v == nil
+	})
+	if len(results) <= 0 {
+		// 都失败时按普通请求处理，由重试策略决定结果
+		return result, false, nil
+	}
+
+	var value any
+	if jsonrpc.Method() == "eth_feeHistory" {
+		value, ok = aggregateFeeHistory(results, config.Percentile)
+	} else {
+		value, ok = percentileQuantity(results, config.Percentile)
+	}
+	if !ok {
+		return result, false, nil
+	}
+
+	rc.Logger().Debug().Msgf("%s aggregated from %d/%d endpoints", jsonrpc.Method(), len(results), len(_endpoints))
+
+	if config.TTL > 0 {
+		a.setCache(key, value)
+	}
+	return jsonrpc.MakeResult(value, nil), true, nil
+}
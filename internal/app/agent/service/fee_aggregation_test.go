@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+)
+
+func TestPercentileIndex(t *testing.T) {
+	tests := []struct {
+		n          int
+		percentile float64
+		index      int
+	}{
+		{1, 50, 0},
+		{2, 50, 0},
+		{3, 50, 1},
+		{4, 50, 1},
+		{5, 50, 2},
+		{5, 0, 0},
+		{5, 100, 4},
+		{5, 90, 4},
+		{5, 20, 0},
+		{5, 21, 1},
+		{10, 25, 2},
+		// 超出范围的百分位
+		{5, -10, 0},
+		{5, 150, 4},
+	}
+	for _, test := range tests {
+		if i := percentileIndex(test.n, test.percentile); i != test.index {
+			t.Errorf("percentileIndex(%d, %v): expected %d, got %d", test.n, test.percentile, test.index, i)
+		}
+	}
+}
+
+func TestPercentileQuantity(t *testing.T) {
+	// 按数值而不是字符串排序，无法解析的值被忽略
+	values := []any{"0x10", "0x9", "0xa", "invalid", nil, "0x", float64(1)}
+	if v, ok := percentileQuantity(values, 50); !ok || v != "0xa" {
+		t.Errorf("expected %s, got %s", "0xa", v)
+	}
+	if v, ok := percentileQuantity(values, 100); !ok || v != "0x10" {
+		t.Errorf("expected %s, got %s", "0x10", v)
+	}
+	if _, ok := percentileQuantity([]any{"invalid"}, 50); ok {
+		t.Errorf("expected no value")
+	}
+}
+
+func TestAggregateFeeHistory(t *testing.T) {
+	history := func(oldest string, baseFees []any, ratios []any, rewards []any) any {
+		return map[string]any{"oldestBlock": oldest, "baseFeePerGas": baseFees, "gasUsedRatio": ratios, "reward": rewards}
+	}
+	results := []any{
+		history("0x10", []any{"0x1", "0x5", "0x9"}, []any{0.1, 0.5}, []any{[]any{"0x1", "0x10"}, []any{"0x2", "0x20"}}),
+		history("0x10", []any{"0x3", "0x6", "0x7"}, []any{0.3, 0.6}, []any{[]any{"0x3", "0x30"}, []any{"0x4", "0x40"}}),
+		history("0x10", []any{"0x2", "0x4", "0x8"}, []any{0.2, 0.4}, []any{[]any{"0x2", "0x20"}, []any{"0x3", "0x30"}}),
+		// 高度不同的节点
+		history("0x11", []any{"0xff", "0xff", "0xff"}, []any{0.9, 0.9}, []any{[]any{"0xff", "0xff"}, []any{"0xff", "0xff"}}),
+		"invalid",
+	}
+
+	v, ok := aggregateFeeHistory(results, 50)
+	if !ok {
+		t.Fatal("expected aggregated")
+	}
+	expected := history("0x10", []any{"0x2", "0x5", "0x8"}, []any{0.2, 0.5}, []any{[]any{"0x2", "0x20"}, []any{"0x3", "0x30"}})
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("expected %v, got %v", expected, v)
+	}
+
+	// 数量相同时取较新的一组
+	v, _ = aggregateFeeHistory(results[2:4], 50)
+	if oldest := v.(map[string]any)["oldestBlock"]; oldest != "0x11" {
+		t.Errorf("expected %s, got %v", "0x11", oldest)
+	}
+
+	// 长度不一致的字段不聚合，保留第一个结果
+	mismatched := []any{
+		history("0x10", []any{"0x1", "0x2"}, []any{0.1}, []any{[]any{"0x1"}}),
+		history("0x10", []any{"0x3"}, []any{0.3}, []any{[]any{"0x3", "0x4"}}),
+	}
+	v, _ = aggregateFeeHistory(mismatched, 100)
+	if fees := v.(map[string]any)["baseFeePerGas"]; !reflect.DeepEqual(fees, []any{"0x1", "0x2"}) {
+		t.Errorf("expected first base fees, got %v", fees)
+	}
+	if ratios := v.(map[string]any)["gasUsedRatio"]; !reflect.DeepEqual(ratios, []any{0.3}) {
+		t.Errorf("expected aggregated ratios, got %v", ratios)
+	}
+	if rewards := v.(map[string]any)["reward"]; !reflect.DeepEqual(rewards, []any{[]any{"0x1"}}) {
+		t.Errorf("expected first rewards, got %v", rewards)
+	}
+
+	if _, ok := aggregateFeeHistory([]any{"invalid"}, 50); ok {
+		t.Errorf("expected not aggregated")
+	}
+}
+
+func TestAggregateFee(t *testing.T) {
+	conf := newConfig(map[string]any{"agent.fee-aggregation.enable": true, "agent.fee-aggregation.endpoints": 3})
+	prices := map[string]any{"http://a": "0x64", "http://b": "0x3b9aca00", "http://c": "0x6e", "http://d": "0x1"}
+	client := &fakeClient{handle: func(e *endpoint.Endpoint, jsonrpc rpc.SealedJSONRPC) map[string]any {
+		return map[string]any{"result": prices[e.Url().String()]}
+	}}
+	a := newTestAgentService(t, conf, client, nil)
+
+	// 只查询 3 个节点，单个节点的异常值不影响结果
+	b, err := a.Call(context.Background(), newTestReqctx(conf, `{"jsonrpc":"2.0","id":1,"method":"eth_gasPrice","params":[]}`), newTestEndpoints("http://a", "http://b", "http://c", "http://d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Result string `json:"result"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(client.called()); n != 3 {
+		t.Errorf("expected %d requests, got %d", 3, n)
+	}
+	if result.Result == "0x3b9aca00" || result.Result == "" {
+		t.Errorf("expected median of endpoints, got %s", result.Result)
+	}
+
+	// 未开启的方法不聚合
+	client.methods = nil
+	if _, err := a.Call(context.Background(), newTestReqctx(conf, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`), newTestEndpoints("http://a", "http://b")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(client.called()); n != 1 {
+		t.Errorf("expected %d requests, got %d", 1, n)
+	}
+}
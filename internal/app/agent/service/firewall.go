@@ -0,0 +1,104 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+)
+
+// 默认禁止的方法，会操作节点本身或使用节点上的账户
+var defaultDenyMethods = []string{
+	"admin_*",
+	"personal_*",
+	"miner_*",
+	"debug_setHead",
+	"eth_sign",
+	"eth_signTransaction",
+	"eth_sendTransaction",
+}
+
+type methodPolicy struct {
+	Allow []string `koanf:"allow"`
+	Deny  []string `koanf:"deny"`
+}
+
+// 方法防火墙，在所有租户的白名单之前检查：
+//
+//	jsonrpc:
+//	  firewall:
+//	    deny: ["admin_*", "debug_*"]
+//	    chains:
+//	      ethereum:
+//	        allow: ["debug_trace*"]
+//
+// 链的配置优先于全局配置，同一级中 deny 优先于 allow；配置了 allow 时只允许匹配的方法
+type methodFirewall struct {
+	Allow  []string                `koanf:"allow"`
+	Deny   []string                `koanf:"deny"`
+	Chains map[string]methodPolicy `koanf:"chains"`
+}
+
+func newMethodFirewall(config *config.Conf) *methodFirewall {
+	firewall := &methodFirewall{}
+	config.Unmarshal("jsonrpc.firewall", firewall)
+	// 配置 deny: [] 可以取消默认禁止的方法
+	if !config.Exists("jsonrpc.firewall.deny") {
+		firewall.Deny = defaultDenyMethods
+	}
+	return firewall
+}
+
+// 当前链生效的配置，按链 ID 配置的优先，其次按链代号的字母顺序，不受 map 遍历顺序影响
+func (f *methodFirewall) policies(rc reqctx.Reqctxs) []methodPolicy {
+	id := fmt.Sprint(rc.ChainID())
+	policies := []methodPolicy{}
+	if policy, ok := f.Chains[id]; ok {
+		policies = append(policies, policy)
+	}
+
+	codes := make([]string, 0, len(f.Chains))
+	for chain := range f.Chains {
+		if chain != id {
+			codes = append(codes, chain)
+		}
+	}
+	slices.Sort(codes)
+	for _, chain := range codes {
+		if allowChain(rc, []string{chain}) {
+			policies = append(policies, f.Chains[chain])
+		}
+	}
+	return policies
+}
+
+// 返回不允许的原因，允许时返回空字符串；
+// 链的任一配置 deny 时拒绝，之后才检查 allow
+func (f *methodFirewall) check(rc reqctx.Reqctxs, method string) string {
+	reason := helpers.Concat("method ", method, " is not available")
+
+	policies := f.policies(rc)
+	for _, policy := range policies {
+		if allowMethod(policy.Deny, method) {
+			return reason
+		}
+	}
+
+	var allows []string
+	for _, policy := range policies {
+		if allowMethod(policy.Allow, method) {
+			return ""
+		}
+		allows = append(allows, policy.Allow...)
+	}
+
+	if allowMethod(f.Deny, method) {
+		return reason
+	}
+	if allows = append(allows, f.Allow...); len(allows) > 0 && !allowMethod(allows, method) {
+		return reason
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+)
+
+func TestMethodFirewall(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]any
+		method  string
+		allowed bool
+	}{
+		// 默认禁止的方法
+		{"default", map[string]any{}, "admin_peers", false},
+		{"default", map[string]any{}, "personal_unlockAccount", false},
+		{"default", map[string]any{}, "eth_sendTransaction", false},
+		{"default", map[string]any{}, "debug_setHead", false},
+		{"default", map[string]any{}, "debug_traceTransaction", true},
+		{"default", map[string]any{}, "eth_call", true},
+		// deny: [] 取消默认禁止的方法
+		{"empty deny", map[string]any{"jsonrpc.firewall.deny": []string{}}, "admin_peers", true},
+		{"deny", map[string]any{"jsonrpc.firewall.deny": []string{"debug_*"}}, "debug_traceTransaction", false},
+		{"deny", map[string]any{"jsonrpc.firewall.deny": []string{"debug_*"}}, "admin_peers", true},
+		// 配置了 allow 时只允许匹配的方法，deny 优先
+		{"allow", map[string]any{"jsonrpc.firewall.allow": []string{"eth_*"}}, "eth_call", true},
+		{"allow", map[string]any{"jsonrpc.firewall.allow": []string{"eth_*"}}, "net_version", false},
+		{"allow", map[string]any{"jsonrpc.firewall.allow": []string{"eth_*"}}, "eth_sign", false},
+		// 链的配置优先于全局配置
+		{"chain allow", map[string]any{"jsonrpc.firewall.deny": []string{"debug_*"}, "jsonrpc.firewall.chains.1.allow": []string{"debug_trace*"}}, "debug_traceTransaction", true},
+		{"chain allow", map[string]any{"jsonrpc.firewall.deny": []string{"debug_*"}, "jsonrpc.firewall.chains.1.allow": []string{"debug_trace*"}}, "debug_getRawBlock", false},
+		{"chain deny", map[string]any{"jsonrpc.firewall.chains.1.deny": []string{"eth_getLogs"}}, "eth_getLogs", false},
+		{"chain deny", map[string]any{"jsonrpc.firewall.chains.1.deny": []string{"eth_getLogs"}, "jsonrpc.firewall.chains.1.allow": []string{"eth_*"}}, "eth_getLogs", false},
+		// 链的 allow 与全局的 allow 合并
+		{"chain and global allow", map[string]any{"jsonrpc.firewall.allow": []string{"net_*"}, "jsonrpc.firewall.chains.1.allow": []string{"eth_*"}}, "net_version", true},
+		{"chain and global allow", map[string]any{"jsonrpc.firewall.allow": []string{"net_*"}, "jsonrpc.firewall.chains.1.allow": []string{"eth_*"}}, "web3_clientVersion", false},
+		// 其它链的配置不生效
+		{"other chain", map[string]any{"jsonrpc.firewall.chains.56.deny": []string{"eth_getLogs"}}, "eth_getLogs", true},
+		{"other chain", map[string]any{"jsonrpc.firewall.chains.56.allow": []string{"eth_call"}}, "eth_getLogs", true},
+		// 链 ID 与链代号的配置同时生效，任一配置 deny 时拒绝
+		{"chain id and code", map[string]any{"chains.ethereum": common.EndpointChain{ChainID: 1}, "jsonrpc.firewall.chains.1.allow": []string{"debug_*"}, "jsonrpc.firewall.chains.ethereum.deny": []string{"debug_setHead"}}, "debug_setHead", false},
+		{"chain id and code", map[string]any{"chains.ethereum": common.EndpointChain{ChainID: 1}, "jsonrpc.firewall.chains.1.deny": []string{"debug_setHead"}, "jsonrpc.firewall.chains.ethereum.allow": []string{"debug_*"}}, "debug_setHead", false},
+		{"chain id and code", map[string]any{"chains.ethereum": common.EndpointChain{ChainID: 1}, "jsonrpc.firewall.chains.1.deny": []string{"debug_setHead"}, "jsonrpc.firewall.chains.ethereum.allow": []string{"debug_*"}}, "debug_traceTransaction", true},
+	}
+
+	for _, test := range tests {
+		conf := newConfig(test.config)
+		firewall := newMethodFirewall(conf)
+		// 多次检查结果一致，不受 map 遍历顺序影响
+		for i := 0; i < 10; i++ {
+			if reason := firewall.check(newTestReqctx(conf, ""), test.method); (reason == "") != test.allowed {
+				t.Errorf("%s %s: expected allowed %v, got %q", test.name, test.method, test.allowed, reason)
+				break
+			}
+		}
+	}
+}
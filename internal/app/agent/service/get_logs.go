@@ -0,0 +1,313 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+	"github.com/duke-git/lancet/v2/slice"
+)
+
+type getLogsConfig struct {
+	// 单个分段的最大区块跨度，0 表示不拆分
+	ChunkSize uint64 `koanf:"chunk-size"`
+	// 自适应减半时，分段的最小区块跨度
+	MinChunkSize uint64 `koanf:"min-chunk-size"`
+	// 同时请求的分段数
+	Concurrency int `koanf:"concurrency"`
+	// 单个请求最多拆分的分段数，超过时不拆分，0 表示不限制
+	MaxChunks uint64 `koanf:"max-chunks"`
+}
+
+// 节点返回结果数量、区块跨度超限时的错误信息
+var logsLimitErrors = []string{
+	"block range",
+	"range too large",
+	"range is too large",
+	"more than 10000 results",
+	"query returned more than",
+	"limit exceeded",
+	"response size exceeded",
+	"response size should not",
+	"too many results",
+}
+
+// 读取 eth_getLogs 拆分配置，链的配置会覆盖全局配置
+func loadGetLogsConfig(conf *config.Conf, chainId common.ChainId) getLogsConfig {
+	c := getLogsConfig{
+		MinChunkSize: 16,
+		Concurrency:  4,
+		MaxChunks:    100,
+	}
+	conf.Unmarshal("agent.get-logs", &c)
+	conf.Unmarshal(helpers.Concat("agent.get-logs.chains.", fmt.Sprint(chainId)), &c)
+	return c
+}
+
+func isLogsLimitError(err any) bool {
+	msg := strings.ToLower(fmt.Sprint(err))
+	if v, ok := err.(map[string]any); ok {
+		msg = strings.ToLower(fmt.Sprint(v["message"]))
+	}
+	return slice.Some(logsLimitErrors, func(_ int, s string) bool {
+		return strings.Contains(msg, s)
+	})
+}
+
+// 记录节点返回的 eth_blockNumber
+func (a agentService) observeHead(chainId common.ChainId, result any) {
+	v, ok := result.(string)
+	if !ok {
+		return
+	}
+	height, ok := helpers.ParseHexUint64(v)
+	if !ok {
+		return
+	}
+	_v, _ := a.heads.LoadOrStore(chainId, &atomic.Uint64{})
+	head := _v.(*atomic.Uint64)
+	for old := head.Load(); height > old && !head.CompareAndSwap(old, height); old = head.Load() {
+	}
+}
+
+// 所有节点中已知的最高区块，不发出请求
+func (a agentService) knownHead(chainId common.ChainId, endpoints []*endpoint.Endpoint) uint64 {
+	var height uint64
+	for i := range endpoints {
+		height = max(height, endpoints[i].BlockNumber())
+	}
+	if v, ok := a.heads.Load(chainId); ok {
+		height = max(height, v.(*atomic.Uint64).Load())
+	}
+	return height
+}
+
+// 所有节点中已知的最高区块，未知时向节点查询一次
+func (a agentService) head(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint) uint64 {
+	height := a.knownHead(rc.ChainID(), endpoints)
+	if height > 0 {
+		return height
+	}
+
+	jsonrpc := rpc.NewJSONRPC(map[string]any{
+		"jsonrpc": rpc.JSONRPC_VERSION_2,
+		"id":      "head",
+		"method":  "eth_blockNumber",
+		"params":  []any{},
+	})
+	results, err := a.call(ctx, rc, endpoints, []rpc.JSONRPCer{jsonrpc})
+	if err != nil || len(results) <= 0 || results[0].Error != nil {
+		return 0
+	}
+	if v, ok := results[0].Result.(string); ok {
+		height, _ = helpers.ParseHexUint64(v)
+	}
+	return height
+}
+
+// 将大范围的 eth_getLogs 拆分为多个分段，并发请求后按顺序合并；
+// 不需要拆分时返回 ok = false，交由常规流程处理
+func (a agentService) getLogs(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpc rpc.JSONRPCer, useCache bool) (result rpc.SealedJSONRPCResult, ok bool, err error) {
+	if jsonrpc.Method() != "eth_getLogs" || len(jsonrpc.Params()) != 1 {
+		return result, false, nil
+	}
+	filter, ok := jsonrpc.Params()[0].(map[string]any)
+	if !ok || filter["blockHash"] != nil {
+		return result, false, nil
+	}
+
+	config := loadGetLogsConfig(rc.Config(), rc.ChainID())
+	// 节点自身有跨度限制时，取最小值
+	chunkSize := config.ChunkSize
+	for i := range endpoints {
+		if size := endpoints[i].LogsRange(); size > 0 && (chunkSize == 0 || size < chunkSize) {
+			chunkSize = size
+		}
+	}
+	if chunkSize == 0 {
+		return result, false, nil
+	}
+
+	var from, to, head uint64
+	switch v := fmt.Sprint(filter["fromBlock"]); v {
+	case "earliest":
+		from = 0
+	default:
+		if from, ok = helpers.ParseHexUint64(v); !ok {
+			return result, false, nil
+		}
+	}
+	switch v := fmt.Sprint(filter["toBlock"]); v {
+	case "latest", "<nil>":
+		if head = a.head(ctx, rc, endpoints); head == 0 {
+			return result, false, nil
+		}
+		to = head
+	default:
+		if to, ok = helpers.ParseHexUint64(v); !ok {
+			return result, false, nil
+		}
+	}
+	if to < from || to-from+1 <= chunkSize {
+		return result, false, nil
+	}
+	// 跨度过大时不拆分，交由节点自身的限制处理，避免一个请求放大为大量分段
+	if config.MaxChunks > 0 && (to-from)/chunkSize+1 > config.MaxChunks {
+		rc.Logger().Debug().Msgf("eth_getLogs %d-%d exceeds %d chunks, not split", from, to, config.MaxChunks)
+		return result, false, nil
+	}
+
+	// 只有写缓存时才需要判断分段是否已确认
+	if useCache && head == 0 {
+		head = a.head(ctx, rc, endpoints)
+	}
+
+	_endpoints, ok := a.es.Select(ctx, rc, endpoints, []rpc.JSONRPCer{jsonrpc})
+	if !ok || len(_endpoints) <= 0 {
+		a.logger.Error().Msgf("%d No available endpoints", rc.ChainID())
+		return result, true, common.InternalServerError("No available endpoints")
+	}
+
+	ranges := [][2]uint64{}
+	for start := from; start <= to; start += chunkSize {
+		ranges = append(ranges, [2]uint64{start, min(start+chunkSize-1, to)})
+	}
+
+	// 任一分段失败时取消其余分段
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		logs    = make([][]any, len(ranges))
+		rpcErrs = make([]any, len(ranges))
+		errs    = make([]error, len(ranges))
+		sem     = make(chan struct{}, max(config.Concurrency, 1))
+		wg      sync.WaitGroup
+	)
+	for i := range ranges {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			// 未发出的分段记为失败，不返回不完整的结果
+			errs[i] = common.InternalServerError("Failed to get logs")
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				if err := recover(); err != nil {
+					a.logger.Error().Interface("error", err).Msg("Failed to get logs")
+					errs[i] = common.InternalServerError("Failed to get logs")
+				}
+				<-sem
+				wg.Done()
+			}()
+
+			// 每个分段轮换首选节点，将请求分散到不同节点
+			offset := i % len(_endpoints)
+			rotated := append(slices.Clone(_endpoints[offset:]), _endpoints[:offset]...)
+			logs[i], rpcErrs[i], errs[i] = a.getLogsRange(ctx, rc, rotated, jsonrpc, filter, ranges[i][0], ranges[i][1], &config, head, useCache)
+			if errs[i] != nil || rpcErrs[i] != nil {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 优先返回节点的错误，被取消的分段只会返回取消导致的错误
+	for i := range ranges {
+		if rpcErrs[i] != nil {
+			return jsonrpc.MakeResult(nil, rpcErrs[i]), true, nil
+		}
+	}
+	merged := []any{}
+	for i := range ranges {
+		if errs[i] != nil {
+			return result, true, errs[i]
+		}
+		merged = append(merged, logs[i]...)
+	}
+
+	rc.Logger().Debug().Msgf("eth_getLogs %d-%d split into %d chunks, %d logs", from, to, len(ranges), len(merged))
+
+	return jsonrpc.MakeResult(merged, nil), true, nil
+}
+
+// 请求单个分段，节点报告结果超限时将分段减半重试
+func (a agentService) getLogsRange(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpc rpc.JSONRPCer, filter map[string]any, from, to uint64, config *getLogsConfig, head uint64, useCache bool) ([]any, any, error) {
+	_filter := maps.Clone(filter)
+	_filter["fromBlock"], _filter["toBlock"] = helpers.FormatHexUint64(from), helpers.FormatHexUint64(to)
+	chunk := rpc.NewJSONRPC(map[string]any{
+		"jsonrpc": jsonrpc.Version(),
+		"id":      helpers.FormatHexUint64(from),
+		"method":  jsonrpc.Method(),
+		"params":  []any{_filter},
+	})
+
+	// 已确认的分段结果不会再变化，可以单独缓存，确认深度与持久化缓存一致
+	var (
+		final    = head > 0 && to+a.config.FinalityDepth <= head
+		key      = _CacheKey(rc.ChainID(), chunk)
+		ok, ttl  = _WithCache(a.config.methods(), chunk)
+		cachable = ok && useCache && final
+	)
+	if cachable {
+		if v, _, ok := a.getCache(rc.Logger(), key, ttl); ok {
+			if logs, ok := v.([]any); ok {
+				return logs, nil, nil
+			}
+		}
+	}
+
+	results, err := a.request(ctx, rc, endpoints, []rpc.JSONRPCer{chunk})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(results) <= 0 {
+		return nil, nil, common.InternalServerError("All endpoints are unavailable")
+	}
+
+	if results[0].Error != nil {
+		if !isLogsLimitError(results[0].Error) || to-from+1 <= config.MinChunkSize {
+			return nil, results[0].Error, nil
+		}
+
+		mid := from + (to-from)/2
+		rc.Logger().Debug().Msgf("eth_getLogs %d-%d exceeds limit, split at %d", from, to, mid)
+		left, rpcErr, err := a.getLogsRange(ctx, rc, endpoints, jsonrpc, filter, from, mid, config, head, useCache)
+		if err != nil || rpcErr != nil {
+			return nil, rpcErr, err
+		}
+		right, rpcErr, err := a.getLogsRange(ctx, rc, endpoints, jsonrpc, filter, mid+1, to, config, head, useCache)
+		if err != nil || rpcErr != nil {
+			return nil, rpcErr, err
+		}
+		return append(left, right...), nil, nil
+	}
+
+	logs := []any{}
+	if results[0].Result != nil {
+		if logs, ok = results[0].Result.([]any); !ok {
+			return nil, nil, common.UpstreamServerError("Unexpected eth_getLogs result")
+		}
+	}
+
+	if cachable {
+		a.setCache(key, logs)
+		a.setDiskCache(key, logs)
+	}
+
+	return logs, nil, nil
+}
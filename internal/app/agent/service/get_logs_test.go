@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+)
+
+func TestGetLogsChunks(t *testing.T) {
+	conf := newConfig(map[string]any{
+		"agent.get-logs.chunk-size":     100,
+		"agent.get-logs.min-chunk-size": 25,
+	})
+
+	var (
+		mu     sync.Mutex
+		ranges = map[string]bool{}
+	)
+	client := &fakeClient{handle: func(e *endpoint.Endpoint, jsonrpc rpc.SealedJSONRPC) map[string]any {
+		filter := jsonrpc.Params[0].(map[string]any)
+		from, _ := helpers.ParseHexUint64(fmt.Sprint(filter["fromBlock"]))
+		to, _ := helpers.ParseHexUint64(fmt.Sprint(filter["toBlock"]))
+
+		mu.Lock()
+		ranges[fmt.Sprintf("%d-%d", from, to)] = true
+		mu.Unlock()
+
+		// 第二个分段超过节点的结果数限制，需要减半重试
+		if from == 100 && to-from+1 > 50 {
+			return map[string]any{"error": map[string]any{"code": -32005, "message": "query returned more than 10000 results"}}
+		}
+		return map[string]any{"result": []any{
+			map[string]any{"blockNumber": helpers.FormatHexUint64(from)},
+			map[string]any{"blockNumber": helpers.FormatHexUint64(to)},
+		}}
+	}}
+	a := newTestAgentService(t, conf, client, nil)
+
+	body := `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"0x105"}]}`
+	rc := newTestReqctx(conf, body)
+	b, err := a.Call(context.Background(), rc, newTestEndpoints("http://a", "http://b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Result []map[string]string `json:"result"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	// 分段结果按区块顺序合并
+	expected := []uint64{0, 99, 100, 149, 150, 199, 200, 261}
+	if len(result.Result) != len(expected) {
+		t.Fatalf("expected %d logs, got %s", len(expected), b)
+	}
+	for i := range expected {
+		if v := result.Result[i]["blockNumber"]; v != helpers.FormatHexUint64(expected[i]) {
+			t.Errorf("log %d: expected %s, got %s", i, helpers.FormatHexUint64(expected[i]), v)
+		}
+	}
+
+	for _, r := range []string{"0-99", "100-199", "100-149", "150-199", "200-261"} {
+		if !ranges[r] {
+			t.Errorf("expected range %s requested, got %v", r, ranges)
+		}
+	}
+	if len(ranges) != 5 {
+		t.Errorf("unexpected ranges %v", ranges)
+	}
+}
+
+func TestGetLogsNotSplit(t *testing.T) {
+	conf := newConfig(map[string]any{"agent.get-logs.chunk-size": 100})
+	client := &fakeClient{handle: func(e *endpoint.Endpoint, jsonrpc rpc.SealedJSONRPC) map[string]any {
+		return map[string]any{"result": []any{}}
+	}}
+	a := newTestAgentService(t, conf, client, nil)
+
+	for _, params := range []string{
+		`{"fromBlock":"0x0","toBlock":"0x63"}`,
+		`{"blockHash":"0xabc"}`,
+		`{"fromBlock":"0x10","toBlock":"0x1"}`,
+	} {
+		rc := newTestReqctx(conf, `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[`+params+`]}`)
+		filter := map[string]any{}
+		if err := json.Unmarshal([]byte(params), &filter); err != nil {
+			t.Fatal(err)
+		}
+		jsonrpc := rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "eth_getLogs", "params": []any{filter}})
+		if _, ok, _ := a.getLogs(context.Background(), rc, newTestEndpoints("http://a"), jsonrpc, false); ok {
+			t.Errorf("%s: expected not split", params)
+		}
+	}
+}
+
+func TestGetLogsMaxChunks(t *testing.T) {
+	conf := newConfig(map[string]any{
+		"agent.get-logs.chunk-size": 100,
+		"agent.get-logs.max-chunks": 3,
+	})
+	client := &fakeClient{handle: func(e *endpoint.Endpoint, jsonrpc rpc.SealedJSONRPC) map[string]any {
+		return map[string]any{"result": []any{}}
+	}}
+	a := newTestAgentService(t, conf, client, nil)
+
+	for params, split := range map[string]bool{
+		`{"fromBlock":"0x0","toBlock":"0x12b"}`: true,
+		`{"fromBlock":"0x0","toBlock":"0x12c"}`: false,
+	} {
+		rc := newTestReqctx(conf, `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[`+params+`]}`)
+		filter := map[string]any{}
+		if err := json.Unmarshal([]byte(params), &filter); err != nil {
+			t.Fatal(err)
+		}
+		jsonrpc := rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "eth_getLogs", "params": []any{filter}})
+		if _, ok, _ := a.getLogs(context.Background(), rc, newTestEndpoints("http://a"), jsonrpc, false); ok != split {
+			t.Errorf("%s: expected split %v, got %v", params, split, ok)
+		}
+	}
+}
+
+func TestGetLogsCancelOnError(t *testing.T) {
+	conf := newConfig(map[string]any{
+		"agent.get-logs.chunk-size":  10,
+		"agent.get-logs.concurrency": 1,
+	})
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	client := &fakeClient{handle: func(e *endpoint.Endpoint, jsonrpc rpc.SealedJSONRPC) map[string]any {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		return map[string]any{"error": map[string]any{"code": -32000, "message": "internal error"}}
+	}}
+	a := newTestAgentService(t, conf, client, nil)
+
+	body := `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x0","toBlock":"0x63"}]}`
+	rc := newTestReqctx(conf, body)
+	b, err := a.Call(context.Background(), rc, newTestEndpoints("http://a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Error map[string]any `json:"error"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil || result.Error == nil {
+		t.Fatalf("expected error result, got %s", b)
+	}
+	// 第一个分段失败后不再发出其余分段
+	if requests >= 10 {
+		t.Errorf("expected remaining chunks cancelled, got %d requests", requests)
+	}
+}
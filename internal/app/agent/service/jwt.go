@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// 支持的签名算法
+var jwtMethods = []string{"HS256", "ES256", "RS256"}
+
+type jwtConfig struct {
+	// 要求 aud 包含该值，为空时不校验；租户 preferences 中的 jwt.audience 优先
+	Audience string `koanf:"audience"`
+	// 允许的时钟偏差
+	Leeway time.Duration `koanf:"leeway"`
+	// 配置的公钥或密钥，按 JWT header 中的 kid 匹配
+	Keys []jwtKeyConfig `koanf:"keys"`
+}
+
+type jwtKeyConfig struct {
+	Kid string `koanf:"kid"`
+	Alg string `koanf:"alg"`
+	// HS256 为密钥，ES256、RS256 为 PEM 格式的公钥
+	Key string `koanf:"key"`
+	// 绑定的租户，为 0 时由 claims 中的 tenant 指定
+	Tenant uint64 `koanf:"tenant"`
+}
+
+// 后端为终端用户签发的 JWT：
+//
+//	{"tenant": 1, "sub": "user", "exp": 1700000000, "bucket": "user", "chains": ["1"], "methods": ["eth_*"], "rate": 10, "capacity": 20}
+type JWTClaims struct {
+	jwt.RegisteredClaims
+
+	Tenant   any      `json:"tenant"`
+	Bucket   string   `json:"bucket,omitempty"`
+	Chains   []string `json:"chains,omitempty"`
+	Methods  []string `json:"methods,omitempty"`
+	Rate     float64  `json:"rate,omitempty"`
+	Capacity float64  `json:"capacity,omitempty"`
+}
+
+func (c *JWTClaims) tenantId() (uint64, bool) {
+	switch v := c.Tenant.(type) {
+	case float64:
+		return uint64(v), v > 0
+	case string:
+		id, err := strconv.ParseUint(v, 10, 64)
+		return id, err == nil && id > 0
+	}
+	return 0, false
+}
+
+// 按 ID 访问租户时的凭证，用于缓存租户信息
+func _TenantCredential(id uint64) string {
+	return helpers.Hash([]byte(helpers.Concat("tenant#", strconv.FormatUint(id, 10))))
+}
+
+func (s *tenantService) getTenantInfoByID(ctx context.Context, id uint64) (*tenantEntry, error) {
+	return s.getTenantInfo(ctx, _TenantCredential(id), func(entry *tenantEntry) error {
+		return s.tenantRepository.GetTenantByID(ctx, id, &entry.TenantInfo)
+	})
+}
+
+func parseJWTKey(alg string, key []byte) (any, error) {
+	switch alg {
+	case "HS256":
+		return key, nil
+	case "ES256":
+		return jwt.ParseECPublicKeyFromPEM(key)
+	case "RS256":
+		return jwt.ParseRSAPublicKeyFromPEM(key)
+	}
+	return nil, fmt.Errorf("unsupported alg %s", alg)
+}
+
+// 按 JWT header 中的 kid 或 claims 中的租户查找验签的密钥，按租户查找时同时返回租户信息
+func (s *tenantService) jwtKey(ctx context.Context, token *jwt.Token, claims *JWTClaims) (any, *tenantEntry, error) {
+	alg := token.Method.Alg()
+
+	// 配置的密钥
+	if kid, _ := token.Header["kid"].(string); kid != "" {
+		i := slices.IndexFunc(s.jwt.Keys, func(key jwtKeyConfig) bool {
+			return key.Kid == kid
+		})
+		if i < 0 {
+			return nil, nil, fmt.Errorf("unknown kid %s", kid)
+		}
+		key := s.jwt.Keys[i]
+		if key.Alg != alg {
+			return nil, nil, fmt.Errorf("unexpected alg %s", alg)
+		}
+		if id, ok := claims.tenantId(); key.Tenant != 0 && (!ok || id != key.Tenant) {
+			if ok {
+				return nil, nil, errors.New("tenant does not match the kid")
+			}
+			claims.Tenant = float64(key.Tenant)
+		}
+		k, err := parseJWTKey(alg, []byte(key.Key))
+		return k, nil, err
+	}
+
+	// 租户自己的密钥
+	id, ok := claims.tenantId()
+	if !ok {
+		return nil, nil, errors.New("tenant is required")
+	}
+	entry, err := s.getTenantInfoByID(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	app := common.App{TenantInfo: entry.TenantInfo}
+	if alg == "HS256" {
+		if secret := app.JWTSecret(); secret != nil {
+			return []byte(*secret), entry, nil
+		}
+	} else if v, ok := app.Preference("jwt.public_key").(string); ok && v != "" {
+		k, err := parseJWTKey(alg, []byte(v))
+		return k, entry, err
+	}
+	return nil, nil, fmt.Errorf("tenant %d has no %s key", id, alg)
+}
+
+// 校验 JWT 并返回 claims 与签发的租户；
+// 验签的密钥与 aud 取决于租户，先读取未验证的 claims 确定租户，再按租户的设置校验
+func (s *tenantService) verifyJWT(ctx context.Context, raw string) (*JWTClaims, *tenantEntry, error) {
+	var unverified JWTClaims
+	token, _, err := jwt.NewParser(jwt.WithValidMethods(jwtMethods)).ParseUnverified(raw, &unverified)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !slices.Contains(jwtMethods, token.Method.Alg()) {
+		return nil, nil, fmt.Errorf("unexpected alg %s", token.Method.Alg())
+	}
+
+	key, entry, err := s.jwtKey(ctx, token, &unverified)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, ok := unverified.tenantId()
+	if !ok {
+		return nil, nil, errors.New("tenant is required")
+	}
+	if entry == nil {
+		if entry, err = s.getTenantInfoByID(ctx, id); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	audience := s.jwt.Audience
+	app := common.App{TenantInfo: entry.TenantInfo}
+	if v, ok := app.Preference("jwt.audience").(string); ok && v != "" {
+		audience = v
+	}
+
+	// 要求必须是有期限的凭证
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithLeeway(s.jwt.Leeway),
+		jwt.WithExpirationRequired(),
+	}
+	if audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
+
+	var claims JWTClaims
+	if _, err := jwt.ParseWithClaims(raw, &claims, func(*jwt.Token) (any, error) {
+		return key, nil
+	}, options...); err != nil {
+		return nil, nil, err
+	}
+	// kid 绑定的租户
+	claims.Tenant = unverified.Tenant
+
+	return &claims, entry, nil
+}
+
+// 使用后端签发的 JWT 访问，claims 中的 bucket、chains、methods 与限流会覆盖请求中的设置；
+// 调整了限流但没有 bucket 时使用 jwt:<sub> 作为 bucket
+func (s *tenantService) AccessJWT(ctx context.Context, raw, bucket string, cost int64, check func(app *common.App) error) (*common.App, error) {
+	claims, entry, err := s.verifyJWT(ctx, raw)
+	if err != nil {
+		s.logger.Debug().Err(err).Msg("Invalid jwt")
+		return nil, common.ForbiddenError("JWT is invalid", err)
+	}
+
+	switch {
+	case claims.Bucket != "":
+		bucket = claims.Bucket
+	case claims.Rate > 0 || claims.Capacity > 0:
+		// 限流只对 JWT 自己的令牌桶生效，不能与租户共用，否则会改变共用令牌桶的恢复速率
+		if claims.Subject == "" {
+			return nil, common.ForbiddenError("JWT is invalid", errors.New("bucket or sub is required for rate limits"))
+		}
+		bucket = helpers.Concat("jwt:", claims.Subject)
+	}
+	credential := _TenantCredential(entry.ID)
+
+	return s.access(ctx, credential, bucket, cost, func(e *tenantEntry) error {
+		*e = *entry
+		return nil
+	}, func(app *common.App) {
+		app.Scopes = map[string][]string{}
+		if claims.Chains != nil {
+			app.Scopes["chains"] = claims.Chains
+		}
+		if claims.Methods != nil {
+			app.Scopes["methods"] = claims.Methods
+		}
+		app.MaxRate, app.MaxCapacity = claims.Rate, claims.Capacity
+	}, check)
+}
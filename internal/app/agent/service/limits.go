@@ -0,0 +1,143 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+)
+
+// 请求的大小限制，0 表示不限制
+type requestLimits struct {
+	// 请求体的最大字节数
+	MaxBodySize int64 `koanf:"max_body_size"`
+	// 批量调用的最大数量
+	MaxBatchSize int64 `koanf:"max_batch_size"`
+	// eth_getLogs 的最大区块跨度
+	MaxLogsRange int64 `koanf:"max_logs_range"`
+	// params 的最大嵌套层数
+	MaxParamDepth int64 `koanf:"max_param_depth"`
+}
+
+// 读取请求的大小限制，链的配置覆盖全局配置，租户 preferences 中的配置覆盖链的配置：
+//
+//	{"limits": {"max_body_size": 1048576, "max_batch_size": 100, "max_logs_range": 10000, "max_param_depth": 8}}
+//
+// 请求体在识别租户之前就要检查，租户的 max_body_size 只能调低链的限制
+func loadRequestLimits(rc reqctx.Reqctxs) requestLimits {
+	var c requestLimits
+	conf := rc.Config()
+	conf.Unmarshal("jsonrpc.limits", &c)
+	conf.Unmarshal(helpers.Concat("jsonrpc.limits.chains.", fmt.Sprint(rc.ChainID())), &c)
+
+	if app := rc.App(); app != nil {
+		for path, v := range map[string]*int64{
+			"limits.max_body_size":   &c.MaxBodySize,
+			"limits.max_batch_size":  &c.MaxBatchSize,
+			"limits.max_logs_range":  &c.MaxLogsRange,
+			"limits.max_param_depth": &c.MaxParamDepth,
+		} {
+			n := app.PreferenceInt64(path)
+			if v == &c.MaxBodySize && c.MaxBodySize > 0 {
+				n = min(n, c.MaxBodySize)
+			}
+			if n > 0 {
+				*v = n
+			}
+		}
+	}
+	return c
+}
+
+// 在解析请求、识别租户之前检查请求体的大小，避免解析超大的请求
+func CheckRequestBody(rc reqctx.Reqctxs) error {
+	return loadRequestLimits(rc).checkBody(*rc.Body())
+}
+
+// 整个请求超出限制时，返回 id 为 null 的 JSON-RPC 错误
+func limitExceededError(code int, msg string) error {
+	b, err := rpc.MarshalJSONRPCResults(rpc.SealedJSONRPCResult{
+		Version: "2.0",
+		Error:   rpc.NewJSONRPCError(code, msg),
+	})
+	if err != nil {
+		return common.BadRequestError(msg)
+	}
+	return common.InterceptError(msg, b)
+}
+
+// 检查请求体的大小
+func (c requestLimits) checkBody(body []byte) error {
+	if c.MaxBodySize > 0 && int64(len(body)) > c.MaxBodySize {
+		return limitExceededError(rpc.ERROR_CODE_LIMIT_EXCEEDED, fmt.Sprintf("request body of %d bytes exceeds the limit of %d bytes", len(body), c.MaxBodySize))
+	}
+	return nil
+}
+
+// 检查批量调用的数量
+func (c requestLimits) checkBatch(n int) error {
+	if c.MaxBatchSize > 0 && int64(n) > c.MaxBatchSize {
+		return limitExceededError(rpc.ERROR_CODE_LIMIT_EXCEEDED, fmt.Sprintf("batch of %d calls exceeds the limit of %d calls", n, c.MaxBatchSize))
+	}
+	return nil
+}
+
+// 检查单个调用，返回超出的限制，未超出时返回空字符串；head 返回已知的最新高度，用于 toBlock 为 latest 的情况
+func (c requestLimits) check(jsonrpc rpc.JSONRPCer, head func() uint64) string {
+	if c.MaxParamDepth > 0 {
+		if depth := paramDepth(jsonrpc.Params()); int64(depth) > c.MaxParamDepth {
+			return fmt.Sprintf("params depth of %d exceeds the limit of %d", depth, c.MaxParamDepth)
+		}
+	}
+
+	if c.MaxLogsRange > 0 && jsonrpc.Method() == "eth_getLogs" && len(jsonrpc.Params()) > 0 {
+		filter, _ := jsonrpc.Params()[0].(map[string]any)
+		if filter == nil || filter["blockHash"] != nil {
+			return ""
+		}
+		from, fromOk := logsBlock(filter["fromBlock"], head)
+		to, toOk := logsBlock(filter["toBlock"], head)
+		// 只拒绝确定超出限制的跨度；最新高度未知或参数无效时交由节点处理
+		if !fromOk || !toOk {
+			return ""
+		}
+		if to >= from && int64(to-from+1) > c.MaxLogsRange {
+			return fmt.Sprintf("eth_getLogs range of %d blocks exceeds the limit of %d blocks", to-from+1, c.MaxLogsRange)
+		}
+	}
+
+	return ""
+}
+
+// 解析 eth_getLogs 的区块参数，latest、safe、finalized、pending 与省略时按已知的最新高度计算；
+// ok 为 false 时无法确定区块号，如最新高度未知或参数无效
+func logsBlock(v any, head func() uint64) (n uint64, ok bool) {
+	switch v := fmt.Sprint(v); v {
+	case "earliest":
+		return 0, true
+	case "latest", "safe", "finalized", "pending", "<nil>":
+		n = head()
+		return n, n > 0
+	default:
+		return helpers.ParseHexUint64(v)
+	}
+}
+
+func paramDepth(v any) int {
+	depth := 0
+	switch v := v.(type) {
+	case []any:
+		for i := range v {
+			depth = max(depth, paramDepth(v[i]))
+		}
+	case map[string]any:
+		for k := range v {
+			depth = max(depth, paramDepth(v[k]))
+		}
+	default:
+		return 0
+	}
+	return depth + 1
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/jackc/pgx/pgtype"
+)
+
+func TestRequestLimitsCheck(t *testing.T) {
+	limits := requestLimits{MaxLogsRange: 100, MaxParamDepth: 4}
+	known := func() uint64 { return 1000 }
+	unknown := func() uint64 { return 0 }
+
+	tests := []struct {
+		method string
+		params []any
+		head   func() uint64
+		reason string
+	}{
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x1", "toBlock": "0x64"}}, known, ""},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x1", "toBlock": "0x65"}}, known, "range of 101 blocks"},
+		{"eth_getLogs", []any{map[string]any{"blockHash": "0xabc"}}, known, ""},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "earliest", "toBlock": "0x63"}}, known, ""},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "earliest", "toBlock": "latest"}}, known, "range of 1001 blocks"},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x384"}}, known, "range of 101 blocks"},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x385"}}, known, ""},
+		// safe、finalized、pending 按最新高度计算，不能绕过限制
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x1", "toBlock": "safe"}}, known, "range of 1000 blocks"},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x1", "toBlock": "finalized"}}, known, "range of 1000 blocks"},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x1", "toBlock": "pending"}}, known, "range of 1000 blocks"},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "latest", "toBlock": "pending"}}, unknown, ""},
+		{"eth_getLogs", []any{map[string]any{}}, unknown, ""},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "latest", "toBlock": "latest"}}, known, ""},
+		// 最新高度未知或参数无效时无法确定跨度，交由节点处理
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x1", "toBlock": "latest"}}, unknown, ""},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "earliest", "toBlock": "finalized"}}, unknown, ""},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x1", "toBlock": "0xzz"}}, known, ""},
+		// 区块号确定时仍然检查跨度
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "earliest", "toBlock": "0x64"}}, unknown, "range of 101 blocks"},
+		{"eth_call", []any{map[string]any{"a": map[string]any{"b": []any{1}}}}, known, ""},
+		{"eth_call", []any{map[string]any{"a": map[string]any{"b": []any{[]any{1}}}}}, known, "params depth of 5"},
+	}
+
+	for _, test := range tests {
+		jsonrpc := rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1, "method": test.method, "params": test.params})
+		reason := limits.check(jsonrpc, test.head)
+		if (test.reason == "") != (reason == "") || !strings.Contains(reason, test.reason) {
+			t.Errorf("%s %v: expected %q, got %q", test.method, test.params, test.reason, reason)
+		}
+	}
+}
+
+func TestCheckRequestBody(t *testing.T) {
+	conf := newConfig(map[string]any{"jsonrpc.limits.max_body_size": 64})
+	body := `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}` + strings.Repeat(" ", 64)
+
+	if err := CheckRequestBody(newTestReqctx(conf, body)); err == nil {
+		t.Errorf("expected body size exceeded")
+	}
+
+	// 租户不能调高请求体的限制
+	app := &common.App{TenantInfo: createTenant("abc")}
+	app.Preferences = &pgtype.JSONB{Bytes: []byte(`{"limits": {"max_body_size": 1048576}}`), Status: pgtype.Present}
+	rc := newTestReqctx(conf, body)
+	rc.SetApp(app)
+	if err := CheckRequestBody(rc); err == nil {
+		t.Errorf("expected body size exceeded")
+	}
+
+	app.Preferences = &pgtype.JSONB{Bytes: []byte(`{"limits": {"max_body_size": 32}}`), Status: pgtype.Present}
+	rc = newTestReqctx(conf, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+	rc.SetApp(app)
+	if err := CheckRequestBody(rc); err == nil {
+		t.Errorf("expected body size exceeded")
+	}
+
+	if err := CheckRequestBody(newTestReqctx(conf, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
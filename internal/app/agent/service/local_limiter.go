@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// 限流模式
+const (
+	RATE_LIMIT_MODE_REDIS = "redis"
+	RATE_LIMIT_MODE_LOCAL = "local"
+)
+
+// Redis 不可用时的降级配置
+type fallbackConfig struct {
+	// 是否在 Redis 不可用时降级为本地限流，未开启时请求直接失败
+	Enable bool `koanf:"enable"`
+	// 实例数，本地限流时容量与恢复速率按实例数平分
+	Replicas int64 `koanf:"replicas"`
+	// 降级期间检查 Redis 是否恢复的间隔
+	ProbeInterval time.Duration `koanf:"probe_interval"`
+}
+
+// 本实例内的令牌桶，只在 Redis 不可用时使用
+type localLimiter struct {
+	replicas int64
+	buckets  sync.Map
+}
+
+type localBucket struct {
+	mu       sync.Mutex
+	balance  float64
+	capacity float64
+	last     time.Time
+}
+
+func newLocalLimiter(replicas int64) *localLimiter {
+	return &localLimiter{replicas: max(replicas, 1)}
+}
+
+// 与 redis 中的 balance 脚本一致：余额不足时不扣除，返回负数表示缺少的额度
+func (l *localLimiter) take(key string, capacity, rate, cost int64) int64 {
+	var (
+		c   = float64(capacity) / float64(l.replicas)
+		r   = float64(rate) / float64(l.replicas)
+		now = time.Now()
+	)
+	if c <= 0 || r <= 0 {
+		return 0
+	}
+
+	v, _ := l.buckets.LoadOrStore(key, &localBucket{balance: c, capacity: c, last: now})
+	bucket := v.(*localBucket)
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	bucket.capacity = c
+	bucket.balance = math.Min(c, bucket.balance+now.Sub(bucket.last).Seconds()*r)
+	bucket.last = now
+
+	if bucket.balance < float64(cost) {
+		return int64(math.Floor(bucket.balance)) - cost
+	}
+	bucket.balance -= float64(cost)
+	return int64(math.Floor(bucket.balance))
+}
+
+// 退还请求失败时扣除的额度
+func (l *localLimiter) refund(key string, cost int64) {
+	v, ok := l.buckets.Load(key)
+	if !ok {
+		return
+	}
+	bucket := v.(*localBucket)
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.balance = math.Min(bucket.capacity, bucket.balance+float64(cost))
+}
+
+// 清除长时间未使用的令牌桶
+func (l *localLimiter) prune(idle time.Duration) {
+	deadline := time.Now().Add(-idle)
+	l.buckets.Range(func(key, v any) bool {
+		bucket := v.(*localBucket)
+		bucket.mu.Lock()
+		expired := bucket.last.Before(deadline)
+		bucket.mu.Unlock()
+		if expired {
+			l.buckets.Delete(key)
+		}
+		return true
+	})
+}
+
+func (l *localLimiter) reset() {
+	l.buckets.Range(func(key, _ any) bool {
+		l.buckets.Delete(key)
+		return true
+	})
+}
+
+// Redis 返回的错误（如脚本错误）说明 Redis 仍然可用，不需要降级
+func isRedisUnavailable(ctx context.Context, err error) bool {
+	if err == nil || err == redis.Nil || ctx.Err() != nil {
+		return false
+	}
+	var rerr redis.Error
+	return !errors.As(err, &rerr)
+}
+
+// 当前的限流模式
+func (s *tenantService) RateLimitMode() string {
+	if s.degraded.Load() {
+		return RATE_LIMIT_MODE_LOCAL
+	}
+	return RATE_LIMIT_MODE_REDIS
+}
+
+// 切换为本地限流，并在后台检查 Redis 是否恢复
+func (s *tenantService) degrade(err error) {
+	if !s.degraded.CompareAndSwap(false, true) {
+		return
+	}
+	s.logger.Warn().Err(err).Int64("replicas", s.limiter.replicas).Msg("Redis is unavailable, fall back to local rate limit")
+	utils.RateLimitMode.Set(1)
+
+	go s.probe()
+}
+
+func (s *tenantService) probe() {
+	defer func() {
+		if err := recover(); err != nil {
+			s.logger.Error().Interface("error", err).Msg("Panic to probe() goroutine")
+		}
+	}()
+
+	ticker := time.NewTicker(s.fallback.ProbeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), s.fallback.ProbeInterval)
+		err := s.redis.Client.Ping(ctx).Err()
+		cancel()
+		if err != nil {
+			s.logger.Debug().Err(err).Msg("Redis is still unavailable")
+			continue
+		}
+
+		// 恢复后以 Redis 中的余额为准，丢弃本地的令牌桶
+		s.limiter.reset()
+		s.degraded.Store(false)
+		utils.RateLimitMode.Set(0)
+		s.logger.Info().Msg("Redis is recovered, switch back to redis rate limit")
+		return
+	}
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/rs/zerolog"
+)
+
+// 中继的签名方式
+const (
+	// X-Flashbots-Signature: <address>:<personal_sign(keccak256(body))>
+	RELAY_SIGNING_FLASHBOTS = "flashbots"
+)
+
+// bundle 相关的方法，只会发送到私有中继
+var bundleMethods = []string{
+	"eth_sendBundle",
+	"eth_callBundle",
+	"eth_cancelBundle",
+	"mev_sendBundle",
+	"mev_simBundle",
+	"eth_sendPrivateTransaction",
+	"eth_sendPrivateRawTransaction",
+	"eth_cancelPrivateTransaction",
+}
+
+type privateRelay struct {
+	Name string `koanf:"name"`
+	Url  string `koanf:"url"`
+	// 生效的链 ID 或链代码，为空时对所有链生效
+	Chains  []string          `koanf:"chains"`
+	Headers map[string]string `koanf:"headers"`
+	// 请求的签名方式，为空时不签名
+	Signing string `koanf:"signing"`
+	// 签名使用的私钥，十六进制
+	Key string `koanf:"key"`
+
+	key     *secp256k1.PrivateKey
+	address string
+}
+
+// 私有中继，开启后交易与 bundle 不会发送到公开节点：
+//
+//	agent:
+//	  private-relay:
+//	    timeout: 10s
+//	    relays:
+//	      - name: flashbots
+//	        url: https://relay.flashbots.net
+//	        chains: ["1"]
+//	        signing: flashbots
+//	        key: "0x..."
+//
+// 租户的 preferences 中 {"private_relay": {"enable": true, "relays": ["flashbots"], "fallback": false}}
+// 或请求参数 private_relay 开启，中继都不可用时只有明确允许 fallback 才会广播到公开节点
+type privateRelays struct {
+	Timeout time.Duration  `koanf:"timeout"`
+	Relays  []privateRelay `koanf:"relays"`
+
+	client *http.Client
+}
+
+func newPrivateRelays(config *config.Conf, logger zerolog.Logger) *privateRelays {
+	relays := &privateRelays{Timeout: 10 * time.Second}
+	config.Unmarshal("agent.private-relay", relays)
+
+	relays.Relays = slices.DeleteFunc(relays.Relays, func(relay privateRelay) bool {
+		if relay.Url == "" {
+			logger.Warn().Msgf("Private relay %s has no url, ignored", relay.Name)
+			return true
+		}
+		return false
+	})
+	for i := range relays.Relays {
+		relay := &relays.Relays[i]
+		if relay.Signing == "" {
+			continue
+		}
+		if relay.Signing != RELAY_SIGNING_FLASHBOTS {
+			logger.Fatal().Msgf("Private relay %s has unknown signing %s", relay.Name, relay.Signing)
+		}
+		b, err := hex.DecodeString(strings.TrimPrefix(relay.Key, "0x"))
+		if err != nil || len(b) != 32 {
+			logger.Fatal().Msgf("Private relay %s has invalid signing key", relay.Name)
+		}
+		relay.key = secp256k1.PrivKeyFromBytes(b)
+		relay.address = "0x" + hex.EncodeToString(rpc.Keccak256(relay.key.PubKey().SerializeUncompressed()[1:])[12:])
+	}
+
+	relays.client = &http.Client{Timeout: relays.Timeout}
+	return relays
+}
+
+// 返回链可用的中继，names 为 nil 时返回所有中继
+func (r *privateRelays) match(rc reqctx.Reqctxs, names []string) []*privateRelay {
+	relays := []*privateRelay{}
+	for i := range r.Relays {
+		relay := &r.Relays[i]
+		if len(relay.Chains) > 0 && !allowChain(rc, relay.Chains) {
+			continue
+		}
+		if names != nil && !slices.Contains(names, relay.Name) {
+			continue
+		}
+		relays = append(relays, relay)
+	}
+	return relays
+}
+
+// 请求体的签名，格式与 flashbots 一致
+func (r *privateRelay) sign(body []byte) string {
+	msg := "0x" + hex.EncodeToString(rpc.Keccak256(body))
+	digest := rpc.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(msg), msg)))
+	// [27 + recovery, r, s] 转为 [r, s, 27 + recovery]
+	sig := ecdsa.SignCompact(r.key, digest, false)
+	sig = append(sig[1:], sig[0])
+	return r.address + ":0x" + hex.EncodeToString(sig)
+}
+
+func (r *privateRelays) call(ctx context.Context, relay *privateRelay, jsonrpc rpc.JSONRPCer) (rpc.JSONRPCResulter, error) {
+	body, err := json.Marshal(jsonrpc.Seal())
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, relay.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range relay.Headers {
+		req.Header.Set(key, value)
+	}
+	if relay.Signing == RELAY_SIGNING_FLASHBOTS {
+		req.Header.Set("X-Flashbots-Signature", relay.sign(body))
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	results, _, err := rpc.UnmarshalJSONRPCResults(b)
+	if err != nil || len(results) <= 0 {
+		return nil, fmt.Errorf("unexpected response from %s: %d %s", relay.Name, resp.StatusCode, b)
+	}
+	return results[0], nil
+}
+
+// 将交易与 bundle 发送到私有中继，ok 为 false 时按公开节点的流程处理
+func (a agentService) sendPrivate(ctx context.Context, rc reqctx.Reqctxs, jsonrpc rpc.JSONRPCer) (result rpc.SealedJSONRPCResult, ok bool, err error) {
+	var (
+		method = jsonrpc.Method()
+		bundle = slices.Contains(bundleMethods, method)
+	)
+	if !bundle && method != "eth_sendRawTransaction" {
+		return result, false, nil
+	}
+	names, enabled := rc.Options().PrivateRelays()
+	if !enabled && !bundle {
+		return result, false, nil
+	}
+	// bundle 没有公开节点可以回退
+	fallback := !bundle && rc.Options().PrivateFallback()
+
+	relays := a.relays.match(rc, names)
+	if len(relays) <= 0 {
+		if fallback {
+			rc.Logger().Warn().Msgf("No private relay for chain %d, fall back to public broadcast", rc.ChainID())
+			return result, false, nil
+		}
+		code := rpc.ERROR_CODE_NOT_ALLOWED
+		if bundle {
+			code = rpc.ERROR_CODE_METHOD_NOT_FOUND
+		}
+		return jsonrpc.MakeResult(nil, rpc.NewJSONRPCError(code, fmt.Sprintf("no private relay available for chain %d", rc.ChainID()))), true, nil
+	}
+
+	hash := ""
+	if !bundle {
+		if len(jsonrpc.Params()) != 1 {
+			return jsonrpc.MakeResult(nil, rpc.NewJSONRPCError(rpc.ERROR_CODE_INVALID_PARAMS, "invalid params")), true, nil
+		}
+		config := loadSendRawTransactionConfig(rc.Config(), rc.ChainID())
+		tx, _, reason := validateRawTransaction(rc, jsonrpc, &config)
+		if reason != "" {
+			return jsonrpc.MakeResult(nil, rpc.NewJSONRPCError(rpc.ERROR_CODE_INVALID_PARAMS, reason)), true, nil
+		}
+		hash = tx.Hash()
+	}
+
+	var (
+		results = make([]rpc.JSONRPCResulter, len(relays))
+		errs    = make([]error, len(relays))
+		wg      sync.WaitGroup
+	)
+	for i := range relays {
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				if err := recover(); err != nil {
+					a.logger.Error().Interface("error", err).Msg("Failed to send to private relay")
+					errs[i] = errors.New("panic")
+				}
+				wg.Done()
+			}()
+
+			results[i], errs[i] = a.relays.call(ctx, relays[i], jsonrpc)
+		}(i)
+	}
+	wg.Wait()
+
+	var rpcErr any
+	for i := range relays {
+		if errs[i] != nil {
+			rc.Logger().Warn().Err(errs[i]).Msgf("%s to private relay %s failed", method, relays[i].Name)
+			continue
+		}
+		switch e := results[i].Error(); {
+		case e == nil:
+			if bundle {
+				return jsonrpc.MakeResult(results[i].Result(), nil), true, nil
+			}
+			a.track(ctx, rc, hash)
+			return jsonrpc.MakeResult(hash, nil), true, nil
+		case !bundle && isKnownTransactionError(e):
+			a.track(ctx, rc, hash)
+			return jsonrpc.MakeResult(hash, nil), true, nil
+		default:
+			if rpcErr == nil {
+				rpcErr = e
+			}
+		}
+	}
+
+	if fallback {
+		rc.Logger().Warn().Msgf("All private relays failed to send %s, fall back to public broadcast", hash)
+		return result, false, nil
+	}
+	if rpcErr != nil {
+		return jsonrpc.MakeResult(nil, rpcErr), true, nil
+	}
+	return result, true, common.UpstreamServerError("All private relays are unavailable")
+}
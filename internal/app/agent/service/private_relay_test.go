@@ -0,0 +1,52 @@
+package service
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/jackc/pgx/pgtype"
+)
+
+func TestPrivateRelayOptions(t *testing.T) {
+	tests := []struct {
+		preferences string
+		query       string
+		relays      []string
+		enabled     bool
+		fallback    bool
+	}{
+		{``, ``, nil, false, false},
+		{``, `?private_relay=true&private_fallback=true`, nil, true, true},
+		{``, `?private_relay=flashbots`, []string{"flashbots"}, true, false},
+		{`{"private_relay": {"enable": true}}`, `?private_relay=false`, nil, true, false},
+		// 请求参数只能在租户指定的中继中选择
+		{`{"private_relay": {"enable": true, "relays": ["flashbots"]}}`, `?private_relay=titan,flashbots`, []string{"flashbots"}, true, false},
+		{`{"private_relay": {"enable": true, "relays": ["flashbots"]}}`, `?private_relay=titan`, []string{}, true, false},
+		{`{"private_relay": {"enable": true, "relays": []}}`, `?private_relay=titan`, []string{"titan"}, true, false},
+		// 请求参数不能开启租户关闭的回退
+		{`{"private_relay": {"enable": true, "fallback": false}}`, `?private_fallback=true`, nil, true, false},
+		{`{"private_relay": {"enable": true}}`, `?private_fallback=true`, nil, true, false},
+		{`{"private_relay": {"fallback": false}}`, `?private_relay=true&private_fallback=true`, nil, true, false},
+		{`{"private_relay": {"enable": true, "fallback": true}}`, ``, nil, true, true},
+		{`{"private_relay": {"enable": true, "fallback": true}}`, `?private_fallback=false`, nil, true, false},
+	}
+
+	conf := newConfig(map[string]any{})
+	for _, test := range tests {
+		rc := newTestReqctxWithURI(conf, "/1"+test.query, "")
+		if test.preferences != "" {
+			app := &common.App{TenantInfo: createTenant("abc")}
+			app.Preferences = &pgtype.JSONB{Bytes: []byte(test.preferences), Status: pgtype.Present}
+			rc.SetApp(app)
+		}
+
+		relays, enabled := rc.Options().PrivateRelays()
+		if enabled != test.enabled || (relays == nil) != (test.relays == nil) || !slices.Equal(relays, test.relays) {
+			t.Errorf("%s %s: expected relays %v %v, got %v %v", test.preferences, test.query, test.relays, test.enabled, relays, enabled)
+		}
+		if fallback := rc.Options().PrivateFallback(); fallback != test.fallback {
+			t.Errorf("%s %s: expected fallback %v, got %v", test.preferences, test.query, test.fallback, fallback)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"strconv"
+
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+)
+
+// 固定返回的结果或错误
+type responderRule struct {
+	// 方法名，支持通配符
+	Method string `koanf:"method"`
+	// 生效的链 ID 或链代码，为空时对所有链生效
+	Chains []string `koanf:"chains"`
+	Result any      `koanf:"result"`
+	Error  *struct {
+		Code    int    `koanf:"code"`
+		Message string `koanf:"message"`
+	} `koanf:"error"`
+}
+
+// 不请求节点，直接在本地返回结果：
+//
+//	jsonrpc:
+//	  responder:
+//	    client_version: "Web3RPCProxy/v1"
+//	    rules:
+//	      - method: eth_accounts
+//	        result: []
+//	      - method: eth_mining
+//	        chains: ["1"]
+//	        error: {code: -32601, message: "method eth_mining is not available"}
+//
+// eth_chainId、net_version 按链的配置返回，规则优先于内置的方法；网络 ID 与链 ID 不同的链可以用规则覆盖 net_version
+type localResponder struct {
+	Disable       bool            `koanf:"disable"`
+	ClientVersion string          `koanf:"client_version"`
+	Rules         []responderRule `koanf:"rules"`
+}
+
+func newLocalResponder(config *config.Conf) *localResponder {
+	responder := &localResponder{}
+	config.Unmarshal("jsonrpc.responder", responder)
+	return responder
+}
+
+// 返回本地的结果，ok 为 false 时需要请求节点
+func (r *localResponder) respond(rc reqctx.Reqctxs, jsonrpc rpc.JSONRPCer) (result rpc.SealedJSONRPCResult, ok bool) {
+	if r.Disable {
+		return result, false
+	}
+
+	method := jsonrpc.Method()
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if !allowMethod([]string{rule.Method}, method) {
+			continue
+		}
+		if len(rule.Chains) > 0 && !allowChain(rc, rule.Chains) {
+			continue
+		}
+		if rule.Error != nil {
+			return jsonrpc.MakeResult(nil, rpc.NewJSONRPCError(rule.Error.Code, rule.Error.Message)), true
+		}
+		return jsonrpc.MakeResult(rule.Result, nil), true
+	}
+
+	chainId := rc.ChainID()
+	switch method {
+	case "eth_chainId":
+		if chainId != 0 {
+			return jsonrpc.MakeResult(helpers.FormatHexUint64(chainId), nil), true
+		}
+	case "net_version":
+		if chainId != 0 {
+			return jsonrpc.MakeResult(strconv.FormatUint(chainId, 10), nil), true
+		}
+	case "web3_clientVersion":
+		if r.ClientVersion != "" {
+			return jsonrpc.MakeResult(r.ClientVersion, nil), true
+		}
+	}
+	return result, false
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+)
+
+type sendRawTransactionConfig struct {
+	// 同时广播的节点数
+	Broadcast int `koanf:"broadcast"`
+	// 是否允许未使用 EIP-155 的交易
+	AllowUnprotected bool `koanf:"allow-unprotected"`
+	// 只向这些节点广播，为空时从链的所有节点中选择
+	Endpoints []string `koanf:"endpoints"`
+}
+
+// 节点已经收到该交易时的错误信息，视为广播成功
+var knownTransactionErrors = []string{
+	"already known",
+	"known transaction",
+	"already imported",
+	"already exists",
+	"alreadyknown",
+}
+
+// 读取交易广播配置，链的配置会覆盖全局配置
+func loadSendRawTransactionConfig(conf *config.Conf, chainId common.ChainId) sendRawTransactionConfig {
+	c := sendRawTransactionConfig{Broadcast: 3}
+	conf.Unmarshal("agent.send-raw-transaction", &c)
+	conf.Unmarshal(helpers.Concat("agent.send-raw-transaction.chains.", fmt.Sprint(chainId)), &c)
+	return c
+}
+
+func rpcErrorMessage(err any) string {
+	if v, ok := err.(map[string]any); ok {
+		return strings.ToLower(fmt.Sprint(v["message"]))
+	}
+	return strings.ToLower(fmt.Sprint(err))
+}
+
+func isKnownTransactionError(err any) bool {
+	msg := rpcErrorMessage(err)
+	return slices.ContainsFunc(knownTransactionErrors, func(s string) bool {
+		return strings.Contains(msg, s)
+	})
+}
+
+// 解码 eth_sendRawTransaction 的交易并校验链 ID 与签名，返回发送者；校验失败时返回原因
+func validateRawTransaction(rc reqctx.Reqctxs, jsonrpc rpc.JSONRPCer, config *sendRawTransactionConfig) (tx *rpc.RawTransaction, sender string, reason string) {
+	raw, _ := jsonrpc.Params()[0].(string)
+	tx, err := rpc.DecodeRawTransaction(raw)
+	if err != nil {
+		return nil, "", helpers.Concat("invalid raw transaction: ", err.Error())
+	}
+
+	if tx.ChainID == nil {
+		if !config.AllowUnprotected {
+			return nil, "", "only replay-protected (EIP-155) transactions allowed"
+		}
+	} else if tx.ChainID.Cmp(new(big.Int).SetUint64(rc.ChainID())) != 0 {
+		return nil, "", fmt.Sprintf("invalid chain id: have %s want %d", tx.ChainID, rc.ChainID())
+	}
+
+	if sender, err = tx.Sender(); err != nil {
+		return nil, "", helpers.Concat("invalid sender: ", err.Error())
+	}
+	return tx, sender, ""
+}
+
+// 解码并校验交易，校验通过后并行广播到多个节点，返回交易哈希
+func (a agentService) sendRawTransaction(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpc rpc.JSONRPCer) (result rpc.SealedJSONRPCResult, ok bool, err error) {
+	if jsonrpc.Method() != "eth_sendRawTransaction" || len(jsonrpc.Params()) != 1 {
+		return result, false, nil
+	}
+
+	config := loadSendRawTransactionConfig(rc.Config(), rc.ChainID())
+	tx, sender, reason := validateRawTransaction(rc, jsonrpc, &config)
+	if reason != "" {
+		return jsonrpc.MakeResult(nil, rpc.NewJSONRPCError(rpc.ERROR_CODE_INVALID_PARAMS, reason)), true, nil
+	}
+	hash := tx.Hash()
+
+	candidates := endpoints
+	if len(config.Endpoints) > 0 {
+		candidates = slices.DeleteFunc(slices.Clone(endpoints), func(e *endpoint.Endpoint) bool {
+			return !slices.Contains(config.Endpoints, e.Url().String())
+		})
+	}
+	_endpoints, ok := a.es.Select(ctx, rc, candidates, []rpc.JSONRPCer{jsonrpc})
+	if !ok || len(_endpoints) <= 0 {
+		a.logger.Error().Msgf("%d No available endpoints", rc.ChainID())
+		return result, true, common.InternalServerError("No available endpoints")
+	}
+	_endpoints = _endpoints[:min(len(_endpoints), max(config.Broadcast, 1))]
+
+	var (
+		results = make([][]rpc.SealedJSONRPCResult, len(_endpoints))
+		errs    = make([]error, len(_endpoints))
+		wg      sync.WaitGroup
+	)
+	for i := range _endpoints {
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				if err := recover(); err != nil {
+					a.logger.Error().Interface("error", err).Msg("Failed to send raw transaction")
+					errs[i] = common.InternalServerError("Failed to send raw transaction")
+				}
+				wg.Done()
+			}()
+
+			results[i], errs[i] = a.request(ctx, rc, _endpoints[i:i+1], []rpc.JSONRPCer{jsonrpc})
+		}(i)
+	}
+	wg.Wait()
+
+	var (
+		sent     = 0
+		accepted = []*endpoint.Endpoint{}
+		rpcErr   any
+	)
+	for i := range _endpoints {
+		if errs[i] != nil {
+			err = errs[i]
+			continue
+		}
+		if len(results[i]) <= 0 {
+			continue
+		}
+		switch e := results[i][0].Error; {
+		case e == nil:
+			if v, _ := results[i][0].Result.(string); !strings.EqualFold(v, hash) {
+				rc.Logger().Warn().Msgf("%s returned hash %s, expected %s", _endpoints[i].Url(), v, hash)
+			}
+			sent++
+			accepted = append(accepted, _endpoints[i])
+		case isKnownTransactionError(e):
+			sent++
+			accepted = append(accepted, _endpoints[i])
+		case strings.Contains(rpcErrorMessage(e), "nonce too low") && a.mined(ctx, rc, _endpoints[i:i+1], hash):
+			// 同一笔交易已经上链
+			sent++
+			accepted = append(accepted, _endpoints[i])
+		default:
+			if rpcErr == nil {
+				rpcErr = e
+			}
+		}
+	}
+
+	rc.Logger().Debug().Msgf("eth_sendRawTransaction %s from %s broadcast to %d/%d endpoints", hash, sender, sent, len(_endpoints))
+
+	if sent > 0 {
+		a.es.Stick(ctx, rc, []string{sender, hash}, accepted)
+		a.track(ctx, rc, hash)
+		return jsonrpc.MakeResult(hash, nil), true, nil
+	}
+	if rpcErr != nil {
+		return jsonrpc.MakeResult(nil, rpcErr), true, nil
+	}
+	if err == nil {
+		err = common.InternalServerError("All endpoints are unavailable")
+	}
+	return result, true, err
+}
+
+// 交易是否已经被节点收录
+func (a agentService) mined(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, hash string) bool {
+	query := rpc.NewJSONRPC(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      hash,
+		"method":  "eth_getTransactionByHash",
+		"params":  []any{hash},
+	})
+	results, err := a.request(ctx, rc, endpoints, []rpc.JSONRPCer{query})
+	return err == nil && len(results) > 0 && results[0].Error == nil && results[0].Result != nil
+}
+
+// 开始跟踪发出的交易，失败时只记录日志
+func (a agentService) track(ctx context.Context, rc reqctx.Reqctxs, hash string) {
+	if a.tracker == nil {
+		return
+	}
+	if err := a.tracker.Track(ctx, rc, hash); err != nil {
+		rc.Logger().Warn().Err(err).Msgf("Failed to track transaction %s", hash)
+	}
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+)
+
+func TestServeStale(t *testing.T) {
+	conf := newConfig(map[string]any{})
+	var available atomic.Bool
+	client := &fakeClient{handle: func(e *endpoint.Endpoint, jsonrpc rpc.SealedJSONRPC) map[string]any {
+		if !available.Load() {
+			return nil
+		}
+		return map[string]any{"result": "fresh"}
+	}}
+	a := newTestAgentService(t, conf, client, map[string]string{"eth_getBlockByHash": "1m"})
+	a.config.StaleMethods = map[string]time.Duration{"eth_getBlockByHash": time.Minute}
+	a.config.MaxStale = 10 * time.Minute
+
+	body := `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByHash","params":["0xabc",false]}`
+	key := _CacheKey(1, rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "eth_getBlockByHash", "params": []any{"0xabc", false}}))
+	// 写入指定时间之前的缓存
+	cached := func(age time.Duration) {
+		if err := _SetCache(a.cache, key, &CacheEntry{V: "cached", T: time.Now().Add(-age).UnixMilli()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call := func() (string, error) {
+		b, err := a.Call(context.Background(), newTestReqctx(conf, body), newTestEndpoints("http://a"))
+		if err != nil {
+			return "", err
+		}
+		var result struct {
+			Result string `json:"result"`
+		}
+		return result.Result, json.Unmarshal(b, &result)
+	}
+
+	// 可用窗口内直接返回过期的缓存，并在后台刷新
+	available.Store(true)
+	cached(90 * time.Second)
+	if v, err := call(); err != nil || v != "cached" {
+		t.Errorf("expected stale result, got %v %v", v, err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := a.revalidating.Load(key); !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !slices.Contains(client.called(), "eth_getBlockByHash") {
+		t.Errorf("expected stale result revalidated")
+	}
+
+	// 超出可用窗口后节点可用时请求节点
+	cached(5 * time.Minute)
+	if v, err := call(); err != nil || v != "fresh" {
+		t.Errorf("expected fresh result, got %v %v", v, err)
+	}
+
+	// 节点都不可用时返回最大过期时间内的缓存
+	available.Store(false)
+	cached(5 * time.Minute)
+	if v, err := call(); err != nil || v != "cached" {
+		t.Errorf("expected stale-if-error result, got %v %v", v, err)
+	}
+
+	cached(15 * time.Minute)
+	if _, err := call(); err == nil {
+		t.Errorf("expected error beyond max stale")
+	}
+}
+
+func TestCacheWindow(t *testing.T) {
+	methods := map[string]string{"eth_chainId": "24h", "eth_getBlockByHash": "10m", "eth_blockNumber": "0.1s"}
+	stales := map[string]time.Duration{"eth_getBlockByHash": time.Hour}
+	if window := cacheWindow(methods, stales, 10*time.Minute); window != 24*time.Hour+10*time.Minute {
+		t.Errorf("expected %s, got %s", 24*time.Hour+10*time.Minute, window)
+	}
+	stales["eth_getBlockByHash"] = 48 * time.Hour
+	if window := cacheWindow(methods, stales, 10*time.Minute); window != 48*time.Hour+10*time.Minute {
+		t.Errorf("expected %s, got %s", 48*time.Hour+10*time.Minute, window)
+	}
+
+	// 超出内存缓存存活时间的配置会被拒绝
+	a := newTestAgentService(t, newConfig(map[string]any{}), &fakeClient{}, map[string]string{"eth_getBlockByHash": "10m"})
+	if err := a.SetTTL("eth_getBlockByHash", CacheTTL{TTL: "30m", Stale: "1h"}); err == nil {
+		t.Errorf("expected cache window exceeded")
+	}
+	if ttl := a.TTLs()["eth_getBlockByHash"]; ttl.TTL != "10m" || ttl.Stale != "" {
+		t.Errorf("expected ttl unchanged, got %v", ttl)
+	}
+	if err := a.SetTTL("eth_getBlockByHash", CacheTTL{TTL: "30m", Stale: "10m"}); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
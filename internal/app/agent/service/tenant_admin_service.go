@@ -0,0 +1,488 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/app/database/schema"
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+	"github.com/jackc/pgx/pgtype"
+	"gorm.io/gorm"
+)
+
+// 租户信息变更后，通知所有实例清除本地缓存
+const tenantInvalidateChannel = "app#invalidate"
+
+// 租户的管理接口，由 tenantService 实现
+type TenantAdminService interface {
+	ListTenants(ctx context.Context, offset, limit int) ([]TenantView, int64, error)
+	GetTenant(ctx context.Context, id uint64) (*TenantView, error)
+	CreateTenant(ctx context.Context, input TenantInput) (*TenantView, error)
+	UpdateTenant(ctx context.Context, id uint64, input TenantInput) (*TenantView, error)
+	DeleteTenant(ctx context.Context, id uint64) error
+	RotateToken(ctx context.Context, id uint64) (*TenantView, error)
+	ResetBalance(ctx context.Context, id uint64, bucket string) (int, error)
+	ListApiKeys(ctx context.Context, id uint64) ([]ApiKeyView, error)
+	CreateApiKey(ctx context.Context, id uint64, input ApiKeyInput) (*ApiKeyView, error)
+	DeleteApiKey(ctx context.Context, id uint64, keyId uint64) error
+	Subscribe(ctx context.Context) error
+}
+
+// pgtype.JSONB 没有实现 json.Marshaler，返回给管理接口时转换为普通的 JSON
+type TenantView struct {
+	ID          uint64    `json:"id"`
+	Name        string    `json:"name"`
+	Token       string    `json:"token"`
+	Rate        float64   `json:"rate"`
+	Capacity    float64   `json:"capacity"`
+	Preferences any       `json:"preferences"`
+	Disabled    bool      `json:"disabled"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// 创建、更新租户的参数，更新时只修改非空的字段
+type TenantInput struct {
+	Name        *string         `json:"name"`
+	Token       *string         `json:"token"`
+	Rate        *float64        `json:"rate"`
+	Capacity    *float64        `json:"capacity"`
+	Preferences json.RawMessage `json:"preferences"`
+	Disabled    *bool           `json:"disabled"`
+}
+
+type ApiKeyView struct {
+	ID         uint64     `json:"id"`
+	TenantID   uint64     `json:"tenant_id"`
+	Prefix     string     `json:"prefix"`
+	Label      string     `json:"label"`
+	Scopes     any        `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// 只在创建时返回明文的 key
+	Key string `json:"key,omitempty"`
+}
+
+type ApiKeyInput struct {
+	Label     string          `json:"label"`
+	Scopes    json.RawMessage `json:"scopes"`
+	ExpiresAt *time.Time      `json:"expires_at"`
+}
+
+func NewTenantAdminService(tenantService TenantService) TenantAdminService {
+	return tenantService.(TenantAdminService)
+}
+
+func newTenantView(info *common.TenantInfo) *TenantView {
+	view := &TenantView{
+		ID:        info.ID,
+		Name:      info.Name,
+		Token:     info.Token,
+		Rate:      info.Rate,
+		Capacity:  info.Capacity,
+		Disabled:  info.Disabled,
+		CreatedAt: info.CreatedAt,
+	}
+	if info.Preferences != nil {
+		view.Preferences = info.Preferences.Get()
+	}
+	return view
+}
+
+func newApiKeyView(key *schema.ApiKey) *ApiKeyView {
+	view := &ApiKeyView{
+		ID:         key.ID,
+		TenantID:   key.TenantID,
+		Prefix:     key.Prefix,
+		Label:      key.Label,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		CreatedAt:  key.CreatedAt,
+	}
+	if key.Scopes != nil {
+		view.Scopes = key.Scopes.Get()
+	}
+	return view
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *tenantService) getTenant(ctx context.Context, id uint64) (*common.TenantInfo, error) {
+	var info common.TenantInfo
+	if err := s.tenantRepository.GetTenantByID(ctx, id, &info); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, common.NotFoundError("Tenant not found")
+		}
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (s *tenantService) ListTenants(ctx context.Context, offset, limit int) ([]TenantView, int64, error) {
+	tenants, count, err := s.tenantRepository.ListTenants(ctx, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	views := make([]TenantView, len(tenants))
+	for i := range tenants {
+		views[i] = *newTenantView(&tenants[i])
+	}
+	return views, count, nil
+}
+
+func (s *tenantService) GetTenant(ctx context.Context, id uint64) (*TenantView, error) {
+	info, err := s.getTenant(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return newTenantView(info), nil
+}
+
+func (s *tenantService) CreateTenant(ctx context.Context, input TenantInput) (*TenantView, error) {
+	if input.Name == nil || *input.Name == "" {
+		return nil, common.BadRequestError("Name is required")
+	}
+	if input.Rate == nil || *input.Rate <= 0 || input.Capacity == nil || *input.Capacity <= 0 {
+		return nil, common.BadRequestError("Rate and capacity must be greater than 0")
+	}
+
+	info := common.TenantInfo{
+		Name:     *input.Name,
+		Rate:     *input.Rate,
+		Capacity: *input.Capacity,
+		Preferences: &pgtype.JSONB{
+			Bytes:  []byte("{}"),
+			Status: pgtype.Present,
+		},
+	}
+	if input.Token != nil && *input.Token != "" {
+		info.Token = *input.Token
+	} else {
+		token, err := generateToken()
+		if err != nil {
+			return nil, err
+		}
+		info.Token = token
+	}
+	if len(input.Preferences) > 0 {
+		if !json.Valid(input.Preferences) {
+			return nil, common.BadRequestError("Invalid preferences")
+		}
+		info.Preferences.Bytes = input.Preferences
+	}
+	if input.Disabled != nil {
+		info.Disabled = *input.Disabled
+	}
+
+	if err := s.tenantRepository.CreateTenant(ctx, &info); err != nil {
+		return nil, err
+	}
+	// 之前用同一 token 访问失败的结果可能还在缓存中
+	s.invalidate(ctx, helpers.Hash([]byte(info.Token)))
+
+	return newTenantView(&info), nil
+}
+
+func (s *tenantService) UpdateTenant(ctx context.Context, id uint64, input TenantInput) (*TenantView, error) {
+	info, err := s.getTenant(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]any{}
+	if input.Name != nil {
+		if *input.Name == "" {
+			return nil, common.BadRequestError("Name is required")
+		}
+		values["name"] = *input.Name
+	}
+	if input.Rate != nil {
+		if *input.Rate <= 0 {
+			return nil, common.BadRequestError("Rate must be greater than 0")
+		}
+		values["rate"] = *input.Rate
+	}
+	if input.Capacity != nil {
+		if *input.Capacity <= 0 {
+			return nil, common.BadRequestError("Capacity must be greater than 0")
+		}
+		values["capacity"] = *input.Capacity
+	}
+	if len(input.Preferences) > 0 {
+		if !json.Valid(input.Preferences) {
+			return nil, common.BadRequestError("Invalid preferences")
+		}
+		values["preferences"] = &pgtype.JSONB{Bytes: input.Preferences, Status: pgtype.Present}
+	}
+	if input.Disabled != nil {
+		values["disabled"] = *input.Disabled
+	}
+	// token 只能通过 RotateToken 修改
+	if len(values) <= 0 {
+		return newTenantView(info), nil
+	}
+
+	if err := s.tenantRepository.UpdateTenant(ctx, info, values); err != nil {
+		return nil, err
+	}
+	s.invalidateTenant(ctx, info)
+
+	return newTenantView(info), nil
+}
+
+func (s *tenantService) DeleteTenant(ctx context.Context, id uint64) error {
+	info, err := s.getTenant(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// 删除后无法再查到租户的 API key，需要先取出
+	credentials, err := s.credentials(ctx, info)
+	if err != nil {
+		return err
+	}
+	if err := s.tenantRepository.DeleteTenant(ctx, id); err != nil {
+		return err
+	}
+	if _, err := s.resetBuckets(ctx, info.Token, ""); err != nil {
+		s.logger.Error().Err(err).Msgf("Failed to delete buckets of tenant %d", id)
+	}
+	return s.invalidate(ctx, credentials...)
+}
+
+// 生成新的 token，旧的 token 立即失效
+func (s *tenantService) RotateToken(ctx context.Context, id uint64) (*TenantView, error) {
+	info, err := s.getTenant(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	old := *info
+	if err := s.tenantRepository.UpdateTenant(ctx, info, map[string]any{"token": token}); err != nil {
+		return nil, err
+	}
+	if _, err := s.resetBuckets(ctx, old.Token, ""); err != nil {
+		s.logger.Error().Err(err).Msgf("Failed to delete buckets of tenant %d", id)
+	}
+	// API key 缓存的租户信息中也包含旧的 token
+	s.invalidateTenant(ctx, &old)
+
+	return newTenantView(info), nil
+}
+
+// 重置余额，bucket 为空时重置所有 bucket
+func (s *tenantService) ResetBalance(ctx context.Context, id uint64, bucket string) (int, error) {
+	info, err := s.getTenant(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := s.resetBuckets(ctx, info.Token, bucket)
+	if err != nil {
+		return 0, err
+	}
+	return n, s.invalidateTenant(ctx, info)
+}
+
+// 删除 bucket 的余额记录，下次访问时恢复到 capacity；不影响配额的计数
+func (s *tenantService) resetBuckets(ctx context.Context, token, bucket string) (int, error) {
+	if bucket != "" {
+		n, err := s.redis.Client.Del(ctx, _TenantKey(token, bucket)).Result()
+		return int(n), err
+	}
+
+	prefix := _TenantKey(token) + ":"
+	keys := []string{}
+	iter := s.redis.Client.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		// 只删除 app#token:bucket，不删除 token 下的其他记录
+		if key := iter.Val(); !strings.Contains(strings.TrimPrefix(key, prefix), ":") {
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	if len(keys) <= 0 {
+		return 0, nil
+	}
+
+	n, err := s.redis.Client.Del(ctx, keys...).Result()
+	return int(n), err
+}
+
+// 租户 token 与所有 API key 的 sha256
+func (s *tenantService) credentials(ctx context.Context, info *common.TenantInfo) ([]string, error) {
+	credentials := []string{helpers.Hash([]byte(info.Token)), _TenantCredential(info.ID)}
+	keys, err := s.tenantRepository.ListApiKeys(ctx, info.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		credentials = append(credentials, keys[i].Hash)
+	}
+	return credentials, nil
+}
+
+// 清除租户 token、JWT 与所有 API key 的缓存
+func (s *tenantService) invalidateTenant(ctx context.Context, info *common.TenantInfo) error {
+	credentials, err := s.credentials(ctx, info)
+	if err != nil {
+		return err
+	}
+	return s.invalidate(ctx, credentials...)
+}
+
+// 清除 redis 与所有实例本地缓存的租户信息，credentials 为访问凭证的 sha256
+func (s *tenantService) invalidate(ctx context.Context, credentials ...string) error {
+	s.evict(credentials...)
+
+	pipeline := s.redis.Client.Pipeline()
+	for i := range credentials {
+		pipeline.Del(ctx, _TenantKey(credentials[i]))
+	}
+	pipeline.Publish(ctx, tenantInvalidateChannel, strings.Join(credentials, ","))
+	if _, err := pipeline.Exec(ctx); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to invalidate tenant caches")
+		return err
+	}
+	return nil
+}
+
+// 清除本地缓存中这些凭证所有 bucket 的租户信息
+func (s *tenantService) evict(credentials ...string) {
+	s.generation.Add(1)
+
+	prefixes := make([]string, len(credentials))
+	for i := range credentials {
+		prefixes[i] = _TenantKey(credentials[i]) + ":"
+	}
+
+	keys := []string{}
+	iter := s.cache.Iterator()
+	for iter.SetNext() {
+		entry, err := iter.Value()
+		if err != nil {
+			continue
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(entry.Key(), prefix) {
+				keys = append(keys, entry.Key())
+				break
+			}
+		}
+	}
+	for i := range keys {
+		s.cache.Delete(keys[i])
+	}
+}
+
+func (s *tenantService) ListApiKeys(ctx context.Context, id uint64) ([]ApiKeyView, error) {
+	if _, err := s.getTenant(ctx, id); err != nil {
+		return nil, err
+	}
+
+	keys, err := s.tenantRepository.ListApiKeys(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]ApiKeyView, len(keys))
+	for i := range keys {
+		views[i] = *newApiKeyView(&keys[i])
+	}
+	return views, nil
+}
+
+// 创建 API key，明文的 key 只在返回结果中出现一次
+func (s *tenantService) CreateApiKey(ctx context.Context, id uint64, input ApiKeyInput) (*ApiKeyView, error) {
+	if _, err := s.getTenant(ctx, id); err != nil {
+		return nil, err
+	}
+
+	key := schema.ApiKey{
+		TenantID:  id,
+		Label:     input.Label,
+		ExpiresAt: input.ExpiresAt,
+		Scopes: &pgtype.JSONB{
+			Bytes:  []byte("{}"),
+			Status: pgtype.Present,
+		},
+	}
+	if len(input.Scopes) > 0 {
+		var scopes map[string]any
+		if err := json.Unmarshal(input.Scopes, &scopes); err != nil {
+			return nil, common.BadRequestError("Invalid scopes", err)
+		}
+		key.Scopes.Bytes = input.Scopes
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	key.Hash, key.Prefix = helpers.Hash([]byte(token)), token[:8]
+
+	if err := s.tenantRepository.CreateApiKey(ctx, &key); err != nil {
+		return nil, err
+	}
+
+	view := newApiKeyView(&key)
+	view.Key = token
+	return view, nil
+}
+
+// 撤销 API key，立即生效
+func (s *tenantService) DeleteApiKey(ctx context.Context, id uint64, keyId uint64) error {
+	keys, err := s.tenantRepository.ListApiKeys(ctx, id)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(keys, func(key schema.ApiKey) bool {
+		return key.ID == keyId
+	})
+	if i < 0 {
+		return common.NotFoundError("API key not found")
+	}
+
+	if err := s.tenantRepository.DeleteApiKey(ctx, keyId); err != nil {
+		return err
+	}
+	return s.invalidate(ctx, keys[i].Hash)
+}
+
+// 订阅其它实例的失效通知，需要在连接 redis 之后调用
+func (s *tenantService) Subscribe(ctx context.Context) error {
+	if s.redis.Client == nil {
+		return errors.New("redis is not connected")
+	}
+
+	pubsub := s.redis.Client.Subscribe(ctx, tenantInvalidateChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			s.evict(strings.Split(msg.Payload, ",")...)
+		}
+	}()
+	return nil
+}
@@ -3,13 +3,16 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/DODOEX/web3rpcproxy/internal/app/agent/repository"
+	"github.com/DODOEX/web3rpcproxy/internal/app/database/schema"
 	"github.com/DODOEX/web3rpcproxy/internal/app/shared"
 	rdbscripts "github.com/DODOEX/web3rpcproxy/internal/app/shared/redis_scripts"
 	"github.com/DODOEX/web3rpcproxy/internal/common"
@@ -18,14 +21,20 @@ import (
 	"github.com/allegro/bigcache"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
+	"gorm.io/gorm"
 )
 
 const CacheExpireInSeconds = time.Duration(7*24) * time.Hour
 
 type TenantService interface {
-	Access(ctx context.Context, token, bucket string) (*common.App, error)
+	Cost(methods []string) int64
+	// check 在扣除余额前校验 app，返回错误时不扣除余额
+	Access(ctx context.Context, token, bucket string, cost int64, check func(app *common.App) error) (*common.App, error)
+	AccessJWT(ctx context.Context, raw, bucket string, cost int64, check func(app *common.App) error) (*common.App, error)
 	Affected(app *common.App) error
 	Unaffected(app *common.App) error
+	Refund(app *common.App, cost int64) error
+	RateLimitMode() string
 }
 
 // TenantService
@@ -37,7 +46,21 @@ type tenantService struct {
 	tenantRepository repository.ITenantRepository
 	rwm              sync.Map
 	timers           sync.Map
+	touched          sync.Map
 	cache            *bigcache.BigCache
+	costs            computeUnitsConfig
+	jwt              jwtConfig
+	fallback         fallbackConfig
+	limiter          *localLimiter
+	degraded         atomic.Bool
+	// 每次清除租户缓存时递增，读取租户信息期间发生过清除时不写入缓存，避免写回旧数据
+	generation atomic.Int64
+}
+
+// 各方法消耗的计算单位，未配置的方法使用默认值
+type computeUnitsConfig struct {
+	Default int64            `koanf:"default"`
+	Methods map[string]int64 `koanf:"methods"`
 }
 
 // init TenantService
@@ -68,12 +91,26 @@ func NewTenantService(config *config.Conf, logger zerolog.Logger, redis *shared.
 		// 0 value means no size limit
 		HardMaxCacheSize: 64,
 	}
-	config.Unmarshal("tenant.bigcache", &_cacheConfig)
+	if config != nil {
+		config.Unmarshal("tenant.bigcache", &_cacheConfig)
+	}
 	cache, initErr := bigcache.NewBigCache(_cacheConfig)
 	if initErr != nil {
 		log.Fatal(initErr)
 	}
 
+	costs := computeUnitsConfig{Default: 1}
+	jwt := jwtConfig{Leeway: 30 * time.Second}
+	fallback := fallbackConfig{Replicas: 1, ProbeInterval: 5 * time.Second}
+	if config != nil {
+		config.Unmarshal("tenant.compute_units", &costs)
+		config.Unmarshal("tenant.jwt", &jwt)
+		config.Unmarshal("tenant.fallback", &fallback)
+	}
+	if fallback.ProbeInterval <= 0 {
+		fallback.ProbeInterval = 5 * time.Second
+	}
+
 	service := &tenantService{
 		config:           config,
 		logger:           logger.With().Str("name", "tenant_service").Logger(),
@@ -81,6 +118,10 @@ func NewTenantService(config *config.Conf, logger zerolog.Logger, redis *shared.
 		scripts:          scripts,
 		tenantRepository: tenantRepository,
 		cache:            cache,
+		costs:            costs,
+		jwt:              jwt,
+		fallback:         fallback,
+		limiter:          newLocalLimiter(fallback.Replicas),
 	}
 
 	return service
@@ -90,24 +131,31 @@ func _TenantKey(args ...string) string {
 	return helpers.Concat("app#", strings.Join(args, ":"))
 }
 
-func (s *tenantService) cacheTenantInfo(ctx context.Context, info *common.TenantInfo, expire time.Duration) error {
+// 缓存的租户信息，使用 API key 访问时包含 key 的信息
+type tenantEntry struct {
+	common.TenantInfo
+	Key *schema.ApiKey `json:"key,omitempty"`
+}
+
+func (s *tenantService) cacheTenantInfo(ctx context.Context, credential string, entry *tenantEntry, expire time.Duration) error {
 	defer func() {
 		if err := recover(); err != nil {
 			s.logger.Error().Interface("error", err).Msg("Failed to save tenant info to redis")
 		}
 	}()
 
-	data, err := json.Marshal(info)
+	data, err := json.Marshal(entry)
 	if err != nil {
 		return err
 	}
-	s.redis.Client.Set(ctx, _TenantKey(info.Token), data, expire)
+	s.redis.Client.Set(ctx, _TenantKey(credential), data, expire)
 	return nil
 }
 
-func (s *tenantService) getTenantInfo(ctx context.Context, token string) (*common.TenantInfo, error) {
-	logger := s.logger.Warn().Str("token", token)
-	key := _TenantKey(token)
+// 查询租户信息，优先读取 redis 中的缓存；credential 为访问凭证的 sha256，load 从数据库中读取
+func (s *tenantService) getTenantInfo(ctx context.Context, credential string, load func(entry *tenantEntry) error) (*tenantEntry, error) {
+	logger := s.logger.Warn().Str("credential", credential)
+	key := _TenantKey(credential)
 
 	l, _ := s.rwm.LoadOrStore(key, &sync.RWMutex{})
 	rwm := l.(*sync.RWMutex)
@@ -119,74 +167,244 @@ func (s *tenantService) getTenantInfo(ctx context.Context, token string) (*commo
 		logger.Err(err).Msg("Cache read error")
 	}
 
-	var info common.TenantInfo
+	var entry tenantEntry
 	if len(data) > 0 {
-		if err := json.Unmarshal(data, &info); err == nil {
-			return &info, nil
+		if err := json.Unmarshal(data, &entry); err == nil {
+			return &entry, nil
 		}
 		logger.Msgf("Cache unmarshal error: %v", err)
 	}
 
-	s.logger.Debug().Str("token", token).Msg("Get app info with cache failed, try get from db")
+	s.logger.Debug().Str("credential", credential).Msg("Get app info with cache failed, try get from db")
 
 	rwm.Lock()
 	defer rwm.Unlock()
-	if err := s.tenantRepository.GetTenantByToken(ctx, token, &info); err != nil {
+	if err := load(&entry); err != nil {
 		return nil, err
 	}
 
-	go s.cacheTenantInfo(context.Background(), &info, CacheExpireInSeconds)
+	go s.cacheTenantInfo(context.Background(), credential, &entry, CacheExpireInSeconds)
 
 	s.rwm.Delete(key)
 
-	return &info, nil
+	return &entry, nil
+}
+
+// 按 API key 或租户的 token 查询租户信息
+func (s *tenantService) loadByToken(ctx context.Context, token, credential string) func(entry *tenantEntry) error {
+	return func(entry *tenantEntry) error {
+		var apikey schema.ApiKey
+		err := s.tenantRepository.GetTenantByKey(ctx, credential, &entry.TenantInfo, &apikey)
+		if err == nil {
+			entry.Key = &apikey
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		// 兼容直接使用租户 token 访问
+		return s.tenantRepository.GetTenantByToken(ctx, token, &entry.TenantInfo)
+	}
 }
 
-func (s *tenantService) getBalanceValue(ctx context.Context, app *common.App) (int64, error) {
-	var (
-		capacity = int64(app.Capacity)
-		rate     = int64(app.Rate)
-	)
-	balance, err := s.scripts.Balance(ctx, _TenantKey(app.Token, app.Bucket), capacity, rate)
+func (s *tenantService) getBalanceValue(ctx context.Context, app *common.App, cost int64) (int64, error) {
+	c, r := app.Limits()
+	capacity, rate := int64(c), int64(r)
+	key := _TenantKey(app.Token, app.Bucket)
+	if s.degraded.Load() {
+		app.LocalLimited = true
+		return s.limiter.take(key, capacity, rate, cost), nil
+	}
+
+	balance, err := s.scripts.Balance(ctx, key, capacity, rate, cost)
 
 	if err != nil {
-		s.logger.Error().Str("token", app.Token).Str("bucket", app.Bucket).Int64("capacity", capacity).Int64("rate", rate).Msgf("Read balance error: %v", err)
+		s.logger.Error().Str("token", app.Token).Str("bucket", app.Bucket).Int64("capacity", capacity).Int64("rate", rate).Int64("cost", cost).Msgf("Read balance error: %v", err)
+		if s.fallback.Enable && isRedisUnavailable(ctx, err) {
+			s.degrade(err)
+			app.LocalLimited = true
+			return s.limiter.take(key, capacity, rate, cost), nil
+		}
 		return 0, err
 	}
 	return balance, nil
 }
 
-func (s *tenantService) Access(ctx context.Context, token, bucket string) (*common.App, error) {
-	key := _TenantKey(token, bucket)
+// 计算一次请求（批量请求中的所有调用）消耗的计算单位
+func (s *tenantService) Cost(methods []string) int64 {
+	if len(methods) <= 0 {
+		return s.costs.Default
+	}
+
+	var cost int64
+	for i := range methods {
+		if v, ok := s.costs.Methods[methods[i]]; ok {
+			cost += v
+		} else {
+			cost += s.costs.Default
+		}
+	}
+	return cost
+}
+
+func (s *tenantService) Access(ctx context.Context, token, bucket string, cost int64, check func(app *common.App) error) (*common.App, error) {
+	credential := helpers.Hash([]byte(token))
+	return s.access(ctx, credential, bucket, cost, s.loadByToken(ctx, token, credential), nil, check)
+}
+
+// load 读取租户信息，prepare 在扣除余额前调整 app，check 返回错误时不扣除余额
+func (s *tenantService) access(ctx context.Context, credential, bucket string, cost int64, load func(entry *tenantEntry) error, prepare func(app *common.App), check func(app *common.App) error) (*common.App, error) {
+	key := _TenantKey(credential, bucket)
 
 	app := &common.App{}
 	err := _GetCache(s.cache, key, app)
 	if err != nil {
-		info, err := s.getTenantInfo(ctx, token)
+		generation := s.generation.Load()
+		entry, err := s.getTenantInfo(ctx, credential, load)
 
 		if err != nil {
 			return nil, err
 		}
 
 		app = &common.App{
-			TenantInfo: *info,
+			TenantInfo: entry.TenantInfo,
+			Key:        entry.Key,
 			Bucket:     bucket,
 		}
-		_SetCache(s.cache, key, app)
+		if generation == s.generation.Load() {
+			_SetCache(s.cache, key, app)
+		}
+	}
+	app.Credential = credential
+
+	if app.Disabled {
+		return nil, common.ForbiddenError("Token is disabled")
+	}
+	if app.Key != nil && app.Key.ExpiresAt != nil && app.Key.ExpiresAt.Before(time.Now()) {
+		return nil, common.ForbiddenError("API key is expired")
+	}
+	if app.Key != nil {
+		s.touch(app.Key.ID)
+	}
+	if prepare != nil {
+		prepare(app)
+	}
+	if check != nil {
+		if err := check(app); err != nil {
+			return nil, err
+		}
 	}
 
-	balance, err := s.getBalanceValue(ctx, app)
+	balance, err := s.getBalanceValue(ctx, app, cost)
 	if err != nil {
 		return nil, err
 	}
 	app.Balance = balance
+	if balance >= 0 {
+		app.Cost = cost
+
+		quotas, err := s.useQuotas(ctx, app, cost)
+		if err != nil {
+			// 配额用尽时退还已扣除的余额
+			s.Unaffected(app)
+			app.Quotas = quotas
+			return app, err
+		}
+		app.Quotas = quotas
+	}
 
 	return app, nil
 }
 
+// 租户 preferences 中的配额配置，未配置的窗口不限制：
+//
+//	{"quotas": {"daily": {"requests": 100000}, "monthly": {"requests": 1000000, "compute_units": 5000000}}}
+func (s *tenantService) quotaWindows(app *common.App, now time.Time) []common.Quota {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	quotas := []common.Quota{}
+	for _, w := range []struct {
+		window string
+		suffix string
+		reset  time.Time
+	}{
+		{"daily", day.Format("20060102"), day.AddDate(0, 0, 1)},
+		{"monthly", month.Format("200601"), month.AddDate(0, 1, 0)},
+	} {
+		requests := app.PreferenceInt64(helpers.Concat("quotas.", w.window, ".requests"))
+		units := app.PreferenceInt64(helpers.Concat("quotas.", w.window, ".compute_units"))
+		if requests <= 0 && units <= 0 {
+			continue
+		}
+		// 按租户 ID 计数，轮换 token 不会重置配额
+		quotas = append(quotas, common.Quota{
+			Window:   w.window,
+			Key:      _TenantKey("quota", strconv.FormatUint(app.ID, 10), w.window, w.suffix),
+			Requests: requests,
+			Units:    units,
+			Reset:    w.reset.Unix(),
+		})
+	}
+	return quotas
+}
+
+// 按天、月的窗口累加配额，任一窗口超出时返回 QuotaExceededError，且不计数
+func (s *tenantService) useQuotas(ctx context.Context, app *common.App, cost int64) ([]common.Quota, error) {
+	quotas := s.quotaWindows(app, time.Now())
+	// 本地限流时不统计配额
+	if len(quotas) <= 0 || app.LocalLimited {
+		return nil, nil
+	}
+
+	keys, limits := make([]string, len(quotas)), make([]int64, 0, len(quotas)*3)
+	for i := range quotas {
+		keys[i] = quotas[i].Key
+		// 窗口结束后多保留一天，便于查询
+		limits = append(limits, quotas[i].Requests, quotas[i].Units, quotas[i].Reset+24*60*60)
+	}
+
+	result, err := s.scripts.Quota(ctx, keys, limits, cost)
+	if err != nil || len(result) != 1+len(quotas)*2 {
+		// 配额只是计费用途，读取失败时不影响请求
+		s.logger.Error().Str("token", app.Token).Msgf("Read quota error: %v", err)
+		return nil, nil
+	}
+
+	for i := range quotas {
+		quotas[i].UsedRequests, quotas[i].UsedUnits = result[1+i*2], result[2+i*2]
+	}
+	if exceeded := result[0]; exceeded > 0 {
+		return quotas, common.QuotaExceededError(helpers.Concat(quotas[exceeded-1].Window, " quota exceeded"))
+	}
+	return quotas, nil
+}
+
+// 退还请求失败时计入的配额
+func (s *tenantService) refundQuotas(quotas []common.Quota, requests, cost int64) {
+	defer func() {
+		if err := recover(); err != nil {
+			s.logger.Error().Interface("error", err).Msg("Failed to refund quotas")
+		}
+	}()
+
+	pipeline := s.redis.Client.Pipeline()
+	for i := range quotas {
+		pipeline.HIncrBy(context.Background(), quotas[i].Key, rdbscripts.CacheFieldQuotaRequests, -requests)
+		pipeline.HIncrBy(context.Background(), quotas[i].Key, rdbscripts.CacheFieldQuotaUnits, -cost)
+	}
+	if _, err := pipeline.Exec(context.Background()); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to refund quotas")
+	}
+}
+
 // 记录最后一次正确访问的时间，用于计算恢复量；异步调用时，只能保证最终准确性
 func (s *tenantService) Affected(app *common.App) error {
 	app.LastTime = time.Now().UnixMilli()
+	if app.LocalLimited {
+		return nil
+	}
 
 	if _, ok := s.timers.Load(_TenantKey(app.Token, app.Bucket)); !ok {
 		go s.debounce(app)
@@ -195,9 +413,33 @@ func (s *tenantService) Affected(app *common.App) error {
 	return nil
 }
 
-// 记录异常访问的次数，用于补偿到balance；异步调用时，只能保证最终准确性
+// 记录异常访问消耗的计算单位，用于补偿到balance；异步调用时，只能保证最终准确性
 func (s *tenantService) Unaffected(app *common.App) error {
-	atomic.AddInt64(&app.Offset, 1)
+	return s.Refund(app, app.Cost)
+}
+
+// 退还本次请求中的部分计算单位，如批量调用中在本地处理的调用
+func (s *tenantService) Refund(app *common.App, cost int64) error {
+	cost = min(cost, app.Cost)
+	if cost <= 0 {
+		return nil
+	}
+
+	if app.LocalLimited {
+		s.limiter.refund(_TenantKey(app.Token, app.Bucket), cost)
+		return nil
+	}
+
+	atomic.AddInt64(&app.Offset, cost)
+
+	if len(app.Quotas) > 0 {
+		// 只退还部分计算单位时，请求仍计入配额
+		requests := int64(0)
+		if cost >= app.Cost {
+			requests = 1
+		}
+		go s.refundQuotas(app.Quotas, requests, cost)
+	}
 
 	if _, ok := s.timers.Load(_TenantKey(app.Token, app.Bucket)); !ok {
 		go s.debounce(app)
@@ -237,17 +479,28 @@ func (s *tenantService) debounce(app *common.App) error {
 		return err
 	}
 
+	// 不写回本地缓存，请求中的 app 可能在租户信息更新、缓存被清除之前读取
 	if offset > 0 {
 		atomic.AddInt64(&app.Offset, -offset)
 		app.LastTime = 0
 	}
 
-	if v, err := json.Marshal(app); err == nil {
-		err = s.cache.Set(key, v)
-		if err != nil {
-			s.logger.Error().Err(err).Msg("Cache update error")
-		}
+	return nil
+}
+
+// 记录 API key 最后使用的时间，每个 key 每分钟最多写一次数据库
+func (s *tenantService) touch(id uint64) {
+	now := time.Now()
+	if v, ok := s.touched.Load(id); ok && now.Sub(v.(time.Time)) < time.Minute {
+		return
 	}
+	s.touched.Store(id, now)
 
-	return nil
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.tenantRepository.TouchApiKey(ctx, id, now); err != nil {
+			s.logger.Error().Err(err).Msgf("Failed to update last used time of api key %d", id)
+		}
+	}()
 }
@@ -3,7 +3,9 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"net/http"
 	"testing"
 	"time"
 
@@ -15,10 +17,13 @@ import (
 	"github.com/DODOEX/web3rpcproxy/utils/general/types"
 	"github.com/DODOEX/web3rpcproxy/utils/helpers"
 	"github.com/go-redis/redismock/v9"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/pgtype"
 	"github.com/knadh/koanf/providers/confmap"
 	"github.com/knadh/koanf/v2"
 	"github.com/rs/zerolog"
 	gomock "go.uber.org/mock/gomock"
+	"gorm.io/gorm"
 )
 
 type rdbclient struct{}
@@ -112,22 +117,20 @@ func TestAccessHasCache(t *testing.T) {
 	token := "abc"
 	_tenant := createTenant(token)
 
-	rscriptsmock, rdbmock, repo, tenantService := createTenantService(ctrl1, ctrl2)
+	rscriptsmock, rdbmock, _, tenantService := createTenantService(ctrl1, ctrl2)
 
 	ctx := context.Background()
 
-	repo.EXPECT().GetTenantByToken(ctx, token, tenant{
-		v: &_tenant,
-	}).Return(nil)
+	// 缓存命中时不查询数据库
+	rscriptsmock.EXPECT().Balance(ctx, "app#abc:default", int64(100), int64(1), int64(1)).Return(int64(1), nil)
 
-	rscriptsmock.EXPECT().Balance(ctx, "app#:default", 100, 1).Return(int64(1), nil)
+	v, _ := json.Marshal(tenantEntry{TenantInfo: _tenant})
+	rdbmock.ExpectGet(_TenantKey(helpers.Hash([]byte(token)))).SetVal(string(v))
 
-	v, _ := json.Marshal(_tenant)
-	key := helpers.Concat("app#%s", _tenant.Token)
-	rdbmock.ExpectGet(key).SetVal(string(v))
-	rdbmock.ExpectGet(key + ":default:last").SetVal("10000")
-
-	app, _ := tenantService.Access(ctx, token, "default")
+	app, err := tenantService.Access(ctx, token, "default", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if app.TenantInfo.ID != _tenant.ID {
 		t.Errorf("expected %d, got %d", _tenant.ID, app.TenantInfo.ID)
@@ -149,6 +152,10 @@ func TestAccessHasCache(t *testing.T) {
 		t.Errorf("expected %f, got %f", _tenant.Capacity, app.TenantInfo.Capacity)
 	}
 
+	if app.Key != nil {
+		t.Errorf("expected no api key, got %v", app.Key)
+	}
+
 	if app.Balance != 1 {
 		t.Errorf("expected %d, got %d", 1, app.Balance)
 	}
@@ -161,12 +168,13 @@ func TestAccessHasCache(t *testing.T) {
 		t.Errorf("expected %d, got %d", 0, app.Offset)
 	}
 }
+
 func TestAccessHasNoCache(t *testing.T) {
 	ctrl1 := gomock.NewController(t)
 	defer ctrl1.Finish()
 
 	scripts := shared.NewMockScripts(ctrl1)
-	scripts.EXPECT().Balance(context.Background(), "app#abc:default", float64(100), float64(1)).Return(int64(1), nil)
+	scripts.EXPECT().Balance(context.Background(), "app#abc:default", int64(100), int64(1), int64(1)).Return(int64(1), nil)
 
 	token := "abc"
 
@@ -180,20 +188,24 @@ func TestAccessHasNoCache(t *testing.T) {
 		},
 	}
 
-	key := helpers.Concat("app#%s", token)
+	credential := helpers.Hash([]byte(token))
+	key := _TenantKey(credential)
 
 	rdb, mock := redismock.NewClientMock()
 	rclient := &shared.RedisClient{
 		Client: rdb,
 	}
 	mock.ExpectGet(key).RedisNil()
-	mock.Regexp().ExpectSet(key, `.*`, 7*24*time.Hour).SetVal("OK")
-	mock.ExpectGet(key + ":default:last").SetVal("10000")
+	mock.Regexp().ExpectSet(key, `.*`, CacheExpireInSeconds).SetVal("OK")
 
 	ctrl2 := gomock.NewController(t)
 	defer ctrl2.Finish()
 	repo := repository.NewMockITenantRepository(ctrl2)
-	repo.EXPECT().GetTenantByToken(context.Background(), gomock.Eq(token), gomock.Any()).Return(nil).SetArg(1, info)
+	// 不是 API key 时，回退到租户 token 查询
+	gomock.InOrder(
+		repo.EXPECT().GetTenantByKey(context.Background(), credential, gomock.Any(), gomock.Any()).Return(gorm.ErrRecordNotFound),
+		repo.EXPECT().GetTenantByToken(context.Background(), token, gomock.Any()).SetArg(2, info).Return(nil),
+	)
 
 	tenantService := NewTenantService(
 		nil,
@@ -203,7 +215,10 @@ func TestAccessHasNoCache(t *testing.T) {
 		repo,
 	)
 
-	app, _ := tenantService.Access(context.Background(), token, "default")
+	app, err := tenantService.Access(context.Background(), token, "default", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if app.TenantInfo.ID != info.ID {
 		t.Errorf("expected %d, got %d", info.ID, app.TenantInfo.ID)
@@ -225,6 +240,10 @@ func TestAccessHasNoCache(t *testing.T) {
 		t.Errorf("expected %f, got %f", info.Capacity, app.TenantInfo.Capacity)
 	}
 
+	if app.Key != nil {
+		t.Errorf("expected no api key, got %v", app.Key)
+	}
+
 	if app.Balance != 1 {
 		t.Errorf("expected %d, got %d", 1, app.Balance)
 	}
@@ -238,6 +257,32 @@ func TestAccessHasNoCache(t *testing.T) {
 	}
 }
 
+func TestAccessCheckBeforeCharge(t *testing.T) {
+	ctrl1 := gomock.NewController(t)
+	defer ctrl1.Finish()
+
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+
+	token := "abc"
+	_, rdbmock, _, tenantService := createTenantService(ctrl1, ctrl2)
+
+	v, _ := json.Marshal(tenantEntry{TenantInfo: createTenant(token)})
+	rdbmock.ExpectGet(_TenantKey(helpers.Hash([]byte(token)))).SetVal(string(v))
+
+	// 校验失败时不调用 Balance 扣除余额
+	restricted := common.ForbiddenError("Origin is not allowed")
+	app, err := tenantService.Access(context.Background(), token, "default", 1, func(app *common.App) error {
+		if app.Token != token {
+			t.Errorf("expected %s, got %s", token, app.Token)
+		}
+		return restricted
+	})
+	if app != nil || err != restricted {
+		t.Errorf("expected %v, got %v %v", restricted, app, err)
+	}
+}
+
 func TestAffected(t *testing.T) {
 	ctrl1 := gomock.NewController(t)
 	defer ctrl1.Finish()
@@ -308,6 +353,7 @@ func TestUnaffected(t *testing.T) {
 		},
 		Bucket:  "defatult",
 		Balance: 1,
+		Cost:    1,
 	}
 
 	key := helpers.Concat("app#", _app.Token, ":", _app.Bucket)
@@ -341,6 +387,321 @@ func TestUnaffected(t *testing.T) {
 	}
 }
 
+func TestRefund(t *testing.T) {
+	_app := common.App{
+		TenantInfo: schema.Tenant{
+			Name:     "test",
+			Token:    "abc",
+			Rate:     1,
+			Capacity: 100,
+		},
+		Bucket:  "defatult",
+		Balance: 1,
+		Cost:    5,
+	}
+
+	rdb, _ := redismock.NewClientMock()
+	tenantService := NewTenantService(nil, zerolog.Nop(), &shared.RedisClient{Client: rdb}, nil, nil)
+
+	// 只退还部分计算单位，且不超过本次扣除的计算单位
+	if err := tenantService.Refund(&_app, 2); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if _app.Offset != 2 {
+		t.Errorf("expected %d, got %d", 2, _app.Offset)
+	}
+	tenantService.Refund(&_app, 10)
+	if _app.Offset != 7 {
+		t.Errorf("expected %d, got %d", 7, _app.Offset)
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	ctrl1 := gomock.NewController(t)
+	defer ctrl1.Finish()
+
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+
+	scripts, _, _, service := createTenantService(ctrl1, ctrl2)
+
+	_app := common.App{
+		TenantInfo: createTenant("abc"),
+		Bucket:     "default",
+	}
+	_app.Preferences = &pgtype.JSONB{
+		Bytes:  []byte(`{"quotas": {"daily": {"requests": 10}, "monthly": {"compute_units": 1000}}}`),
+		Status: pgtype.Present,
+	}
+
+	scripts.EXPECT().Quota(gomock.Any(), gomock.Len(2), gomock.Len(6), int64(5)).Return([]int64{1, 10, 50, 20, 900}, nil)
+
+	quotas, err := service.(*tenantService).useQuotas(context.Background(), &_app, 5)
+
+	if err == nil || err.(common.HTTPErrors).Message() != "daily quota exceeded" {
+		t.Errorf("expected daily quota exceeded, got %v", err)
+	}
+
+	if len(quotas) != 2 {
+		t.Fatalf("expected %d, got %d", 2, len(quotas))
+	}
+
+	if quotas[0].UsedRequests != 10 || quotas[1].UsedUnits != 900 {
+		t.Errorf("expected %d/%d, got %d/%d", 10, 900, quotas[0].UsedRequests, quotas[1].UsedUnits)
+	}
+}
+
+func TestQuotaKeysSurviveTokenRotation(t *testing.T) {
+	service := NewTenantService(nil, zerolog.Nop(), nil, nil, nil).(*tenantService)
+
+	_app := common.App{TenantInfo: createTenant("abc")}
+	_app.ID = 7
+	_app.Preferences = &pgtype.JSONB{
+		Bytes:  []byte(`{"quotas": {"daily": {"requests": 10}}}`),
+		Status: pgtype.Present,
+	}
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	before := service.quotaWindows(&_app, now)
+
+	// 轮换 token 后仍使用同一个配额计数
+	_app.Token = "def"
+	after := service.quotaWindows(&_app, now)
+	if len(before) != 1 || len(after) != 1 || before[0].Key != after[0].Key {
+		t.Fatalf("expected same quota keys, got %v and %v", before, after)
+	}
+	if before[0].Key != "app#quota:7:daily:20240506" {
+		t.Errorf("expected %s, got %s", "app#quota:7:daily:20240506", before[0].Key)
+	}
+}
+
+func TestAccessSkipsCacheAfterEvict(t *testing.T) {
+	ctrl1 := gomock.NewController(t)
+	defer ctrl1.Finish()
+
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+
+	scripts, _, _, service := createTenantService(ctrl1, ctrl2)
+	s := service.(*tenantService)
+	scripts.EXPECT().Balance(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(int64(10), nil).AnyTimes()
+
+	credential := helpers.Hash([]byte("abc"))
+	key := _TenantKey(credential, "default")
+
+	// 读取租户信息期间租户被更新，读到的旧数据不写入缓存
+	_, err := s.access(context.Background(), credential, "default", 1, func(entry *tenantEntry) error {
+		entry.TenantInfo = createTenant("abc")
+		s.evict(credential)
+		return nil
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, err := s.cache.Get(key); err == nil {
+		t.Errorf("expected tenant not cached after evict")
+	}
+
+	_, err = s.access(context.Background(), credential, "default", 1, func(entry *tenantEntry) error {
+		entry.TenantInfo = createTenant("abc")
+		return nil
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, err := s.cache.Get(key); err != nil {
+		t.Errorf("expected tenant cached, got %v", err)
+	}
+}
+
+func TestAccessExpiredApiKey(t *testing.T) {
+	ctrl1 := gomock.NewController(t)
+	defer ctrl1.Finish()
+
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+
+	_, rdbmock, _, tenantService := createTenantService(ctrl1, ctrl2)
+
+	token := "abc"
+	expiresAt := time.Now().Add(-time.Hour)
+	entry := tenantEntry{
+		TenantInfo: createTenant("tenant"),
+		Key: &schema.ApiKey{
+			TenantID:  0,
+			Hash:      helpers.Hash([]byte(token)),
+			ExpiresAt: &expiresAt,
+		},
+	}
+	v, _ := json.Marshal(entry)
+	rdbmock.ExpectGet(_TenantKey(helpers.Hash([]byte(token)))).SetVal(string(v))
+
+	app, err := tenantService.Access(context.Background(), token, "default", 1, nil)
+
+	if app != nil {
+		t.Errorf("expected nil, got %v", app)
+	}
+
+	if err == nil || err.(common.HTTPErrors).Message() != "API key is expired" {
+		t.Errorf("expected API key is expired, got %v", err)
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	ctrl1 := gomock.NewController(t)
+	defer ctrl1.Finish()
+
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+
+	_, rdbmock, _, service := createTenantService(ctrl1, ctrl2)
+
+	entry := tenantEntry{TenantInfo: createTenant("abc")}
+	entry.ID = types.Uint64(1)
+	entry.Preferences = &pgtype.JSONB{
+		Bytes:  []byte(`{"jwt": {"secret": "secret"}}`),
+		Status: pgtype.Present,
+	}
+	v, _ := json.Marshal(entry)
+	rdbmock.ExpectGet(_TenantKey(_TenantCredential(1))).SetVal(string(v))
+
+	sign := func(claims jwt.MapClaims) string {
+		claims["tenant"] = 1
+		claims["chains"] = []string{"1"}
+		raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		return raw
+	}
+
+	claims, _, err := service.(*tenantService).verifyJWT(context.Background(), sign(jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(claims.Chains) != 1 || claims.Chains[0] != "1" {
+		t.Errorf("expected chains [1], got %v", claims.Chains)
+	}
+
+	// 允许的时钟偏差内仍然有效
+	rdbmock.ExpectGet(_TenantKey(_TenantCredential(1))).SetVal(string(v))
+	if _, _, err = service.(*tenantService).verifyJWT(context.Background(), sign(jwt.MapClaims{"exp": time.Now().Add(-10 * time.Second).Unix()})); err != nil {
+		t.Errorf("expected nil within leeway, got %v", err)
+	}
+
+	for _, test := range []struct {
+		claims   jwt.MapClaims
+		audience string
+		err      error
+	}{
+		{jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, "", jwt.ErrTokenExpired},
+		{jwt.MapClaims{}, "", jwt.ErrTokenRequiredClaimMissing},
+		{jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix(), "aud": "other"}, "proxy", jwt.ErrTokenInvalidAudience},
+		{jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix(), "aud": []string{"other", "proxy"}}, "proxy", nil},
+	} {
+		service.(*tenantService).jwt.Audience = test.audience
+		rdbmock.ExpectGet(_TenantKey(_TenantCredential(1))).SetVal(string(v))
+		_, _, err = service.(*tenantService).verifyJWT(context.Background(), sign(test.claims))
+		if (test.err == nil && err != nil) || (test.err != nil && !errors.Is(err, test.err)) {
+			t.Errorf("%v: expected %v, got %v", test.claims, test.err, err)
+		}
+	}
+}
+
+func TestAccessJWTBucket(t *testing.T) {
+	ctrl1 := gomock.NewController(t)
+	defer ctrl1.Finish()
+
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+
+	scripts, rdbmock, _, service := createTenantService(ctrl1, ctrl2)
+
+	entry := tenantEntry{TenantInfo: createTenant("abc")}
+	entry.ID = types.Uint64(1)
+	entry.Preferences = &pgtype.JSONB{
+		Bytes:  []byte(`{"jwt": {"secret": "secret"}}`),
+		Status: pgtype.Present,
+	}
+	v, _ := json.Marshal(entry)
+
+	sign := func(claims jwt.MapClaims) string {
+		claims["tenant"], claims["exp"] = 1, time.Now().Add(time.Hour).Unix()
+		raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		return raw
+	}
+
+	// 调低限流的 JWT 使用自己的令牌桶
+	rdbmock.ExpectGet(_TenantKey(_TenantCredential(1))).SetVal(string(v))
+	rdbmock.ExpectGet(_TenantKey(_TenantCredential(1))).SetVal(string(v))
+	scripts.EXPECT().Balance(gomock.Any(), _TenantKey("abc", "jwt:user"), int64(100), int64(1), int64(1)).Return(int64(10), nil)
+	app, err := service.AccessJWT(context.Background(), sign(jwt.MapClaims{"sub": "user", "rate": 1}), "default", 1, nil)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app.Bucket != "jwt:user" {
+		t.Errorf("expected %s, got %s", "jwt:user", app.Bucket)
+	}
+
+	// 没有 bucket 与 sub 时不能调整限流
+	rdbmock.ExpectGet(_TenantKey(_TenantCredential(1))).SetVal(string(v))
+	_, err = service.AccessJWT(context.Background(), sign(jwt.MapClaims{"capacity": 10}), "default", 1, nil)
+	if err == nil || err.(common.HTTPErrors).StatusCode() != http.StatusForbidden {
+		t.Errorf("expected forbidden, got %v", err)
+	}
+}
+
+func TestBalanceFallback(t *testing.T) {
+	ctrl1 := gomock.NewController(t)
+	defer ctrl1.Finish()
+
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+
+	scripts, _, _, service := createTenantService(ctrl1, ctrl2)
+	s := service.(*tenantService)
+	s.fallback = fallbackConfig{Enable: true, Replicas: 2, ProbeInterval: time.Hour}
+	s.limiter = newLocalLimiter(s.fallback.Replicas)
+
+	scripts.EXPECT().Balance(gomock.Any(), "app#abc:default", int64(100), int64(1), int64(30)).Return(int64(0), errors.New("dial tcp: connection refused"))
+
+	app := common.App{TenantInfo: createTenant("abc"), Bucket: "default"}
+	balance, err := s.getBalanceValue(context.Background(), &app, 30)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if s.RateLimitMode() != RATE_LIMIT_MODE_LOCAL || !app.LocalLimited {
+		t.Errorf("expected local rate limit, got %s", s.RateLimitMode())
+	}
+	// 容量按实例数平分
+	if balance != 20 {
+		t.Errorf("expected 20, got %d", balance)
+	}
+
+	balance, _ = s.getBalanceValue(context.Background(), &app, 30)
+	if balance >= 0 {
+		t.Errorf("expected overage, got %d", balance)
+	}
+}
+
+func TestAnonymousAccess(t *testing.T) {
+	conf := newConfig(map[string]any{
+		"anonymous.enable":            true,
+		"anonymous.store":             "local",
+		"anonymous.capacity":          10,
+		"anonymous.rate":              1,
+		"anonymous.chains.1.capacity": 2,
+		"anonymous.chains.1.rate":     1,
+	})
+	service := NewAnonymousService(conf, zerolog.Nop(), nil, nil)
+
+	access, err := service.Access(context.Background(), "1.2.3.4", 56, 5)
+	if err != nil || access == nil || access.Balance != 5 {
+		t.Errorf("expected balance 5, got %v %v", access, err)
+	}
+
+	access, _ = service.Access(context.Background(), "1.2.3.4", 1, 5)
+	if access == nil || access.Capacity != 2 || access.Balance >= 0 {
+		t.Errorf("expected overage on chain 1, got %v", access)
+	}
+}
+
 // func TestBatchCall(t *testing.T) {
 // }
 
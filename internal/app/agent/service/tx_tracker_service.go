@@ -0,0 +1,476 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/app/shared"
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// 交易的状态
+const (
+	TX_STATUS_PENDING   = "pending"
+	TX_STATUS_INCLUDED  = "included"
+	TX_STATUS_REORGED   = "reorged"
+	TX_STATUS_CONFIRMED = "confirmed"
+	TX_STATUS_DROPPED   = "dropped"
+)
+
+// 等待轮询的交易，score 为下次轮询的时间（毫秒）
+const _TxTrackerQueue = "tx#queue"
+
+func _TxTrackerKey(member string) string {
+	return helpers.Concat("tx#", member)
+}
+
+// 跟踪 eth_sendRawTransaction 发出的交易，状态变化时回调租户的 webhook
+type TxTrackerService interface {
+	// 开始跟踪交易，租户未配置 webhook 时忽略
+	Track(ctx context.Context, rc reqctx.Reqctxs, hash string) error
+}
+
+type txTrackerConfig struct {
+	Enable bool `koanf:"enable"`
+	// 轮询交易状态的间隔
+	PollInterval time.Duration `koanf:"poll-interval"`
+	// 每次轮询最多处理的交易数
+	Batch int64 `koanf:"batch"`
+	// 每次轮询查询的节点数
+	Endpoints int `koanf:"endpoints"`
+	// 默认的确认数，租户可以通过 tx_tracking.confirmations 覆盖
+	Confirmations uint64 `koanf:"confirmations"`
+	// 节点上查不到交易超过该时间视为被丢弃
+	DropAfter time.Duration `koanf:"drop-after"`
+	// 交易最长的跟踪时间
+	MaxAge time.Duration `koanf:"max-age"`
+	// webhook 的超时时间与重试次数
+	WebhookTimeout time.Duration `koanf:"webhook-timeout"`
+	WebhookRetries int           `koanf:"webhook-retries"`
+}
+
+// 保存在 Redis 中的跟踪状态，任一实例都可以继续处理
+type trackedTx struct {
+	Hash          string `json:"hash"`
+	ChainID       uint64 `json:"chainId"`
+	Status        string `json:"status"`
+	BlockNumber   uint64 `json:"blockNumber,omitempty"`
+	BlockHash     string `json:"blockHash,omitempty"`
+	Confirmations uint64 `json:"confirmations"`
+	Tenant        string `json:"tenant"`
+	Webhook       string `json:"webhook"`
+	Secret        string `json:"secret,omitempty"`
+	// 开始跟踪与最后一次在节点上看到交易的时间，unix 毫秒
+	Created int64 `json:"created"`
+	Seen    int64 `json:"seen"`
+}
+
+// webhook 回调的内容
+type txStatusEvent struct {
+	Hash          string `json:"hash"`
+	ChainID       uint64 `json:"chainId"`
+	Status        string `json:"status"`
+	Previous      string `json:"previous,omitempty"`
+	BlockNumber   uint64 `json:"blockNumber,omitempty"`
+	BlockHash     string `json:"blockHash,omitempty"`
+	Confirmations uint64 `json:"confirmations"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+type txTrackerService struct {
+	logger          zerolog.Logger
+	config          txTrackerConfig
+	redis           *shared.RedisClient
+	scripts         shared.Scripts
+	endpointService EndpointService
+	clients         *endpoint.ClientFactory
+	http            *http.Client
+}
+
+// 租户 preferences 中的配置：
+//
+//	{"tx_tracking": {"webhook": "https://example.com/tx", "secret": "...", "confirmations": 12}}
+//
+// webhook 请求头 X-Webhook-Signature 为 hex(hmac_sha256(secret, timestamp + "." + body))，timestamp 见 X-Webhook-Timestamp
+func NewTxTrackerService(
+	logger zerolog.Logger,
+	config *config.Conf,
+	redis *shared.RedisClient,
+	scripts shared.Scripts,
+	endpointService EndpointService,
+	clients *endpoint.ClientFactory,
+) TxTrackerService {
+	c := txTrackerConfig{
+		PollInterval:   5 * time.Second,
+		Batch:          100,
+		Endpoints:      3,
+		Confirmations:  12,
+		DropAfter:      30 * time.Minute,
+		MaxAge:         2 * time.Hour,
+		WebhookTimeout: 10 * time.Second,
+		WebhookRetries: 3,
+	}
+	config.Unmarshal("agent.tx-tracker", &c)
+
+	service := &txTrackerService{
+		logger:          logger.With().Str("name", "tx_tracker_service").Logger(),
+		config:          c,
+		redis:           redis,
+		scripts:         scripts,
+		endpointService: endpointService,
+		clients:         clients,
+		http:            &http.Client{Timeout: c.WebhookTimeout},
+	}
+
+	if c.Enable {
+		go service.run()
+	}
+
+	return service
+}
+
+func (s *txTrackerService) Track(ctx context.Context, rc reqctx.Reqctxs, hash string) error {
+	app := rc.App()
+	if !s.config.Enable || app == nil || s.redis.Client == nil {
+		return nil
+	}
+	webhook, _ := app.Preference("tx_tracking.webhook").(string)
+	if webhook == "" {
+		return nil
+	}
+	secret, _ := app.Preference("tx_tracking.secret").(string)
+
+	now := time.Now().UnixMilli()
+	tx := &trackedTx{
+		Hash:          strings.ToLower(hash),
+		ChainID:       rc.ChainID(),
+		Confirmations: s.config.Confirmations,
+		Tenant:        app.Name,
+		Webhook:       webhook,
+		Secret:        secret,
+		Created:       now,
+		Seen:          now,
+	}
+	if v := app.PreferenceInt64("tx_tracking.confirmations"); v > 0 {
+		tx.Confirmations = uint64(v)
+	}
+
+	member := fmt.Sprintf("%d:%s", tx.ChainID, tx.Hash)
+	// 已经在跟踪的交易（如重复发送）不需要重新开始
+	if ok, err := s.redis.Client.SetNX(ctx, _TxTrackerKey(member), s.encode(tx), s.config.MaxAge).Result(); err != nil || !ok {
+		return err
+	}
+	return s.redis.Client.ZAdd(ctx, _TxTrackerQueue, redis.Z{Score: float64(now), Member: member}).Err()
+}
+
+func (s *txTrackerService) encode(tx *trackedTx) []byte {
+	b, _ := json.Marshal(tx)
+	return b
+}
+
+func (s *txTrackerService) run() {
+	ticker := time.NewTicker(s.config.PollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Redis 在启动时才连接
+		if s.redis.Client == nil {
+			continue
+		}
+		s.poll()
+	}
+}
+
+func (s *txTrackerService) poll() {
+	defer func() {
+		if err := recover(); err != nil {
+			s.logger.Error().Interface("error", err).Msg("Panic to poll() goroutine")
+		}
+	}()
+
+	// 租期内处理完所有交易，包括 webhook 的重试
+	lease := s.config.PollInterval + time.Duration(s.config.WebhookRetries+1)*s.config.WebhookTimeout*2
+	members, err := s.scripts.Claim(context.Background(), _TxTrackerQueue, lease, s.config.Batch)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to claim tracked transactions")
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := range members {
+		wg.Add(1)
+		go func(member string) {
+			defer func() {
+				if err := recover(); err != nil {
+					s.logger.Error().Interface("error", err).Msgf("Failed to track %s", member)
+				}
+				wg.Done()
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), lease)
+			defer cancel()
+			s.process(ctx, member)
+		}(members[i])
+	}
+	wg.Wait()
+}
+
+func (s *txTrackerService) process(ctx context.Context, member string) {
+	b, err := s.redis.Client.Get(ctx, _TxTrackerKey(member)).Bytes()
+	if err == redis.Nil {
+		// 跟踪状态已过期
+		s.redis.Client.ZRem(ctx, _TxTrackerQueue, member)
+		return
+	}
+	if err != nil {
+		s.logger.Warn().Err(err).Msgf("Failed to load tracked transaction %s", member)
+		return
+	}
+	tx := &trackedTx{}
+	if err := json.Unmarshal(b, tx); err != nil {
+		s.logger.Warn().Err(err).Msgf("Invalid tracked transaction %s", member)
+		s.stop(ctx, member)
+		return
+	}
+
+	done := s.update(ctx, tx)
+	if done {
+		s.stop(ctx, member)
+		return
+	}
+
+	ttl := time.Until(time.UnixMilli(tx.Created).Add(s.config.MaxAge))
+	if ttl <= 0 {
+		s.logger.Info().Msgf("Stop tracking %s after %s, last status %s", member, s.config.MaxAge, tx.Status)
+		s.stop(ctx, member)
+		return
+	}
+	s.redis.Client.Set(ctx, _TxTrackerKey(member), s.encode(tx), ttl)
+	s.redis.Client.ZAdd(ctx, _TxTrackerQueue, redis.Z{Score: float64(time.Now().Add(s.config.PollInterval).UnixMilli()), Member: member})
+}
+
+func (s *txTrackerService) stop(ctx context.Context, member string) {
+	s.redis.Client.Del(ctx, _TxTrackerKey(member))
+	s.redis.Client.ZRem(ctx, _TxTrackerQueue, member)
+}
+
+// 查询交易的最新状态并回调状态变化，返回是否结束跟踪
+func (s *txTrackerService) update(ctx context.Context, tx *trackedTx) (done bool) {
+	endpoints := s.endpoints(tx.ChainID)
+	if len(endpoints) <= 0 {
+		return false
+	}
+
+	receipt, head, err := s.receipt(ctx, endpoints, tx.Hash)
+	if err != nil {
+		s.logger.Debug().Err(err).Msgf("Failed to query receipt of %s", tx.Hash)
+		return false
+	}
+
+	now := time.Now()
+	if receipt == nil {
+		if tx.Status == TX_STATUS_INCLUDED {
+			// 收据消失，交易所在的区块被回滚
+			s.transit(ctx, tx, TX_STATUS_REORGED)
+			tx.BlockNumber, tx.BlockHash = 0, ""
+		}
+		if s.seen(ctx, endpoints, tx.Hash) {
+			tx.Seen = now.UnixMilli()
+		} else if now.Sub(time.UnixMilli(tx.Seen)) > s.config.DropAfter {
+			s.transit(ctx, tx, TX_STATUS_DROPPED)
+			return true
+		}
+		if tx.Status == "" {
+			s.transit(ctx, tx, TX_STATUS_PENDING)
+		}
+		return false
+	}
+
+	tx.Seen = now.UnixMilli()
+	blockNumber, _ := helpers.ParseHexUint64(fmt.Sprint(receipt["blockNumber"]))
+	blockHash := strings.ToLower(fmt.Sprint(receipt["blockHash"]))
+	if tx.Status == TX_STATUS_INCLUDED && tx.BlockHash != blockHash {
+		// 交易被打包进了另一个区块
+		s.transit(ctx, tx, TX_STATUS_REORGED)
+	}
+	if tx.Status != TX_STATUS_INCLUDED {
+		tx.BlockNumber, tx.BlockHash = blockNumber, blockHash
+		s.transit(ctx, tx, TX_STATUS_INCLUDED)
+	}
+
+	if head >= blockNumber && head-blockNumber+1 >= tx.Confirmations {
+		s.transit(ctx, tx, TX_STATUS_CONFIRMED)
+		return true
+	}
+	return false
+}
+
+// 健康的节点中随机选择几个
+func (s *txTrackerService) endpoints(chainId uint64) []*endpoint.Endpoint {
+	all, ok := s.endpointService.GetAll(chainId)
+	if !ok {
+		return nil
+	}
+	endpoints := make([]*endpoint.Endpoint, 0, len(all))
+	for i := range all {
+		if all[i].Health() {
+			endpoints = append(endpoints, all[i])
+		}
+	}
+	rand.Shuffle(len(endpoints), func(i, j int) {
+		endpoints[i], endpoints[j] = endpoints[j], endpoints[i]
+	})
+	return endpoints[:min(len(endpoints), max(s.config.Endpoints, 1))]
+}
+
+func (s *txTrackerService) call(ctx context.Context, e *endpoint.Endpoint, requests ...rpc.SealedJSONRPC) ([]rpc.JSONRPCResulter, error) {
+	client := s.clients.GetClient(e)
+	if client == nil {
+		return nil, common.InternalServerError("No client of endpoint")
+	}
+	results, err := client.Call(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(requests) {
+		return nil, common.UpstreamServerError("Unexpected results of endpoint")
+	}
+	// 批量请求的结果不保证顺序
+	ordered := make([]rpc.JSONRPCResulter, len(requests))
+	for i := range results {
+		for j := range requests {
+			if results[i].ID() == requests[j].ID {
+				ordered[j] = results[i]
+			}
+		}
+	}
+	for i := range ordered {
+		if ordered[i] == nil {
+			return nil, common.UpstreamServerError("Unexpected results of endpoint")
+		}
+	}
+	return ordered, nil
+}
+
+// 在多个节点上查询交易收据，任一节点返回收据即视为已打包；所有节点都失败时返回错误
+func (s *txTrackerService) receipt(ctx context.Context, endpoints []*endpoint.Endpoint, hash string) (receipt map[string]any, head uint64, err error) {
+	succeeded := false
+	for _, e := range endpoints {
+		results, _err := s.call(ctx, e,
+			rpc.SealedJSONRPC{Version: "2.0", ID: "1", Method: "eth_getTransactionReceipt", Params: []any{hash}},
+			rpc.SealedJSONRPC{Version: "2.0", ID: "2", Method: "eth_blockNumber", Params: []any{}},
+		)
+		if _err != nil {
+			err = _err
+			continue
+		}
+		if results[0].Error() != nil || results[1].Error() != nil {
+			err = fmt.Errorf("%v %v", results[0].Error(), results[1].Error())
+			continue
+		}
+		succeeded = true
+
+		v, _ := helpers.ParseHexUint64(fmt.Sprint(results[1].Result()))
+		head = max(head, v)
+		if r, ok := results[0].Result().(map[string]any); ok && receipt == nil {
+			receipt = r
+		}
+	}
+	if !succeeded {
+		return nil, 0, err
+	}
+	return receipt, head, nil
+}
+
+// 交易是否还在节点的交易池或链上
+func (s *txTrackerService) seen(ctx context.Context, endpoints []*endpoint.Endpoint, hash string) bool {
+	for _, e := range endpoints {
+		results, err := s.call(ctx, e, rpc.SealedJSONRPC{Version: "2.0", ID: "1", Method: "eth_getTransactionByHash", Params: []any{hash}})
+		if err == nil && results[0].Error() == nil && results[0].Result() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// 更新交易的状态并回调 webhook，回调失败不影响状态的更新
+func (s *txTrackerService) transit(ctx context.Context, tx *trackedTx, status string) {
+	event := txStatusEvent{
+		Hash:          tx.Hash,
+		ChainID:       tx.ChainID,
+		Status:        status,
+		Previous:      tx.Status,
+		BlockNumber:   tx.BlockNumber,
+		BlockHash:     tx.BlockHash,
+		Confirmations: tx.Confirmations,
+		Timestamp:     time.Now().Unix(),
+	}
+	tx.Status = status
+
+	s.logger.Debug().Msgf("%d:%s of %s %s -> %s", tx.ChainID, tx.Hash, tx.Tenant, event.Previous, status)
+
+	body, _ := json.Marshal(event)
+	for i := 0; i <= s.config.WebhookRetries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(i) * time.Second):
+			}
+		}
+		err := s.deliver(ctx, tx, body, event.Timestamp)
+		if err == nil {
+			return
+		}
+		s.logger.Warn().Err(err).Msgf("Failed to deliver %s of %s to webhook of %s", status, tx.Hash, tx.Tenant)
+	}
+}
+
+func (s *txTrackerService) deliver(ctx context.Context, tx *trackedTx, body []byte, timestamp int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tx.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(timestamp, 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	if tx.Secret != "" {
+		req.Header.Set("X-Webhook-Signature", signWebhook(tx.Secret, ts, body))
+	}
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
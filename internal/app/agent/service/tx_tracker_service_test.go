@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/rs/zerolog"
+)
+
+type fakeEndpointService struct {
+	endpoints []*endpoint.Endpoint
+}
+
+func (s *fakeEndpointService) Init()            {}
+func (s *fakeEndpointService) Chains() []uint64 { return []uint64{1} }
+func (s *fakeEndpointService) GetAll(chain uint64) ([]*endpoint.Endpoint, bool) {
+	return s.endpoints, len(s.endpoints) > 0
+}
+func (s *fakeEndpointService) Purge() {}
+
+// 模拟节点，返回当前设置的收据、最新高度与交易
+type fakeNode struct {
+	mu      sync.Mutex
+	receipt map[string]any
+	head    uint64
+	pending bool
+}
+
+func (n *fakeNode) set(receipt map[string]any, head uint64, pending bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.receipt, n.head, n.pending = receipt, head, pending
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	requests := []map[string]any{}
+	b, _ := io.ReadAll(r.Body)
+	json.Unmarshal(b, &requests)
+	results := []map[string]any{}
+	for _, req := range requests {
+		var result any
+		switch req["method"] {
+		case "eth_getTransactionReceipt":
+			if n.receipt != nil {
+				result = n.receipt
+			}
+		case "eth_blockNumber":
+			result = "0x" + strconv.FormatUint(n.head, 16)
+		case "eth_getTransactionByHash":
+			if n.pending || n.receipt != nil {
+				result = map[string]any{"hash": "0xabc"}
+			}
+		}
+		results = append(results, map[string]any{"jsonrpc": "2.0", "id": req["id"], "result": result})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// 返回跟踪服务、webhook 地址与收到的状态变化
+func newTestTxTracker(t *testing.T, node *fakeNode) (*txTrackerService, string, func() []string) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if signWebhook("secret", r.Header.Get("X-Webhook-Timestamp"), body) != r.Header.Get("X-Webhook-Signature") {
+			t.Errorf("invalid webhook signature")
+		}
+		event := txStatusEvent{}
+		json.Unmarshal(body, &event)
+		mu.Lock()
+		events = append(events, event.Previous+">"+event.Status)
+		mu.Unlock()
+	}))
+	t.Cleanup(webhook.Close)
+	server := httptest.NewServer(node)
+	t.Cleanup(server.Close)
+
+	s := &txTrackerService{
+		logger:          zerolog.Nop(),
+		config:          txTrackerConfig{Endpoints: 1, DropAfter: time.Minute},
+		endpointService: &fakeEndpointService{endpoints: newTestEndpoints(server.URL)},
+		clients:         endpoint.NewClientFactory(&endpoint.ClientFactoryConfig{ClientsSize: 4, Transport: &http.Transport{}}),
+		http:            &http.Client{Timeout: time.Second},
+	}
+	return s, webhook.URL, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, events...)
+	}
+}
+
+func TestTxTrackerUpdate(t *testing.T) {
+	node := &fakeNode{}
+	s, webhook, events := newTestTxTracker(t, node)
+	tx := &trackedTx{Hash: "0xabc", ChainID: 1, Confirmations: 3, Webhook: webhook, Secret: "secret", Seen: time.Now().UnixMilli()}
+
+	expect := func(done bool, expected ...string) {
+		t.Helper()
+		if _done := s.update(context.Background(), tx); _done != done {
+			t.Errorf("expected done %v, got %v", done, _done)
+		}
+		if got := events(); !slices.Equal(got, expected) {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+	}
+
+	// 在交易池中
+	node.set(nil, 100, true)
+	expect(false, ">pending")
+	expect(false, ">pending")
+
+	// 打包后等待确认数
+	node.set(map[string]any{"blockNumber": "0x64", "blockHash": "0xAA"}, 101, false)
+	expect(false, ">pending", "pending>included")
+	if tx.BlockNumber != 100 || tx.BlockHash != "0xaa" {
+		t.Errorf("unexpected block %d %s", tx.BlockNumber, tx.BlockHash)
+	}
+
+	// 交易被打包进另一个区块
+	node.set(map[string]any{"blockNumber": "0x65", "blockHash": "0xbb"}, 102, false)
+	expect(false, ">pending", "pending>included", "included>reorged", "reorged>included")
+
+	node.set(map[string]any{"blockNumber": "0x65", "blockHash": "0xbb"}, 103, false)
+	expect(true, ">pending", "pending>included", "included>reorged", "reorged>included", "included>confirmed")
+}
+
+func TestTxTrackerDropped(t *testing.T) {
+	node := &fakeNode{}
+	s, webhook, events := newTestTxTracker(t, node)
+	tx := &trackedTx{Hash: "0xabc", ChainID: 1, Confirmations: 1, Webhook: webhook, Secret: "secret", Status: TX_STATUS_INCLUDED, BlockNumber: 100, BlockHash: "0xaa", Seen: time.Now().UnixMilli()}
+
+	// 收据消失但交易仍在交易池中
+	node.set(nil, 101, true)
+	if s.update(context.Background(), tx) {
+		t.Errorf("expected not done")
+	}
+	if got := events(); !slices.Equal(got, []string{"included>reorged"}) {
+		t.Errorf("unexpected events %v", got)
+	}
+
+	// 节点上查不到交易超过 DropAfter
+	node.set(nil, 101, false)
+	tx.Seen = time.Now().Add(-2 * time.Minute).UnixMilli()
+	if !s.update(context.Background(), tx) {
+		t.Errorf("expected done")
+	}
+	if got := events(); !slices.Equal(got, []string{"included>reorged", "reorged>dropped"}) {
+		t.Errorf("unexpected events %v", got)
+	}
+}
@@ -28,6 +28,8 @@ func StartCluster() {
 	prometheus.MustRegister(utils.EndpointDurations)
 	prometheus.MustRegister(utils.TotalCaches)
 	prometheus.MustRegister(utils.TotalAmqpMessages)
+	prometheus.MustRegister(utils.RateLimitMode)
+	prometheus.MustRegister(utils.TotalIntercepts)
 
 	fx.New(
 		// provide modules
@@ -57,11 +59,14 @@ func InitCluster(
 	amqp *shared.Amqp,
 	etcd *clientv3.Client,
 	redis *shared.RedisClient,
+	diskCache *shared.DiskCache,
 	watcher *shared.WatcherClient,
 	ecf *endpoint.ClientFactory,
 	router *Router,
 	app *Application,
 	service service.EndpointService,
+	tenants service.TenantAdminService,
+	caches service.CacheService,
 ) {
 	lifecycle.Append(
 		fx.Hook{
@@ -83,6 +88,31 @@ func InitCluster(
 				}
 				i++
 
+				if err := caches.Subscribe(ctx); err != nil {
+					logger.Error().Err(err).Msgf("%d- An unknown error interrupted when to subscribe the cache invalidations!", i)
+				} else {
+					logger.Info().Msgf("%d- Subscribed the cache invalidations succesfully!", i)
+				}
+				i++
+
+				if !conf.Bool("tenant.enable", false) {
+					logger.Warn().Msgf("%d- Tenant feature is disabled!", i)
+				} else if err := tenants.Subscribe(ctx); err != nil {
+					logger.Error().Err(err).Msgf("%d- An unknown error interrupted when to subscribe the tenant invalidations!", i)
+				} else {
+					logger.Info().Msgf("%d- Subscribed the tenant invalidations succesfully!", i)
+				}
+				i++
+
+				if !diskCache.Enabled() {
+					logger.Warn().Msgf("%d- Disk cache is disabled!", i)
+				} else if err := diskCache.Connect(ctx); err != nil {
+					logger.Error().Err(err).Msgf("%d- An unknown error interrupted when to open the Disk cache!", i)
+				} else {
+					logger.Info().Msgf("%d- Opened the Disk cache succesfully!", i)
+				}
+				i++
+
 				if err := amqp.Connect(ctx); err != nil {
 					logger.Error().Err(err).Msgf("%d- An unknown error occurred when to connect the Amqp!", i)
 				} else {
@@ -150,6 +180,13 @@ func InitCluster(
 				}
 				i++
 
+				if err := diskCache.Close(); err != nil {
+					logger.Error().Err(err).Msgf("%d- An unknown error occurred when to closed the disk cache!", i)
+				} else {
+					logger.Info().Msgf("%d- Closed the Disk cache succesfully!", i)
+				}
+				i++
+
 				if err := amqp.Close(); err != nil {
 					logger.Error().Err(err).Msgf("%d- An unknown error occurred when to closed the amqp!", i)
 				} else {
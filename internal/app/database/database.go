@@ -103,6 +103,7 @@ func (d *Database) Close() error {
 func Models() []interface{} {
 	return []interface{}{
 		schema.Tenant{},
+		schema.ApiKey{},
 	}
 }
 
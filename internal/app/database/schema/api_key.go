@@ -0,0 +1,20 @@
+package schema
+
+import (
+	"time"
+
+	"github.com/jackc/pgx/pgtype"
+)
+
+// 租户的 API key，只保存 key 的 sha256
+type ApiKey struct {
+	TenantID   uint64        `gorm:"notNull; index;" json:"tenant_id"`
+	Hash       string        `gorm:"type:varchar(64); notNull; uniqueIndex;" json:"-"`
+	Prefix     string        `gorm:"type:varchar(16); notNull;" json:"prefix"` // key 的前几位，用于识别
+	Label      string        `gorm:"type:varchar(255);" json:"label"`
+	Scopes     *pgtype.JSONB `gorm:"type:jsonb; notNull; default:'{}'::jsonb;" json:"scopes"` // {"chains": [...], "methods": [...]}
+	ExpiresAt  *time.Time    `json:"expires_at"`
+	LastUsedAt *time.Time    `json:"last_used_at"`
+
+	Base
+}
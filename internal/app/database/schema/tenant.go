@@ -8,6 +8,7 @@ type Tenant struct {
 	Rate        float64       `gorm:"type:real; notNull;" json:"rate"` // 每秒释放量
 	Capacity    float64       `gorm:"notNull;" json:"capacity"`        // 每秒请求量
 	Preferences *pgtype.JSONB `gorm:"type:jsonb; notNull; default:'{}'::jsonb;" json:"preferences"`
+	Disabled    bool          `gorm:"notNull; default:false;" json:"disabled"` // 停用后拒绝访问
 
 	Base
 }
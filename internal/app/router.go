@@ -5,20 +5,23 @@ import (
 )
 
 type Router struct {
-	app *Application
+	app   *Application
 	Agent controller.AgentController
 	Other controller.OtherController
+	Admin controller.AdminController
 }
 
 func NewRouter(
 	app *Application,
 	agent controller.AgentController,
 	other controller.OtherController,
+	admin controller.AdminController,
 ) *Router {
 	return &Router{
 		app:   app,
 		Agent: agent,
 		Other: other,
+		Admin: admin,
 	}
 }
 
@@ -28,6 +31,24 @@ func (c *Router) RegisterRoutes() {
 	c.app.Router.GET("/metrics", c.Other.HandleMetrics)
 	c.app.Router.GET("/k8s/healthz", c.Other.HandleK8sHealthz)
 
+	// 管理接口
+	admin := c.app.Router.Group("/admin")
+	admin.GET("/cache/stats", c.Admin.Auth(c.Admin.HandleCacheStats))
+	admin.GET("/cache/entry", c.Admin.Auth(c.Admin.HandleCacheEntry))
+	admin.DELETE("/cache", c.Admin.Auth(c.Admin.HandleCachePurge))
+	admin.GET("/cache/ttl", c.Admin.Auth(c.Admin.HandleCacheTTLs))
+	admin.PUT("/cache/ttl", c.Admin.Auth(c.Admin.HandleCacheSetTTL))
+	admin.GET("/tenants", c.Admin.Auth(c.Admin.HandleTenantList))
+	admin.POST("/tenants", c.Admin.Auth(c.Admin.HandleTenantCreate))
+	admin.GET("/tenants/{id}", c.Admin.Auth(c.Admin.HandleTenantGet))
+	admin.PATCH("/tenants/{id}", c.Admin.Auth(c.Admin.HandleTenantUpdate))
+	admin.DELETE("/tenants/{id}", c.Admin.Auth(c.Admin.HandleTenantDelete))
+	admin.POST("/tenants/{id}/token", c.Admin.Auth(c.Admin.HandleTenantRotateToken))
+	admin.POST("/tenants/{id}/reset", c.Admin.Auth(c.Admin.HandleTenantResetBalance))
+	admin.GET("/tenants/{id}/keys", c.Admin.Auth(c.Admin.HandleApiKeyList))
+	admin.POST("/tenants/{id}/keys", c.Admin.Auth(c.Admin.HandleApiKeyCreate))
+	admin.DELETE("/tenants/{id}/keys/{key}", c.Admin.Auth(c.Admin.HandleApiKeyDelete))
+
 	c.app.Router.POST("/{chain}", c.Agent.HandleCall)
 	c.app.Router.POST("/{apikey}/{chain}", c.Agent.HandleCall)
 	c.app.Router.POST("/rpc/{chain}", c.Agent.HandleCall)
@@ -0,0 +1,323 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/rs/zerolog"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// key => 写入时间(8 bytes) + value
+	diskCacheResultsBucket = []byte("results")
+	// 写入时间(8 bytes) + key => nil，用于按写入顺序淘汰
+	diskCacheIndexBucket = []byte("index")
+)
+
+type diskCacheConfig struct {
+	Enable bool
+	Path   string
+	// 数据的最大字节数，超过后按写入顺序淘汰
+	Size int64
+	// 检查容量、压缩文件的间隔
+	CompactInterval time.Duration
+}
+
+// 持久化的缓存，只用于保存不可变的链上数据，重启后仍然有效
+type DiskCache struct {
+	logger zerolog.Logger
+	config diskCacheConfig
+	// 压缩文件时需要重新打开数据库，读写持有读锁，压缩持有写锁
+	rwm    sync.RWMutex
+	db     *bolt.DB
+	cancel context.CancelFunc
+}
+
+func NewDiskCache(config *config.Conf, logger zerolog.Logger) *DiskCache {
+	return &DiskCache{
+		logger: logger.With().Str("name", "disk_cache").Logger(),
+		config: diskCacheConfig{
+			Enable:          config.Bool("cache.disk.enable", false),
+			Path:            config.String("cache.disk.path", "data/cache.db"),
+			Size:            config.Int64("cache.disk.size", 4*1024*1024*1024),
+			CompactInterval: config.Duration("cache.disk.compact_interval", time.Hour),
+		},
+	}
+}
+
+func (d *DiskCache) Enabled() bool {
+	return d != nil && d.config.Enable
+}
+
+func (d *DiskCache) open() error {
+	db, err := bolt.Open(d.config.Path, 0o600, &bolt.Options{Timeout: 5 * time.Second, NoFreelistSync: true})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(diskCacheResultsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(diskCacheIndexBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	d.db = db
+	return nil
+}
+
+func (d *DiskCache) Connect(ctx context.Context) error {
+	if !d.Enabled() {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(d.config.Path), 0o755); err != nil {
+		return err
+	}
+	if err := d.open(); err != nil {
+		return err
+	}
+
+	_ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(d.config.CompactInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-_ctx.Done():
+				return
+			case <-ticker.C:
+				d.maintain()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (d *DiskCache) Close() error {
+	if !d.Enabled() {
+		return nil
+	}
+	if d.cancel != nil {
+		d.cancel()
+	}
+
+	d.rwm.Lock()
+	defer d.rwm.Unlock()
+	if d.db == nil {
+		return nil
+	}
+	err := d.db.Close()
+	d.db = nil
+	return err
+}
+
+func (d *DiskCache) Get(key string) ([]byte, bool) {
+	if !d.Enabled() {
+		return nil, false
+	}
+	// 正在压缩时跳过，不阻塞请求
+	if !d.rwm.TryRLock() {
+		return nil, false
+	}
+	defer d.rwm.RUnlock()
+	if d.db == nil {
+		return nil, false
+	}
+
+	var value []byte
+	d.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(diskCacheResultsBucket).Get([]byte(key)); len(v) > 8 {
+			value = append([]byte{}, v[8:]...)
+		}
+		return nil
+	})
+	return value, value != nil
+}
+
+// 异步写入，多个并发的写入会合并为一个事务
+func (d *DiskCache) Set(key string, value []byte) {
+	if !d.Enabled() {
+		return
+	}
+
+	go func() {
+		if !d.rwm.TryRLock() {
+			return
+		}
+		defer d.rwm.RUnlock()
+		if d.db == nil {
+			return
+		}
+
+		err := d.db.Batch(func(tx *bolt.Tx) error {
+			results, index := tx.Bucket(diskCacheResultsBucket), tx.Bucket(diskCacheIndexBucket)
+			// 不可变数据，已存在时不需要覆盖
+			if results.Get([]byte(key)) != nil {
+				return nil
+			}
+
+			ts := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixMilli()))
+			if err := results.Put([]byte(key), append(ts, value...)); err != nil {
+				return err
+			}
+			return index.Put(append(ts, key...), nil)
+		})
+		if err != nil {
+			d.logger.Error().Err(err).Msgf("Failed to write disk cache %s", key)
+		}
+	}()
+}
+
+func (d *DiskCache) Delete(key string) bool {
+	return d.DeletePrefix(key, func(k string) bool {
+		return k == key
+	}) > 0
+}
+
+// 删除 key 以 prefix 开头且 match 返回 true 的数据，返回删除的数量
+func (d *DiskCache) DeletePrefix(prefix string, match func(key string) bool) int {
+	if !d.Enabled() {
+		return 0
+	}
+
+	d.rwm.RLock()
+	defer d.rwm.RUnlock()
+	if d.db == nil {
+		return 0
+	}
+
+	deleted := 0
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		results, index := tx.Bucket(diskCacheResultsBucket), tx.Bucket(diskCacheIndexBucket)
+		// 遍历时删除会跳过数据，先收集再删除
+		var keys, indexes [][]byte
+		c := results.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if match != nil && !match(string(k)) {
+				continue
+			}
+			keys = append(keys, append([]byte{}, k...))
+			if len(v) >= 8 {
+				indexes = append(indexes, append(append([]byte{}, v[:8]...), k...))
+			}
+		}
+		for i := range keys {
+			if err := results.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+		for i := range indexes {
+			if err := index.Delete(indexes[i]); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	if err != nil {
+		d.logger.Error().Err(err).Msgf("Failed to delete disk cache %s", prefix)
+		return 0
+	}
+	return deleted
+}
+
+// 超出容量时淘汰最早写入的数据，文件中空闲空间过多时压缩文件
+func (d *DiskCache) maintain() {
+	defer func() {
+		if err := recover(); err != nil {
+			d.logger.Error().Interface("error", err).Msg("Failed to maintain disk cache")
+		}
+	}()
+
+	var size, fileSize int64
+	d.rwm.RLock()
+	if d.db == nil {
+		d.rwm.RUnlock()
+		return
+	}
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		results, index := tx.Bucket(diskCacheResultsBucket), tx.Bucket(diskCacheIndexBucket)
+		stats := results.Stats()
+		size = int64(stats.LeafInuse + stats.BranchInuse)
+		fileSize = tx.Size()
+		if size <= d.config.Size {
+			return nil
+		}
+
+		// 淘汰到容量的 80%
+		evicted, target := 0, size-d.config.Size*8/10
+		c := index.Cursor()
+		for k, _ := c.First(); k != nil && target > 0; k, _ = c.Next() {
+			key := k[8:]
+			target -= int64(len(key) + len(results.Get(key)))
+			if err := results.Delete(key); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			evicted++
+		}
+		d.logger.Info().Msgf("Evicted %d disk cache entries, size: %d bytes", evicted, size)
+		return nil
+	})
+	d.rwm.RUnlock()
+	if err != nil {
+		d.logger.Error().Err(err).Msg("Failed to evict disk cache")
+		return
+	}
+
+	// bolt 删除数据后不会缩小文件，空闲空间超过一半时压缩
+	if fileSize > 64*1024*1024 && fileSize > 2*min(size, d.config.Size) {
+		if err := d.compact(); err != nil {
+			d.logger.Error().Err(err).Msg("Failed to compact disk cache")
+		}
+	}
+}
+
+func (d *DiskCache) compact() error {
+	d.rwm.Lock()
+	defer d.rwm.Unlock()
+	if d.db == nil {
+		return errors.New("disk cache is closed")
+	}
+
+	tmp := d.config.Path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0o600, &bolt.Options{Timeout: 5 * time.Second, NoFreelistSync: true})
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, d.db, 64*1024*1024); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	if err := d.db.Close(); err != nil {
+		return err
+	}
+	d.db = nil
+	if err := os.Rename(tmp, d.config.Path); err != nil {
+		return errors.Join(err, d.open())
+	}
+	d.logger.Info().Msgf("Compacted disk cache %s", d.config.Path)
+	return d.open()
+}
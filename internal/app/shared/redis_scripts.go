@@ -2,6 +2,7 @@ package shared
 
 import (
 	"context"
+	"time"
 
 	rdbscripts "github.com/DODOEX/web3rpcproxy/internal/app/shared/redis_scripts"
 	"github.com/redis/go-redis/v9"
@@ -9,13 +10,21 @@ import (
 )
 
 type Scripts interface {
-	Balance(ctx context.Context, key string, capacity int64, rate int64) (int64, error)
+	// 按 cost 扣除余额，返回扣除后的余额；余额不足时不扣除，返回负数
+	Balance(ctx context.Context, key string, capacity int64, rate int64, cost int64) (int64, error)
+	// 按窗口检查并累加配额，limits 依次为每个窗口的请求数限额、计算单位限额与过期时间；
+	// 返回超出的窗口序号（0 表示未超出）和各窗口已用的请求数、计算单位
+	Quota(ctx context.Context, keys []string, limits []int64, cost int64) ([]int64, error)
+	// 取出有序集合中到期的成员并将其推后 lease，保证同一时间只有一个实例处理
+	Claim(ctx context.Context, key string, lease time.Duration, count int64) ([]string, error)
 }
 
 type scripts struct {
 	logger  zerolog.Logger
 	rdb     *RedisClient
 	balance *redis.Script
+	quota   *redis.Script
+	claim   *redis.Script
 }
 
 func NewRedisScripts(rdb *RedisClient, logger zerolog.Logger) Scripts {
@@ -23,12 +32,27 @@ func NewRedisScripts(rdb *RedisClient, logger zerolog.Logger) Scripts {
 		rdb:     rdb,
 		logger:  logger,
 		balance: rdbscripts.GetBalanceScript(),
+		quota:   rdbscripts.GetQuotaScript(),
+		claim:   rdbscripts.GetClaimScript(),
 	}
-	logger.Debug().Msgf("Redis scripts: balance=%s", rs.balance.Hash())
+	logger.Debug().Msgf("Redis scripts: balance=%s, quota=%s", rs.balance.Hash(), rs.quota.Hash())
 	return rs
 }
 
-func (s *scripts) Balance(ctx context.Context, key string, capacity int64, rate int64) (int64, error) {
-	balance, err := s.balance.Eval(ctx, s.rdb.Client, []string{key}, capacity, rate).Int64()
+func (s *scripts) Balance(ctx context.Context, key string, capacity int64, rate int64, cost int64) (int64, error) {
+	balance, err := s.balance.Eval(ctx, s.rdb.Client, []string{key}, capacity, rate, cost).Int64()
 	return balance, err
 }
+
+func (s *scripts) Quota(ctx context.Context, keys []string, limits []int64, cost int64) ([]int64, error) {
+	args := make([]any, 0, len(limits)+1)
+	args = append(args, cost)
+	for i := range limits {
+		args = append(args, limits[i])
+	}
+	return s.quota.Eval(ctx, s.rdb.Client, keys, args...).Int64Slice()
+}
+
+func (s *scripts) Claim(ctx context.Context, key string, lease time.Duration, count int64) ([]string, error) {
+	return s.claim.Eval(ctx, s.rdb.Client, []string{key}, lease.Milliseconds(), count).StringSlice()
+}
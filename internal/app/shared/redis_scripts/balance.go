@@ -19,6 +19,7 @@ func GetBalanceScript() *redis.Script {
 	script := fmt.Sprintf(`
 						local capacity = math.floor(tonumber(ARGV[1]))
 						local rate = tonumber(ARGV[2])
+						local cost = math.max(math.floor(tonumber(ARGV[3] or 1)), 0)
 						if (capacity <= 0) then
 							return 0
 						end
@@ -31,8 +32,13 @@ func GetBalanceScript() *redis.Script {
                         local last = tonumber(redis.call('hget', KEYS[1], '%[2]s') or now)
                         if (last > now) then last = now end
                         local recovery = math.floor((now - last) * rate)
-                        local residual = math.floor(redis.call('hincrby', KEYS[1], '%[1]s', -1))
-                        local current = math.min(capacity - 1, residual + recovery)
+                        local residual = math.floor(tonumber(redis.call('hget', KEYS[1], '%[1]s')))
+                        local available = math.min(capacity, residual + recovery)
+                        -- 余额不足时不扣除，返回负数表示缺少的额度
+                        if (available < cost) then
+                            return available - cost
+                        end
+                        local current = available - cost
                         redis.call('hset', KEYS[1], '%[1]s', current)
                         return current
                     `, CacheFieldBalance, CacheFieldLastTime)
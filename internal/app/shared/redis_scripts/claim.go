@@ -0,0 +1,23 @@
+package redisscripts
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+// 从有序集合中取出到期（score 不大于当前毫秒时间）的成员，并将其 score 推后租期，
+// 多个实例同时执行时每个成员只会被一个实例取到，租期内未处理完会被其他实例重新取出；
+// KEYS[1] 为有序集合，ARGV[1] 为租期（毫秒），ARGV[2] 为最多取出的数量
+func GetClaimScript() *redis.Script {
+	script := `
+						local lease = tonumber(ARGV[1])
+						local count = math.max(math.floor(tonumber(ARGV[2] or 1)), 1)
+						local time = redis.call('time')
+						local now = (time[1] * 1000) + math.floor(time[2] / 1000)
+						local members = redis.call('zrangebyscore', KEYS[1], '-inf', now, 'LIMIT', 0, count)
+						for i = 1, #members do
+							redis.call('zadd', KEYS[1], now + lease, members[i])
+						end
+						return members
+					`
+	return redis.NewScript(script)
+}
@@ -0,0 +1,48 @@
+package redisscripts
+
+import (
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type QuotaCacheField = string
+
+const (
+	CacheFieldQuotaRequests QuotaCacheField = "requests"
+	CacheFieldQuotaUnits    QuotaCacheField = "units"
+)
+
+// 同时检查多个时间窗口的配额，任一窗口超出时都不计数；
+// KEYS 为各窗口的计数器，ARGV[1] 为消耗的计算单位，
+// 之后每个窗口依次为请求数限额、计算单位限额（0 表示不限制）与过期时间（unix 秒）；
+// 返回 {超出的窗口序号（从 1 开始，0 表示未超出）, 窗口 1 已用请求数, 窗口 1 已用计算单位, ...}
+func GetQuotaScript() *redis.Script {
+	script := fmt.Sprintf(`
+						local cost = math.max(math.floor(tonumber(ARGV[1] or 1)), 0)
+						local result = {0}
+						for i = 1, #KEYS do
+							local base = 1 + (i - 1) * 3
+							local requestsLimit = tonumber(ARGV[base + 1])
+							local unitsLimit = tonumber(ARGV[base + 2])
+							local requests = tonumber(redis.call('hget', KEYS[i], '%[1]s') or 0)
+							local units = tonumber(redis.call('hget', KEYS[i], '%[2]s') or 0)
+							if (result[1] == 0 and ((requestsLimit > 0 and requests + 1 > requestsLimit) or (unitsLimit > 0 and units + cost > unitsLimit))) then
+								result[1] = i
+							end
+							result[#result + 1] = requests
+							result[#result + 1] = units
+						end
+						if (result[1] ~= 0) then
+							return result
+						end
+						for i = 1, #KEYS do
+							local base = 1 + (i - 1) * 3
+							result[2 * i] = redis.call('hincrby', KEYS[i], '%[1]s', 1)
+							result[2 * i + 1] = redis.call('hincrby', KEYS[i], '%[2]s', cost)
+							redis.call('expireat', KEYS[i], tonumber(ARGV[base + 3]))
+						end
+						return result
+					`, CacheFieldQuotaRequests, CacheFieldQuotaUnits)
+	return redis.NewScript(script)
+}
@@ -12,6 +12,7 @@ package shared
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "go.uber.org/mock/gomock"
 )
@@ -40,16 +41,46 @@ func (m *MockScripts) EXPECT() *MockScriptsMockRecorder {
 }
 
 // Balance mocks base method.
-func (m *MockScripts) Balance(ctx context.Context, key string, capacity, rate int64) (int64, error) {
+func (m *MockScripts) Balance(ctx context.Context, key string, capacity, rate, cost int64) (int64, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Balance", ctx, key, capacity, rate)
+	ret := m.ctrl.Call(m, "Balance", ctx, key, capacity, rate, cost)
 	ret0, _ := ret[0].(int64)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Balance indicates an expected call of Balance.
-func (mr *MockScriptsMockRecorder) Balance(ctx, key, capacity, rate any) *gomock.Call {
+func (mr *MockScriptsMockRecorder) Balance(ctx, key, capacity, rate, cost any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Balance", reflect.TypeOf((*MockScripts)(nil).Balance), ctx, key, capacity, rate)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Balance", reflect.TypeOf((*MockScripts)(nil).Balance), ctx, key, capacity, rate, cost)
+}
+
+// Claim mocks base method.
+func (m *MockScripts) Claim(ctx context.Context, key string, lease time.Duration, count int64) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Claim", ctx, key, lease, count)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Claim indicates an expected call of Claim.
+func (mr *MockScriptsMockRecorder) Claim(ctx, key, lease, count any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Claim", reflect.TypeOf((*MockScripts)(nil).Claim), ctx, key, lease, count)
+}
+
+// Quota mocks base method.
+func (m *MockScripts) Quota(ctx context.Context, keys []string, limits []int64, cost int64) ([]int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Quota", ctx, keys, limits, cost)
+	ret0, _ := ret[0].([]int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Quota indicates an expected call of Quota.
+func (mr *MockScriptsMockRecorder) Quota(ctx, keys, limits, cost any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Quota", reflect.TypeOf((*MockScripts)(nil).Quota), ctx, keys, limits, cost)
 }
@@ -17,4 +17,5 @@ var NewSharedModule = fx.Options(
 	fx.Provide(NewRedisClient),
 	fx.Provide(NewRedisScripts),
 	fx.Provide(NewRabbitMQ),
+	fx.Provide(NewDiskCache),
 )
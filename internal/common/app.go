@@ -1,6 +1,7 @@
 package common
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/DODOEX/web3rpcproxy/internal/app/database/schema"
@@ -11,14 +12,57 @@ type TenantInfo = schema.Tenant
 
 type App struct {
 	TenantInfo
-	Bucket  string
-	Balance int64
+	// 使用 API key 访问时的 key，使用租户 token 访问时为 nil
+	Key *schema.ApiKey `json:"key,omitempty"`
+	// 访问凭证的 sha256，用于缓存租户信息
+	Credential string `json:"-"`
+	// 使用 JWT 访问时，claims 中的权限范围与限流
+	Scopes      map[string][]string `json:"-"`
+	MaxRate     float64             `json:"-"`
+	MaxCapacity float64             `json:"-"`
+	Bucket      string
+	Balance     int64
 	// 用于流量防抖
 	LastTime int64
 	Offset   int64
+	// 本次请求扣除的计算单位，请求失败时需要退还
+	Cost int64 `json:"-"`
+	// 本次请求计入的配额，请求失败时需要退还
+	Quotas []Quota `json:"-"`
+	// Redis 不可用时，本次请求由本地令牌桶限流
+	LocalLimited bool `json:"-"`
+}
+
+// 令牌桶的容量与每秒恢复的速率，JWT 中只能调低租户的限流
+func (a *App) Limits() (capacity, rate float64) {
+	capacity, rate = a.Capacity, a.Rate
+	if a.MaxCapacity > 0 {
+		capacity = min(capacity, a.MaxCapacity)
+	}
+	if a.MaxRate > 0 {
+		rate = min(rate, a.MaxRate)
+	}
+	return capacity, rate
+}
+
+// 按时间窗口（天、月）统计的配额
+type Quota struct {
+	Window string
+	Key    string
+	// 限额，0 表示不限制
+	Requests int64
+	Units    int64
+	// 已用量
+	UsedRequests int64
+	UsedUnits    int64
+	// 窗口结束的时间，unix 秒
+	Reset int64
 }
 
 func (a App) Preference(path string) any {
+	if a.Preferences == nil {
+		return nil
+	}
 	value := a.Preferences.Get()
 	if preferences, ok := value.(map[string]any); ok {
 		p := strings.Split(path, ".")
@@ -33,3 +77,66 @@ func (a App) HasPreference(path string) bool {
 	}
 	return false
 }
+
+// 读取字符串数组类型的配置，配置不存在时返回 nil
+func (a App) PreferenceStrings(path string) []string {
+	switch v := a.Preference(path).(type) {
+	case []string:
+		return append([]string{}, v...)
+	case []any:
+		values := make([]string, 0, len(v))
+		for i := range v {
+			values = append(values, fmt.Sprint(v[i]))
+		}
+		return values
+	case string:
+		return []string{v}
+	}
+	return nil
+}
+
+// 读取数值类型的配置，配置不存在或不是数值时返回 0
+func (a App) PreferenceInt64(path string) int64 {
+	switch v := a.Preference(path).(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	}
+	return 0
+}
+
+// 读取 API key 或 JWT 的权限范围，如 chains、methods；未限制时返回 nil
+func (a App) Scope(name string) []string {
+	if a.Scopes != nil {
+		return a.Scopes[name]
+	}
+	if a.Key == nil || a.Key.Scopes == nil {
+		return nil
+	}
+	scopes, ok := a.Key.Scopes.Get().(map[string]any)
+	if !ok {
+		return nil
+	}
+	switch v := scopes[name].(type) {
+	case []any:
+		values := make([]string, 0, len(v))
+		for i := range v {
+			values = append(values, fmt.Sprint(v[i]))
+		}
+		return values
+	case string:
+		return []string{v}
+	}
+	return nil
+}
+
+// 租户用于签发 HS256 JWT 的密钥，未配置时返回 nil
+func (a App) JWTSecret() *string {
+	if v, ok := a.Preference("jwt.secret").(string); ok && v != "" {
+		return &v
+	}
+	return nil
+}
@@ -4,6 +4,8 @@ type EndpointInfo struct {
 	Url     string             `yaml:"url" koanf:"url" json:"url"`
 	Headers *map[string]string `yaml:"headers" koanf:"headers" json:"headers"`
 	Weight  *int               `yaml:"weight" koanf:"weight" json:"weight"`
+	// 节点允许的 eth_getLogs 最大区块跨度
+	LogsRange *uint64 `yaml:"logs-range" koanf:"logs-range" json:"logsRange"`
 }
 
 type EndpointList = struct {
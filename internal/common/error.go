@@ -44,6 +44,8 @@ func (e httpError) QueryStatus() QueryStatus {
 		fallthrough
 	case "Not Found":
 		fallthrough
+	case "Quota Exceeded":
+		fallthrough
 	case "Forbidden":
 		return Reject
 	case "Timeout":
@@ -149,9 +151,34 @@ func TooManyRequestsError(msg string, errs ...error) httpError {
 	return err
 }
 
+// 与 TooManyRequestsError 区分：限流会很快恢复，配额需要等到下一个窗口
+func QuotaExceededError(msg string, errs ...error) httpError {
+	err := NewHttpError(429, "Quota Exceeded", msg, errs...)
+	_, file, line, _ := runtime.Caller(1)
+	err.file, err.line = file, line
+	return err
+}
+
 func InternalServerError(msg string, errs ...error) httpError {
 	err := NewHttpError(500, "Internal Server Error", msg, errs...)
 	_, file, line, _ := runtime.Caller(1)
 	err.file, err.line = file, line
 	return err
 }
+
+// 请求被拦截时的错误，body 是返回给客户端的 JSON-RPC 结果
+type interceptError struct {
+	httpError
+	body []byte
+}
+
+func (e interceptError) Body() []byte {
+	return e.body
+}
+
+func InterceptError(msg string, body []byte) interceptError {
+	err := NewHttpError(200, "Intercept", msg)
+	_, file, line, _ := runtime.Caller(1)
+	err.file, err.line = file, line
+	return interceptError{httpError: err, body: body}
+}
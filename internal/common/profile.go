@@ -68,6 +68,10 @@ type QueryProfile = struct {
 	// 请求相关参数
 	AppID   uint64 `json:"appId"`
 	ChainID uint64 `json:"chainId"`
+	// 消耗的计算单位
+	ComputeUnits int64 `json:"computeUnits"`
+	// 批量调用中在本地处理、不计费的调用的方法
+	Intercepted []string `json:"intercepted,omitempty"`
 
 	// 代理请求的结果
 	Starttime names.Milliseconds `json:"startTime"` // 接受请求的时间戳
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"slices"
 	"strconv"
 	"time"
 
@@ -12,22 +13,56 @@ import (
 	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
 	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
 	"github.com/DODOEX/web3rpcproxy/utils"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
 	"github.com/duke-git/lancet/v2/slice"
 	"github.com/google/uuid"
 )
 
 type Client interface {
 	Request(ctx context.Context, rc reqctx.Reqctxs, endpoint []*endpoint.Endpoint, jsonrpcs []rpc.SealedJSONRPC) (results []rpc.JSONRPCResulter, err error)
+	// 方法返回 null 时是否可能是节点落后导致的，这类 null 结果会在更高的节点上重试且不应缓存
+	NullRetryable(method string) bool
 }
 
-func NewClient(ecf *endpoint.ClientFactory) Client {
+// 节点落后时可能返回 null 的方法
+var defaultNullRetryMethods = []string{
+	"eth_getTransactionReceipt",
+	"eth_getTransactionByHash",
+	"eth_getBlockByNumber",
+	"eth_getBlockByHash",
+	"eth_getBlockReceipts",
+	"eth_getTransactionByBlockHashAndIndex",
+	"eth_getTransactionByBlockNumberAndIndex",
+}
+
+type nullRetryConfig struct {
+	Disable bool     `koanf:"disable"`
+	Methods []string `koanf:"methods"`
+	// 最多重试的节点数
+	Attempts int `koanf:"attempts"`
+}
+
+func NewClient(ecf *endpoint.ClientFactory, config *config.Conf) Client {
+	retry := nullRetryConfig{Attempts: 2}
+	if config != nil {
+		config.Unmarshal("jsonrpc.retry_null", &retry)
+		if !config.Exists("jsonrpc.retry_null.methods") {
+			retry.Methods = defaultNullRetryMethods
+		}
+	}
 	return &client{
-		ecf: ecf,
+		ecf:       ecf,
+		retryNull: retry,
 	}
 }
 
 type client struct {
-	ecf *endpoint.ClientFactory
+	ecf       *endpoint.ClientFactory
+	retryNull nullRetryConfig
+}
+
+func (c *client) NullRetryable(method string) bool {
+	return !c.retryNull.Disable && slices.Contains(c.retryNull.Methods, method)
 }
 
 func (c *client) Request(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpcs []rpc.SealedJSONRPC) (results []rpc.JSONRPCResulter, err error) {
@@ -36,9 +71,7 @@ func (c *client) Request(ctx context.Context, rc reqctx.Reqctxs, endpoints []*en
 	}
 
 	var (
-		sChainId = fmt.Sprint(rc.ChainID())
 		methods  = getMethods(jsonrpcs)
-		p        = rc.Profile()
 		l        = len(endpoints)
 		timeout  = rc.Options().Timeout().Milliseconds()
 		_timeout = int64(math.Max(float64(timeout/int64(l)), 500))
@@ -50,12 +83,11 @@ func (c *client) Request(ctx context.Context, rc reqctx.Reqctxs, endpoints []*en
 
 	rc.Logger().Debug().Msgf("endpoints count: %d methods: %s", l, methods)
 
+	var used *endpoint.Endpoint
 	for i := 1; i <= rc.Options().Attempts(); i++ {
 		var (
-			reqId    = uuid.NewString()
 			endpoint = endpoints[(i-1)%l] // 这里的算法要跟随 i 的初始值修改
 			_client  = c.ecf.GetClient(endpoint)
-			now      = time.Now()
 		)
 
 		if _client == nil {
@@ -65,34 +97,8 @@ func (c *client) Request(ctx context.Context, rc reqctx.Reqctxs, endpoints []*en
 			continue
 		}
 
-		url := endpoint.Url().String()
-		// 记录请求
-		p.Requests = append(p.Requests, common.RequestProfile{
-			ReqID:     reqId,
-			Timestamp: now.UnixMilli(),
-			Url:       url,
-			Methods:   methods,
-		})
-		profile := common.ResponseProfile{
-			ReqID: reqId,
-		}
-
-		// 执行请求
-		if endpoint.Health() {
-			results, err = _client.Call(ctx, jsonrpcs, &profile)
-		} else {
-			_ctx, cancel := context.WithTimeout(ctx, time.Duration(_timeout)*time.Millisecond)
-			results, err = _client.Call(_ctx, jsonrpcs, &profile)
-			cancel()
-		}
-
-		// 记录响应
-		profile.Respond, p.Responses = true, append(p.Responses, profile)
-
-		// 记录指标
-		utils.EndpointDurations.WithLabelValues(sChainId, url).Observe(float64(profile.Duration) / 1000.0)
-		utils.TotalEndpoints.WithLabelValues(sChainId, url, strconv.Itoa(profile.Status)).Inc()
-		rc.Logger().Debug().Str("req-id", reqId).Msgf("%d/#%d call: %s %d %dms", rc.Options().Attempts(), i, url, profile.Status, profile.Duration)
+		used = endpoint
+		results, err = c.call(ctx, rc, _client, endpoint, jsonrpcs, methods, i, _timeout)
 
 		// 得到结果，跳出循环
 		if err == nil && results != nil && !slice.Some(results, func(_ int, item rpc.JSONRPCResulter) bool { return item.Type() == rpc.JSONRPC_ERROR }) {
@@ -112,9 +118,111 @@ func (c *client) Request(ctx context.Context, rc reqctx.Reqctxs, endpoints []*en
 		return nil, common.InternalServerError("All endpoints are unavailable")
 	}
 
+	if used != nil {
+		results = c.retryNulls(ctx, rc, used, endpoints, jsonrpcs, results, _timeout)
+	}
+
 	return results, nil
 }
 
+// 向节点发出一次请求，并记录 profile 与指标
+func (c *client) call(ctx context.Context, rc reqctx.Reqctxs, _client endpoint.Client, endpoint *endpoint.Endpoint, jsonrpcs []rpc.SealedJSONRPC, methods []string, attempt int, _timeout int64) (results []rpc.JSONRPCResulter, err error) {
+	var (
+		sChainId = fmt.Sprint(rc.ChainID())
+		reqId    = uuid.NewString()
+		now      = time.Now()
+		url      = endpoint.Url().String()
+	)
+
+	// 记录请求
+	rc.AddRequestProfile(common.RequestProfile{
+		ReqID:     reqId,
+		Timestamp: now.UnixMilli(),
+		Url:       url,
+		Methods:   methods,
+	})
+	profile := common.ResponseProfile{
+		ReqID: reqId,
+	}
+
+	// 执行请求
+	if endpoint.Health() {
+		results, err = _client.Call(ctx, jsonrpcs, &profile)
+	} else {
+		_ctx, cancel := context.WithTimeout(ctx, time.Duration(_timeout)*time.Millisecond)
+		results, err = _client.Call(_ctx, jsonrpcs, &profile)
+		cancel()
+	}
+
+	// 记录响应
+	profile.Respond = true
+	rc.AddResponseProfile(profile)
+
+	// 记录指标
+	utils.EndpointDurations.WithLabelValues(sChainId, url).Observe(float64(profile.Duration) / 1000.0)
+	utils.TotalEndpoints.WithLabelValues(sChainId, url, strconv.Itoa(profile.Status)).Inc()
+	rc.Logger().Debug().Str("req-id", reqId).Msgf("%d/#%d call: %s %d %dms", rc.Options().Attempts(), attempt, url, profile.Status, profile.Duration)
+
+	return results, err
+}
+
+// 节点落后时可能返回 null，将这些请求依次在已知高度更高的节点上重试，拿到结果后替换原来的 null
+func (c *client) retryNulls(ctx context.Context, rc reqctx.Reqctxs, used *endpoint.Endpoint, endpoints []*endpoint.Endpoint, jsonrpcs []rpc.SealedJSONRPC, results []rpc.JSONRPCResulter, _timeout int64) []rpc.JSONRPCResulter {
+	if c.retryNull.Disable || c.retryNull.Attempts <= 0 {
+		return results
+	}
+
+	// 结果为 null 的请求
+	nulls := map[string]int{}
+	for i := range results {
+		if results[i].Type() == rpc.JSONRPC_ERROR || results[i].Result() != nil {
+			continue
+		}
+		if j := slices.IndexFunc(jsonrpcs, func(jsonrpc rpc.SealedJSONRPC) bool {
+			return jsonrpc.ID == results[i].ID()
+		}); j >= 0 && c.NullRetryable(jsonrpcs[j].Method) {
+			nulls[jsonrpcs[j].ID] = i
+		}
+	}
+
+	head := used.BlockNumber()
+	for attempt := 1; attempt <= c.retryNull.Attempts && len(nulls) > 0; attempt++ {
+		// 已知高度最高的节点，高度不超过已请求的节点时重试没有意义
+		var next *endpoint.Endpoint
+		for _, e := range endpoints {
+			if e.BlockNumber() > head && e.Health() && (next == nil || e.BlockNumber() > next.BlockNumber()) {
+				next = e
+			}
+		}
+		if next == nil {
+			break
+		}
+		head = next.BlockNumber()
+
+		_client := c.ecf.GetClient(next)
+		if _client == nil {
+			continue
+		}
+
+		retries := slice.Filter(jsonrpcs, func(_ int, jsonrpc rpc.SealedJSONRPC) bool {
+			_, ok := nulls[jsonrpc.ID]
+			return ok
+		})
+		_results, err := c.call(ctx, rc, _client, next, retries, getMethods(retries), attempt, _timeout)
+		if err != nil {
+			continue
+		}
+		for _, result := range _results {
+			if i, ok := nulls[result.ID()]; ok && result.Type() != rpc.JSONRPC_ERROR && result.Result() != nil {
+				results[i] = result
+				delete(nulls, result.ID())
+			}
+		}
+	}
+
+	return results
+}
+
 func getMethods(jsonrpcs []rpc.SealedJSONRPC) []string {
 	methods := slice.Map(jsonrpcs, func(i int, jsonrpc rpc.SealedJSONRPC) string {
 		return jsonrpc.Method
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DODOEX/web3rpcproxy/internal/core/endpoint"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/knadh/koanf/providers/confmap"
+	"github.com/knadh/koanf/v2"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+func newConfig(value map[string]any) *config.Conf {
+	conf := &config.Conf{Koanf: koanf.New(".")}
+	conf.Load(confmap.Provider(value, "."), nil)
+	return conf
+}
+
+// 模拟高度为 head 的节点，result 为 nil 时返回 null
+type fakeNode struct {
+	head   uint64
+	result any
+	calls  atomic.Int32
+	server *httptest.Server
+}
+
+func newFakeNode(t *testing.T, head uint64, result any) *fakeNode {
+	n := &fakeNode{head: head, result: result}
+	n.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.calls.Add(1)
+		requests := []map[string]any{}
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &requests)
+		results := []map[string]any{}
+		for _, req := range requests {
+			results = append(results, map[string]any{"jsonrpc": "2.0", "id": req["id"], "result": n.result})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}))
+	t.Cleanup(n.server.Close)
+	return n
+}
+
+func (n *fakeNode) endpoint() *endpoint.Endpoint {
+	u, _ := url.Parse(n.server.URL)
+	e := endpoint.New(u)
+	e.Update(endpoint.WithAttr(endpoint.BlockNumber, n.head))
+	return e
+}
+
+func newTestReqctx(conf *config.Conf) reqctx.Reqctxs {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/1")
+	ctx.SetUserValue("chain", "1")
+	return reqctx.NewReqctx(ctx, conf, zerolog.Nop())
+}
+
+func TestRetryNulls(t *testing.T) {
+	receipt := map[string]any{"blockNumber": "0x6e"}
+	tests := []struct {
+		name   string
+		config map[string]any
+		method string
+		// 各节点的调用次数
+		calls [3]int32
+		found bool
+	}{
+		// 直接在已知高度最高的节点上重试
+		{"retry", map[string]any{}, "eth_getTransactionReceipt", [3]int32{1, 0, 1}, true},
+		{"not retryable", map[string]any{}, "eth_call", [3]int32{1, 0, 0}, false},
+		{"disabled", map[string]any{"jsonrpc.retry_null.disable": true}, "eth_getTransactionReceipt", [3]int32{1, 0, 0}, false},
+		{"methods", map[string]any{"jsonrpc.retry_null.methods": []string{"eth_call"}}, "eth_call", [3]int32{1, 0, 1}, true},
+	}
+
+	for _, test := range tests {
+		nodes := []*fakeNode{newFakeNode(t, 100, nil), newFakeNode(t, 105, nil), newFakeNode(t, 110, receipt)}
+		endpoints := []*endpoint.Endpoint{nodes[0].endpoint(), nodes[1].endpoint(), nodes[2].endpoint()}
+		conf := newConfig(test.config)
+		c := NewClient(endpoint.NewClientFactory(&endpoint.ClientFactoryConfig{ClientsSize: 4, Transport: &http.Transport{}}), conf)
+
+		rc := newTestReqctx(conf)
+		results, err := c.Request(context.Background(), rc, endpoints, []rpc.SealedJSONRPC{{Version: "2.0", ID: "1", Method: test.method, Params: []any{"0xabc"}}})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if found := results[0].Result() != nil; found != test.found {
+			t.Errorf("%s: expected found %v, got %v", test.name, test.found, results[0].Result())
+		}
+		for i := range nodes {
+			if n := nodes[i].calls.Load(); n != test.calls[i] {
+				t.Errorf("%s: expected %d calls of node %d, got %d", test.name, test.calls[i], i, n)
+			}
+		}
+		// 每次重试都记录在 profile 中
+		if p := rc.Profile(); len(p.Requests) != len(p.Responses) || len(p.Requests) != int(test.calls[0]+test.calls[1]+test.calls[2]) {
+			t.Errorf("%s: unexpected profile %d requests, %d responses", test.name, len(p.Requests), len(p.Responses))
+		}
+	}
+}
+
+func TestRetryNullsHigherOnly(t *testing.T) {
+	// 其它节点不比已请求的节点高时不重试
+	nodes := []*fakeNode{newFakeNode(t, 110, nil), newFakeNode(t, 105, map[string]any{})}
+	endpoints := []*endpoint.Endpoint{nodes[0].endpoint(), nodes[1].endpoint()}
+	conf := newConfig(map[string]any{})
+	c := NewClient(endpoint.NewClientFactory(&endpoint.ClientFactoryConfig{ClientsSize: 4, Transport: &http.Transport{}}), conf)
+
+	results, err := c.Request(context.Background(), newTestReqctx(conf), endpoints, []rpc.SealedJSONRPC{{Version: "2.0", ID: "1", Method: "eth_getBlockByHash", Params: []any{"0xabc", false}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Result() != nil || nodes[1].calls.Load() != 0 {
+		t.Errorf("expected no retry, got %v %d", results[0].Result(), nodes[1].calls.Load())
+	}
+}
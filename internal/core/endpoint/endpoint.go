@@ -48,6 +48,9 @@ func NewWithInfo(info *common.EndpointInfo) (*Endpoint, error) {
 	} else {
 		e.state[Weight] = 0
 	}
+	if info.LogsRange != nil {
+		e.state[LogsRange] = *info.LogsRange
+	}
 	return e, nil
 }
 
@@ -67,6 +70,7 @@ const (
 	Url            EndpointAttribute = "url"
 	Headers        EndpointAttribute = "headers"
 	Weight         EndpointAttribute = "weight"
+	LogsRange      EndpointAttribute = "logs_range"
 )
 
 func (e *Endpoint) Read(name EndpointAttribute) any {
@@ -168,6 +172,9 @@ func (e *Endpoint) Headers() map[string]string {
 func (e *Endpoint) Weight() int {
 	return _int(e.Read(Weight))
 }
+func (e *Endpoint) LogsRange() uint64 {
+	return _uint64(e.Read(LogsRange))
+}
 func (e *Endpoint) String() string {
 	return fmt.Sprintf("[%d %s]", e.ChainID(), e.Url())
 }
@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"slices"
 
+	"github.com/DODOEX/web3rpcproxy/internal/app/shared"
 	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
 	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
 	"github.com/DODOEX/web3rpcproxy/utils/helpers"
@@ -52,18 +53,26 @@ const (
 
 type Selector interface {
 	Select(ctx context.Context, rc reqctx.Reqctxs, endpoints []*Endpoint, jsonrpcs []rpc.JSONRPCer) ([]*Endpoint, bool)
+	// 记录接收交易的节点，短时间内按 keys（发送者地址、交易哈希）查询时优先选择这些节点
+	Stick(ctx context.Context, rc reqctx.Reqctxs, keys []string, endpoints []*Endpoint)
 }
 
 type selector struct {
 	heightenResponseTime *HeightenResponseTime
+	stickiness           *stickiness
 }
 
-func NewSelector() Selector {
+func NewSelector(redis *shared.RedisClient) Selector {
 	return &selector{
 		heightenResponseTime: &HeightenResponseTime{},
+		stickiness:           &stickiness{redis: redis},
 	}
 }
 
+func (s *selector) Stick(ctx context.Context, rc reqctx.Reqctxs, keys []string, endpoints []*Endpoint) {
+	s.stickiness.stick(ctx, rc, keys, endpoints)
+}
+
 func (s *selector) getArranger() arranger {
 	return s.heightenResponseTime
 }
@@ -142,6 +151,9 @@ func (s *selector) Select(ctx context.Context, rc reqctx.Reqctxs, endpoints []*E
 		_endpoints = arranged
 	}
 
+	// 发送交易后的查询优先使用接收交易的节点，避免节点未同步该交易
+	_endpoints = s.stickiness.prefer(ctx, rc, _endpoints, jsonrpcs)
+
 	return _endpoints, true
 }
 
@@ -0,0 +1,147 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/app/shared"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+// 发送交易后的后续查询，按参数中的地址或交易哈希优先使用接收交易的节点
+var stickyMethods = map[string]bool{
+	"eth_getTransactionCount":   true,
+	"eth_getTransactionReceipt": true,
+	"eth_getTransactionByHash":  true,
+}
+
+// 记录接收交易的节点，按租户、链、发送者地址或交易哈希区分；
+// 记录保存在 redis 中，所有实例共享，没有连接 redis 时不粘滞
+type stickiness struct {
+	redis *shared.RedisClient
+}
+
+func _StickyKey(rc reqctx.Reqctxs, key string) string {
+	return helpers.Concat("sticky#", rc.AppKey(), ":", fmt.Sprint(rc.ChainID()), ":", strings.ToLower(key))
+}
+
+// 粘滞的时长，为 0 时不粘滞
+func stickyDuration(rc reqctx.Reqctxs) time.Duration {
+	if rc.Config() == nil {
+		return 0
+	}
+	return rc.Config().Duration("agent.sticky-duration", 30*time.Second)
+}
+
+func (s *stickiness) client() *redis.Client {
+	if s.redis == nil {
+		return nil
+	}
+	return s.redis.Client
+}
+
+func (s *stickiness) stick(ctx context.Context, rc reqctx.Reqctxs, keys []string, endpoints []*Endpoint) {
+	d := stickyDuration(rc)
+	client := s.client()
+	if d <= 0 || len(endpoints) <= 0 || client == nil {
+		return
+	}
+
+	urls := make([]string, 0, len(endpoints))
+	for i := range endpoints {
+		urls = append(urls, endpoints[i].Url().String())
+	}
+	b, err := json.Marshal(urls)
+	if err != nil {
+		return
+	}
+
+	pipeline := client.Pipeline()
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		pipeline.Set(ctx, _StickyKey(rc, key), b, d)
+	}
+	if _, err := pipeline.Exec(ctx); err != nil {
+		rc.Logger().Warn().Err(err).Msg("Failed to stick endpoints")
+	}
+}
+
+// 返回请求应优先使用的节点 url
+func (s *stickiness) lookup(ctx context.Context, rc reqctx.Reqctxs, jsonrpcs []rpc.JSONRPCer) []string {
+	client := s.client()
+	if client == nil || stickyDuration(rc) <= 0 {
+		return nil
+	}
+
+	keys := []string{}
+	for _, jsonrpc := range jsonrpcs {
+		if !stickyMethods[jsonrpc.Method()] || len(jsonrpc.Params()) <= 0 {
+			continue
+		}
+		if key, _ := jsonrpc.Params()[0].(string); key != "" {
+			keys = append(keys, _StickyKey(rc, key))
+		}
+	}
+	if len(keys) <= 0 {
+		return nil
+	}
+
+	values, err := client.MGet(ctx, keys...).Result()
+	if err != nil {
+		rc.Logger().Warn().Err(err).Msg("Failed to look up sticky endpoints")
+		return nil
+	}
+
+	var urls []string
+	for _, v := range values {
+		raw, ok := v.(string)
+		if !ok {
+			continue
+		}
+		_urls := []string{}
+		if err := json.Unmarshal([]byte(raw), &_urls); err != nil {
+			continue
+		}
+		for _, url := range _urls {
+			if !slices.Contains(urls, url) {
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// 将健康的粘滞节点移到最前面，其余节点保持原来的顺序用于重试；
+// 只在筛选后的节点中选择，不会绕过节点类型的筛选
+func (s *stickiness) prefer(ctx context.Context, rc reqctx.Reqctxs, arranged []*Endpoint, jsonrpcs []rpc.JSONRPCer) []*Endpoint {
+	urls := s.lookup(ctx, rc, jsonrpcs)
+	if len(urls) <= 0 {
+		return arranged
+	}
+
+	sticky := make([]*Endpoint, 0, len(urls))
+	for _, url := range urls {
+		if i := slices.IndexFunc(arranged, func(e *Endpoint) bool {
+			return e.Url().String() == url
+		}); i >= 0 && arranged[i].Health() {
+			sticky = append(sticky, arranged[i])
+		}
+	}
+	if len(sticky) <= 0 {
+		return arranged
+	}
+
+	rest := slices.DeleteFunc(slices.Clone(arranged), func(e *Endpoint) bool {
+		return slices.Contains(sticky, e)
+	})
+	return append(sticky, rest...)
+}
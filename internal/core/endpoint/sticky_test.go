@@ -0,0 +1,62 @@
+package endpoint
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/app/shared"
+	"github.com/DODOEX/web3rpcproxy/internal/core/reqctx"
+	"github.com/DODOEX/web3rpcproxy/internal/core/rpc"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/go-redis/redismock/v9"
+	"github.com/knadh/koanf/v2"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+func newTestEndpoint(s string) *Endpoint {
+	u, _ := url.Parse(s)
+	return New(u)
+}
+
+func TestStickiness(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/1")
+	ctx.SetUserValue("chain", "1")
+	rc := reqctx.NewReqctx(ctx, &config.Conf{Koanf: koanf.New(".")}, zerolog.Nop())
+
+	rdb, mock := redismock.NewClientMock()
+	s := &stickiness{redis: &shared.RedisClient{Client: rdb}}
+	a, b, c := newTestEndpoint("http://a"), newTestEndpoint("http://b"), newTestEndpoint("http://c")
+
+	// 记录保存在 redis 中，按粘滞时长过期
+	mock.ExpectSet("sticky#:1:0xsender", []byte(`["http://a","http://c"]`), 30*time.Second).SetVal("OK")
+	mock.ExpectSet("sticky#:1:0xhash", []byte(`["http://a","http://c"]`), 30*time.Second).SetVal("OK")
+	s.stick(context.Background(), rc, []string{"0xSender", "0xHash"}, []*Endpoint{a, c})
+
+	// 接收交易的节点 a 不在筛选后的节点中，不会被选中
+	mock.ExpectMGet("sticky#:1:0xsender").SetVal([]any{`["http://a","http://c"]`})
+	jsonrpcs := []rpc.JSONRPCer{rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "eth_getTransactionCount", "params": []any{"0xsender", "latest"}})}
+	if arranged := s.prefer(context.Background(), rc, []*Endpoint{b, c}, jsonrpcs); len(arranged) != 2 || arranged[0] != c || arranged[1] != b {
+		t.Errorf("expected c, b, got %v", arranged)
+	}
+
+	// 没有记录时保持原来的顺序
+	mock.ExpectMGet("sticky#:1:0xother").SetVal([]any{nil})
+	jsonrpcs = []rpc.JSONRPCer{rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "eth_getTransactionReceipt", "params": []any{"0xother"}})}
+	if arranged := s.prefer(context.Background(), rc, []*Endpoint{b, c}, jsonrpcs); len(arranged) != 2 || arranged[0] != b {
+		t.Errorf("expected b, c, got %v", arranged)
+	}
+
+	// 其它方法不查询
+	jsonrpcs = []rpc.JSONRPCer{rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "eth_getBalance", "params": []any{"0xsender", "latest"}})}
+	if arranged := s.prefer(context.Background(), rc, []*Endpoint{b, c}, jsonrpcs); arranged[0] != b {
+		t.Errorf("expected b first, got %v", arranged)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
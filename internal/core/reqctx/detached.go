@@ -0,0 +1,138 @@
+package reqctx
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DODOEX/web3rpcproxy/internal/common"
+	"github.com/DODOEX/web3rpcproxy/utils/config"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+// 脱离原始请求的上下文，用于请求结束后仍需执行的后台任务（如缓存刷新）；
+// fasthttp 会复用 RequestCtx，所以这里需要复制所有用到的请求数据
+type detached struct {
+	logger    zerolog.Logger
+	reqId     string
+	chainId   common.ChainId
+	body      []byte
+	queryArgs *fasthttp.Args
+	appKey    string
+	appBucket string
+	app       *common.App
+	config    *config.Conf
+	options   Options
+	profile   *common.QueryProfile
+	mu        sync.Mutex
+}
+
+func Detach(rc Reqctxs) Reqctxs {
+	d := &detached{
+		logger:    *rc.Logger(),
+		reqId:     rc.ReqID(),
+		chainId:   rc.ChainID(),
+		body:      append([]byte{}, *rc.Body()...),
+		queryArgs: &fasthttp.Args{},
+		appKey:    rc.AppKey(),
+		appBucket: rc.AppBucket(),
+		app:       rc.App(),
+		config:    rc.Config(),
+		profile: &common.QueryProfile{
+			ID:        rc.ReqID(),
+			ChainID:   rc.ChainID(),
+			Starttime: time.Now().UnixMilli(),
+			Requests:  []common.RequestProfile{},
+			Responses: []common.ResponseProfile{},
+		},
+	}
+	rc.QueryArgs().CopyTo(d.queryArgs)
+	return d
+}
+
+func (d *detached) Logger() *zerolog.Logger {
+	return &d.logger
+}
+
+func (d *detached) ReqID() string {
+	return d.reqId
+}
+
+func (d *detached) ChainID() common.ChainId {
+	return d.chainId
+}
+
+func (d *detached) Body() *[]byte {
+	return &d.body
+}
+
+func (d *detached) Options() Options {
+	if d.options == nil {
+		d.options = NewOptions(d, d.app)
+	}
+	return d.options
+}
+
+func (d *detached) Config() *config.Conf {
+	return d.config
+}
+
+// 后台任务不需要请求头
+func (d *detached) Header(key string) string {
+	return ""
+}
+
+func (d *detached) QueryArgs() *fasthttp.Args {
+	return d.queryArgs
+}
+
+func (d *detached) AppKey() string {
+	return d.appKey
+}
+
+func (d *detached) AppBucket() string {
+	return d.appBucket
+}
+
+func (d *detached) App() *common.App {
+	return d.app
+}
+
+func (d *detached) SetApp(app *common.App) {
+	d.app = app
+}
+
+func (d *detached) Profile() *common.QueryProfile {
+	return d.profile
+}
+
+func (d *detached) AddRequestProfile(p common.RequestProfile) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.profile.Requests = append(d.profile.Requests, p)
+}
+
+func (d *detached) AddResponseProfile(p common.ResponseProfile) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.profile.Responses = append(d.profile.Responses, p)
+}
+
+// 后台任务没有客户端，忽略响应头
+func (d *detached) SetResponseHeader(key, value string) {}
+
+func (d *detached) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (d *detached) Done() <-chan struct{} {
+	return nil
+}
+
+func (d *detached) Err() error {
+	return nil
+}
+
+func (d *detached) Value(key any) any {
+	return nil
+}
@@ -1,10 +1,14 @@
 package reqctx
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"net"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/DODOEX/web3rpcproxy/internal/app/shared"
@@ -26,11 +30,16 @@ type Reqctxs interface {
 	Options() Options
 	Config() *config.Conf
 	QueryArgs() *fasthttp.Args
+	Header(key string) string
 	AppKey() string
 	AppBucket() string
 	App() *common.App
 	SetApp(app *common.App)
 	Profile() *common.QueryProfile
+	// 记录向节点发出的请求与收到的响应，同一请求的多个分段可能并发调用
+	AddRequestProfile(p common.RequestProfile)
+	AddResponseProfile(p common.ResponseProfile)
+	SetResponseHeader(key, value string)
 	Deadline() (deadline time.Time, ok bool)
 	Done() <-chan struct{}
 	Err() error
@@ -45,7 +54,9 @@ type reqctx struct {
 	config     *config.Conf
 	options    Options
 	profile    *common.QueryProfile
-	uuid       string
+	// 保护 profile 中的 Requests、Responses
+	mu   sync.Mutex
+	uuid string
 }
 
 func NewReqctx(requestCtx *fasthttp.RequestCtx, cfg *config.Conf, logger zerolog.Logger) Reqctxs {
@@ -65,21 +76,45 @@ func NewReqctx(requestCtx *fasthttp.RequestCtx, cfg *config.Conf, logger zerolog
 	rc.profile.ID = rc.ReqID()
 	rc.profile.Method = string(requestCtx.Method())
 	rc.profile.Href = string(requestCtx.RequestURI())
-	if v := requestCtx.Request.Header.Peek("cf-connecting-ip"); len(v) > 0 {
-		rc.profile.IP = string(v)
-	} else if v := requestCtx.Request.Header.Peek("true-client-ip"); len(v) > 0 {
-		rc.profile.IP = string(v)
-	} else {
-		rc.profile.IP = requestCtx.RemoteIP().String()
-	}
-	if v := requestCtx.Request.Header.Peek("cf-ipcountry"); len(v) > 0 {
-		rc.profile.IPCountry = string(v)
+	rc.profile.IP = requestCtx.RemoteIP().String()
+	// 只有来自可信代理的请求才使用代理传递的客户端 IP 与国家，否则可以伪造
+	if trustedProxy(cfg, requestCtx.RemoteIP()) {
+		if v := requestCtx.Request.Header.Peek("cf-connecting-ip"); len(v) > 0 {
+			rc.profile.IP = string(v)
+		} else if v := requestCtx.Request.Header.Peek("true-client-ip"); len(v) > 0 {
+			rc.profile.IP = string(v)
+		}
+		if v := requestCtx.Request.Header.Peek("cf-ipcountry"); len(v) > 0 {
+			rc.profile.IPCountry = string(v)
+		}
 	}
 	rc.profile.ChainID = rc.ChainID()
 
 	return rc
 }
 
+// 可信代理的 IP 或 CIDR，配置在 app.trusted-proxies
+func trustedProxy(cfg *config.Conf, ip net.IP) bool {
+	if cfg == nil {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, r := range cfg.Strings("app.trusted-proxies") {
+		if strings.Contains(r, "/") {
+			if prefix, err := netip.ParsePrefix(r); err == nil && prefix.Contains(addr) {
+				return true
+			}
+		} else if v, err := netip.ParseAddr(r); err == nil && v.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *reqctx) App() *common.App {
 	return c.app
 }
@@ -98,6 +133,18 @@ func (c *reqctx) SetApp(app *common.App) {
 	}
 }
 
+func (c *reqctx) AddRequestProfile(p common.RequestProfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.profile.Requests = append(c.profile.Requests, p)
+}
+
+func (c *reqctx) AddResponseProfile(p common.ResponseProfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.profile.Responses = append(c.profile.Responses, p)
+}
+
 func (c *reqctx) Logger() *zerolog.Logger {
 	return &c.logger
 }
@@ -122,6 +169,10 @@ func (c *reqctx) AppBucket() string {
 	return "default"
 }
 
+func (c *reqctx) Header(key string) string {
+	return string(c.requestCtx.Request.Header.Peek(key))
+}
+
 func (c *reqctx) QueryArgs() *fasthttp.Args {
 	return c.requestCtx.Request.URI().QueryArgs()
 }
@@ -180,6 +231,11 @@ func (c *reqctx) Profile() *common.QueryProfile {
 	return c.profile
 }
 
+// 设置返回给客户端的响应头
+func (c *reqctx) SetResponseHeader(key, value string) {
+	c.requestCtx.Response.Header.Set(key, value)
+}
+
 func (c *reqctx) Deadline() (deadline time.Time, ok bool) {
 	return c.requestCtx.Deadline()
 
@@ -250,6 +306,8 @@ type Options interface {
 	Secret() (*string, error)
 	EndpointTypes() []EndpointType
 	AttemptStrategy() RetryStrategy
+	PrivateRelays() (relays []string, enabled bool)
+	PrivateFallback() bool
 	ToProfile() common.OptionsProfile
 }
 
@@ -281,14 +339,41 @@ func (o *Option) AgreeConverging() bool {
 func (o *Option) AgreeMultiCall() bool {
 	return false
 }
+
+// 读取租户的白名单配置，未配置时返回 nil 表示不限制
+func (o *Option) allowlist(path string) []string {
+	app := o.tenant()
+	if app == nil {
+		return nil
+	}
+	return app.PreferenceStrings(path)
+}
+
+func (o *Option) tenant() *common.App {
+	if o.app != nil {
+		return o.app
+	}
+	// 解析租户之前可能已经创建了 Options
+	return o.reqctx.App()
+}
+
+// 允许访问的链，链 ID 或链代码
 func (o *Option) AllowChainIDs() []string {
-	return nil
+	return o.allowlist("allowlist.chains")
 }
+
+// 允许调用的方法，支持通配符，如 eth_*
 func (o *Option) AllowMethods() []string {
-	return nil
+	return o.allowlist("allowlist.methods")
 }
+
+// 允许访问的合约地址
 func (o *Option) AllowContractAddresses() []string {
-	return nil
+	contracts := o.allowlist("allowlist.contracts")
+	for i := range contracts {
+		contracts[i] = strings.ToLower(contracts[i])
+	}
+	return contracts
 }
 
 func (o *Option) Caches() bool {
@@ -350,8 +435,16 @@ func (o *Option) EndpointTypes() []EndpointType {
 	return []EndpointType{EndpointType_Default}
 }
 
+// 租户签发 HS256 JWT 的密钥
 func (o *Option) Secret() (*string, error) {
-	return nil, nil
+	app := o.app
+	if app == nil {
+		app = o.reqctx.App()
+	}
+	if app == nil {
+		return nil, errors.New("tenant is not resolved")
+	}
+	return app.JWTSecret(), nil
 }
 
 func (o *Option) AttemptStrategy() RetryStrategy {
@@ -362,6 +455,51 @@ func (o *Option) AttemptStrategy() RetryStrategy {
 	return Rotation
 }
 
+// 交易与 bundle 只发送到私有中继，relays 为 nil 时使用链的所有中继；
+// 请求参数 private_relay=true 或 private_relay=flashbots,titan 开启，租户的 private_relay.enable 开启后请求不能关闭；
+// 租户指定了中继时，请求参数只能在其中选择
+func (o *Option) PrivateRelays() (relays []string, enabled bool) {
+	if app := o.tenant(); app != nil {
+		enabled, _ = app.Preference("private_relay.enable").(bool)
+		// 空数组与未配置相同，都表示所有中继
+		if relays = app.PreferenceStrings("private_relay.relays"); len(relays) <= 0 {
+			relays = nil
+		}
+	}
+	if o.reqctx.QueryArgs().Has("private_relay") {
+		v := string(o.reqctx.QueryArgs().Peek("private_relay"))
+		if private, err := strconv.ParseBool(v); err == nil {
+			enabled = enabled || private
+		} else if v != "" {
+			names := strings.Split(v, ",")
+			if relays != nil {
+				names = slice.Filter(names, func(_ int, name string) bool {
+					return slice.Contain(relays, name)
+				})
+			}
+			enabled, relays = true, names
+		}
+	}
+	if !enabled {
+		return nil, false
+	}
+	return relays, true
+}
+
+// 私有中继都不可用时是否允许广播到公开节点，需要明确允许；
+// 租户开启私有中继或配置了 private_relay.fallback 时，请求参数 private_fallback 只能关闭回退
+func (o *Option) PrivateFallback() bool {
+	query, err := strconv.ParseBool(string(o.reqctx.QueryArgs().Peek("private_fallback")))
+	if app := o.tenant(); app != nil {
+		enabled, _ := app.Preference("private_relay.enable").(bool)
+		fallback, ok := app.Preference("private_relay.fallback").(bool)
+		if enabled || ok {
+			return fallback && (err != nil || query)
+		}
+	}
+	return err == nil && query
+}
+
 func (o *Option) ToProfile() common.OptionsProfile {
 	beforeBlocksUseScanApi, _ := strconv.Atoi(string(o.reqctx.QueryArgs().Peek("beforeBlocksUseScanApi")))
 	beforeBlocksUseActive, _ := strconv.Atoi(string(o.reqctx.QueryArgs().Peek("beforeBlocksUseActive")))
@@ -15,6 +15,28 @@ const (
 	JSONRPC_VERSION_2 JSONRPC_Version = "2.0"
 )
 
+// JSON-RPC 错误码
+const (
+	ERROR_CODE_INVALID_REQUEST  = -32600
+	ERROR_CODE_METHOD_NOT_FOUND = -32601
+	ERROR_CODE_INVALID_PARAMS   = -32602
+	ERROR_CODE_INTERNAL         = -32603
+	// EIP-1474
+	ERROR_CODE_NOT_ALLOWED    = -32004
+	ERROR_CODE_LIMIT_EXCEEDED = -32005
+)
+
+// 代理自身返回的 JSON-RPC 错误
+type JSONRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func NewJSONRPCError(code int, message string) JSONRPCError {
+	return JSONRPCError{Code: code, Message: message}
+}
+
 type JSONRPC_Type = string
 
 const (
@@ -55,6 +77,27 @@ func UnmarshalJSONRPCs(b []byte) (jsonrpcs []JSONRPCer, batch bool, err error) {
 	}), true, nil
 }
 
+// 只解析请求的方法名，用于计费等不需要完整解析请求的场景
+func UnmarshalMethods(b []byte) (methods []string, batch bool, err error) {
+	type request struct {
+		Method string `json:"method"`
+	}
+
+	var raws []request
+	if err := json.Unmarshal(b, &raws); err != nil {
+		var raw request
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, false, err
+		}
+
+		return []string{raw.Method}, false, nil
+	}
+
+	return slice.Map(raws, func(i int, raw request) string {
+		return raw.Method
+	}), true, nil
+}
+
 // 输出给端点的格式
 type SealedJSONRPC struct {
 	Params  []any  `json:"params"`
@@ -0,0 +1,259 @@
+package rpc
+
+import (
+	"maps"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// 参数的类型，决定如何规范化
+type ParamKind int
+
+const (
+	PARAM_ANY ParamKind = iota
+	// 十六进制数值，去掉前导零
+	PARAM_QUANTITY
+	// 区块号、区块标签或 EIP-1898 区块对象
+	PARAM_BLOCK
+	// 地址，转为小写
+	PARAM_ADDRESS
+	// 哈希，转为小写
+	PARAM_HASH
+	// 任意十六进制数据，转为小写
+	PARAM_DATA
+	// 交易对象，如 eth_call 的第一个参数
+	PARAM_TX
+	// 日志过滤器，如 eth_getLogs 的第一个参数
+	PARAM_FILTER
+	// 哈希数组，如 eth_getProof 的 storage keys
+	PARAM_HASHES
+)
+
+type ParamSpec struct {
+	Kind ParamKind
+	// 省略参数时节点使用的默认值，nil 表示没有默认值
+	Default any
+}
+
+// 各方法的参数说明，未列出的方法不做规范化
+var normalizers = map[string][]ParamSpec{
+	"eth_getBalance":                          {{Kind: PARAM_ADDRESS}, {Kind: PARAM_BLOCK, Default: "latest"}},
+	"eth_getCode":                             {{Kind: PARAM_ADDRESS}, {Kind: PARAM_BLOCK, Default: "latest"}},
+	"eth_getTransactionCount":                 {{Kind: PARAM_ADDRESS}, {Kind: PARAM_BLOCK, Default: "latest"}},
+	"eth_getStorageAt":                        {{Kind: PARAM_ADDRESS}, {Kind: PARAM_QUANTITY}, {Kind: PARAM_BLOCK, Default: "latest"}},
+	"eth_call":                                {{Kind: PARAM_TX}, {Kind: PARAM_BLOCK, Default: "latest"}},
+	"eth_estimateGas":                         {{Kind: PARAM_TX}, {Kind: PARAM_BLOCK}},
+	"eth_getProof":                            {{Kind: PARAM_ADDRESS}, {Kind: PARAM_HASHES}, {Kind: PARAM_BLOCK, Default: "latest"}},
+	"eth_getBlockByNumber":                    {{Kind: PARAM_BLOCK}, {Kind: PARAM_ANY, Default: false}},
+	"eth_getBlockByHash":                      {{Kind: PARAM_HASH}, {Kind: PARAM_ANY, Default: false}},
+	"eth_getBlockReceipts":                    {{Kind: PARAM_BLOCK}},
+	"eth_getBlockTransactionCountByNumber":    {{Kind: PARAM_BLOCK}},
+	"eth_getBlockTransactionCountByHash":      {{Kind: PARAM_HASH}},
+	"eth_getUncleCountByBlockNumber":          {{Kind: PARAM_BLOCK}},
+	"eth_getUncleCountByBlockHash":            {{Kind: PARAM_HASH}},
+	"eth_getTransactionByHash":                {{Kind: PARAM_HASH}},
+	"eth_getTransactionReceipt":               {{Kind: PARAM_HASH}},
+	"eth_getTransactionByBlockHashAndIndex":   {{Kind: PARAM_HASH}, {Kind: PARAM_QUANTITY}},
+	"eth_getTransactionByBlockNumberAndIndex": {{Kind: PARAM_BLOCK}, {Kind: PARAM_QUANTITY}},
+	"eth_getUncleByBlockHashAndIndex":         {{Kind: PARAM_HASH}, {Kind: PARAM_QUANTITY}},
+	"eth_getUncleByBlockNumberAndIndex":       {{Kind: PARAM_BLOCK}, {Kind: PARAM_QUANTITY}},
+	"eth_getLogs":                             {{Kind: PARAM_FILTER}},
+	"eth_feeHistory":                          {{Kind: PARAM_QUANTITY}, {Kind: PARAM_BLOCK}},
+}
+
+// 交易对象中各字段的类型
+var txFields = map[string]ParamKind{
+	"from":                 PARAM_ADDRESS,
+	"to":                   PARAM_ADDRESS,
+	"gas":                  PARAM_QUANTITY,
+	"gasPrice":             PARAM_QUANTITY,
+	"maxFeePerGas":         PARAM_QUANTITY,
+	"maxPriorityFeePerGas": PARAM_QUANTITY,
+	"value":                PARAM_QUANTITY,
+	"nonce":                PARAM_QUANTITY,
+	"data":                 PARAM_DATA,
+	"input":                PARAM_DATA,
+}
+
+// 规范化 jsonrpc 的参数，返回新的 jsonrpc，不修改原请求；
+// 不改变请求的语义，只统一数值、地址、哈希的写法，并补全默认参数
+func Normalize(req JSONRPCer) JSONRPCer {
+	if _, ok := normalizers[req.Method()]; !ok {
+		return req
+	}
+
+	raw := maps.Clone(req.Raw())
+	raw["params"] = NormalizeParams(req.Method(), req.Params())
+	return NewJSONRPC(raw)
+}
+
+func NormalizeParams(method string, params []any) []any {
+	specs, ok := normalizers[method]
+	if !ok {
+		return params
+	}
+
+	_params := make([]any, 0, max(len(params), len(specs)))
+	for i := range params {
+		if i < len(specs) {
+			_params = append(_params, normalizeParam(specs[i].Kind, params[i]))
+		} else {
+			_params = append(_params, params[i])
+		}
+	}
+	// 补全省略的默认参数，中间缺失的参数无法补全
+	for i := len(params); i < len(specs) && specs[i].Default != nil; i++ {
+		_params = append(_params, specs[i].Default)
+	}
+	return _params
+}
+
+func normalizeParam(kind ParamKind, v any) any {
+	switch kind {
+	case PARAM_QUANTITY:
+		return normalizeQuantity(v)
+	case PARAM_BLOCK:
+		return normalizeBlock(v)
+	case PARAM_ADDRESS, PARAM_HASH, PARAM_DATA:
+		return normalizeHex(v)
+	case PARAM_HASHES:
+		if items, ok := v.([]any); ok {
+			_items := make([]any, len(items))
+			for i := range items {
+				_items[i] = normalizeHex(items[i])
+			}
+			return _items
+		}
+	case PARAM_TX:
+		if tx, ok := v.(map[string]any); ok {
+			_tx := make(map[string]any, len(tx))
+			for k, value := range tx {
+				if kind, ok := txFields[k]; ok {
+					value = normalizeParam(kind, value)
+				}
+				_tx[k] = value
+			}
+			return _tx
+		}
+	case PARAM_FILTER:
+		if filter, ok := v.(map[string]any); ok {
+			return normalizeFilter(filter)
+		}
+	}
+	return v
+}
+
+func isHex(s string) bool {
+	if len(s) < 2 || s[0] != '0' || (s[1] != 'x' && s[1] != 'X') {
+		return false
+	}
+	for _, c := range s[2:] {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// 0x01 => 0x1，0x00 => 0x0
+func normalizeQuantity(v any) any {
+	s, ok := v.(string)
+	if !ok || !isHex(s) || len(s) <= 2 {
+		return v
+	}
+	n, ok := new(big.Int).SetString(s[2:], 16)
+	if !ok {
+		return v
+	}
+	return "0x" + n.Text(16)
+}
+
+func normalizeHex(v any) any {
+	if s, ok := v.(string); ok && isHex(s) {
+		return strings.ToLower(s)
+	}
+	return v
+}
+
+// 区块标签保持原样，区块号去掉前导零，EIP-1898 对象中的哈希转为小写
+func normalizeBlock(v any) any {
+	switch block := v.(type) {
+	case string:
+		return normalizeQuantity(block)
+	case map[string]any:
+		_block := maps.Clone(block)
+		if h, ok := _block["blockHash"]; ok {
+			_block["blockHash"] = normalizeHex(h)
+		}
+		if n, ok := _block["blockNumber"]; ok {
+			_block["blockNumber"] = normalizeQuantity(n)
+		}
+		return _block
+	}
+	return v
+}
+
+func normalizeFilter(filter map[string]any) map[string]any {
+	_filter := maps.Clone(filter)
+	if _filter["blockHash"] != nil {
+		_filter["blockHash"] = normalizeHex(_filter["blockHash"])
+	} else {
+		// 节点默认使用 latest
+		for _, k := range []string{"fromBlock", "toBlock"} {
+			if _filter[k] == nil {
+				_filter[k] = "latest"
+			} else {
+				_filter[k] = normalizeBlock(_filter[k])
+			}
+		}
+	}
+
+	// 地址列表与顺序无关，排序并去重
+	switch address := _filter["address"].(type) {
+	case string:
+		_filter["address"] = normalizeHex(address)
+	case []any:
+		addresses := []string{}
+		for i := range address {
+			if s, ok := normalizeHex(address[i]).(string); ok {
+				addresses = append(addresses, s)
+			} else {
+				addresses = nil
+				break
+			}
+		}
+		if addresses != nil {
+			slices.Sort(addresses)
+			addresses = slices.Compact(addresses)
+			_address := make([]any, len(addresses))
+			for i := range addresses {
+				_address[i] = addresses[i]
+			}
+			_filter["address"] = _address
+		}
+	}
+
+	// topics 的位置有意义，只转为小写，并去掉末尾的 null
+	if topics, ok := _filter["topics"].([]any); ok {
+		_topics := make([]any, len(topics))
+		for i := range topics {
+			switch topic := topics[i].(type) {
+			case []any:
+				_topic := make([]any, len(topic))
+				for j := range topic {
+					_topic[j] = normalizeHex(topic[j])
+				}
+				_topics[i] = _topic
+			default:
+				_topics[i] = normalizeHex(topic)
+			}
+		}
+		for len(_topics) > 0 && _topics[len(_topics)-1] == nil {
+			_topics = _topics[:len(_topics)-1]
+		}
+		_filter["topics"] = _topics
+	}
+
+	return _filter
+}
@@ -0,0 +1,61 @@
+package rpc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeParams(t *testing.T) {
+	tests := []struct {
+		method   string
+		params   []any
+		expected []any
+	}{
+		// 补全默认的区块参数
+		{"eth_getBalance", []any{"0xABCdef"}, []any{"0xabcdef", "latest"}},
+		{"eth_getBalance", []any{"0xabcdef", "0x00ff"}, []any{"0xabcdef", "0xff"}},
+		{"eth_getBalance", []any{"0xabcdef", "pending"}, []any{"0xabcdef", "pending"}},
+		{"eth_getStorageAt", []any{"0xAB", "0x0000"}, []any{"0xab", "0x0", "latest"}},
+		// 没有默认值的参数不补全
+		{"eth_estimateGas", []any{map[string]any{"to": "0xAB"}}, []any{map[string]any{"to": "0xab"}}},
+		{"eth_getBlockByNumber", []any{"0x01"}, []any{"0x1", false}},
+		{"eth_getBlockByHash", []any{"0xABC", true}, []any{"0xabc", true}},
+		// EIP-1898 区块对象
+		{"eth_call", []any{map[string]any{"to": "0xAB", "data": "0xDEAD", "value": "0x0010", "other": "0xAA"}, map[string]any{"blockHash": "0xABC", "requireCanonical": true}},
+			[]any{map[string]any{"to": "0xab", "data": "0xdead", "value": "0x10", "other": "0xAA"}, map[string]any{"blockHash": "0xabc", "requireCanonical": true}}},
+		{"eth_getProof", []any{"0xAB", []any{"0xCD", "0xEF"}, "0x10"}, []any{"0xab", []any{"0xcd", "0xef"}, "0x10"}},
+		// 地址排序去重，topics 去掉末尾的 null
+		{"eth_getLogs", []any{map[string]any{"address": []any{"0xBB", "0xaa", "0xbb"}, "topics": []any{"0xAA", nil, []any{"0xBB", nil}, nil}}},
+			[]any{map[string]any{"fromBlock": "latest", "toBlock": "latest", "address": []any{"0xaa", "0xbb"}, "topics": []any{"0xaa", nil, []any{"0xbb", nil}}}}},
+		{"eth_getLogs", []any{map[string]any{"blockHash": "0xABC", "address": "0xAB"}}, []any{map[string]any{"blockHash": "0xabc", "address": "0xab"}}},
+		{"eth_getLogs", []any{map[string]any{"fromBlock": "0x01", "toBlock": "earliest"}}, []any{map[string]any{"fromBlock": "0x1", "toBlock": "earliest"}}},
+		// 非十六进制的值保持原样
+		{"eth_getTransactionByHash", []any{"ABC"}, []any{"ABC"}},
+		{"eth_getBlockByNumber", []any{"0xzz"}, []any{"0xzz", false}},
+		{"eth_getBlockByNumber", []any{float64(1)}, []any{float64(1), false}},
+		// 多余的参数保持原样
+		{"eth_getTransactionReceipt", []any{"0xAB", "0xCD"}, []any{"0xab", "0xCD"}},
+		// 未列出的方法不做规范化
+		{"eth_sendRawTransaction", []any{"0xABCD"}, []any{"0xABCD"}},
+	}
+
+	for _, test := range tests {
+		if params := NormalizeParams(test.method, test.params); !reflect.DeepEqual(params, test.expected) {
+			t.Errorf("%s %v: expected %v, got %v", test.method, test.params, test.expected, params)
+		}
+	}
+}
+
+func TestNormalizeKeepsRequest(t *testing.T) {
+	filter := map[string]any{"address": []any{"0xBB", "0xAA"}}
+	req := NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "eth_getLogs", "params": []any{filter}})
+
+	normalized := Normalize(req)
+	if addresses := normalized.Params()[0].(map[string]any)["address"].([]any); addresses[0] != "0xaa" {
+		t.Errorf("expected normalized addresses, got %v", addresses)
+	}
+	// 不修改原请求
+	if filter["address"].([]any)[0] != "0xBB" || filter["fromBlock"] != nil || len(req.Params()) != 1 {
+		t.Errorf("expected request unchanged, got %v", req.Raw())
+	}
+}
@@ -0,0 +1,331 @@
+package rpc
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/sha3"
+)
+
+// 交易类型
+const (
+	TX_TYPE_LEGACY     uint8 = 0x00
+	TX_TYPE_ACCESS     uint8 = 0x01 // EIP-2930
+	TX_TYPE_DYNAMICFEE uint8 = 0x02 // EIP-1559
+	TX_TYPE_BLOB       uint8 = 0x03 // EIP-4844
+	TX_TYPE_SETCODE    uint8 = 0x04 // EIP-7702
+)
+
+var ErrInvalidRLP = errors.New("invalid rlp")
+
+// eth_sendRawTransaction 中解码出的交易
+type RawTransaction struct {
+	Type      uint8
+	ChainID   *big.Int // legacy 交易未使用 EIP-155 时为 nil
+	Nonce     uint64
+	GasPrice  *big.Int // legacy、EIP-2930 交易
+	GasTipCap *big.Int // EIP-1559 及之后的交易
+	GasFeeCap *big.Int // EIP-1559 及之后的交易
+	Gas       uint64
+	To        string // 0x 开头的小写地址，创建合约时为空
+	Value     *big.Int
+	Data      []byte
+	V, R, S   *big.Int
+	// 原始的交易数据，不包含 EIP-4844 网络格式中的 blobs
+	Raw []byte
+	// 签名的数据
+	unsigned []byte
+}
+
+type rlpItem struct {
+	list  bool
+	data  []byte
+	items []rlpItem
+	// 包含前缀的完整编码
+	raw []byte
+}
+
+func decodeRLPLength(b []byte, n int) (int, error) {
+	if n <= 0 || n > 8 || len(b) < n || b[0] == 0 {
+		return 0, ErrInvalidRLP
+	}
+	var l uint64
+	for i := 0; i < n; i++ {
+		l = l<<8 | uint64(b[i])
+	}
+	if l > uint64(len(b)-n) {
+		return 0, ErrInvalidRLP
+	}
+	return int(l), nil
+}
+
+func decodeRLP(b []byte) (item rlpItem, rest []byte, err error) {
+	if len(b) == 0 {
+		return item, nil, ErrInvalidRLP
+	}
+
+	// 只接受规范编码，同一笔交易不同的编码会得到不同的哈希
+	var offset, size int
+	switch prefix := b[0]; {
+	case prefix < 0x80:
+		return rlpItem{data: b[:1], raw: b[:1]}, b[1:], nil
+	case prefix <= 0xb7:
+		offset, size = 1, int(prefix-0x80)
+		// 小于 0x80 的单个字节必须直接编码
+		if size == 1 && len(b) > 1 && b[1] < 0x80 {
+			return item, nil, ErrInvalidRLP
+		}
+	case prefix <= 0xbf:
+		if size, err = decodeRLPLength(b[1:], int(prefix-0xb7)); err != nil {
+			return item, nil, err
+		}
+		offset = 1 + int(prefix-0xb7)
+	case prefix <= 0xf7:
+		item.list = true
+		offset, size = 1, int(prefix-0xc0)
+	default:
+		if size, err = decodeRLPLength(b[1:], int(prefix-0xf7)); err != nil {
+			return item, nil, err
+		}
+		item.list = true
+		offset = 1 + int(prefix-0xf7)
+	}
+	// 不超过 55 字节时必须使用短格式
+	if offset > 1 && size <= 55 {
+		return item, nil, ErrInvalidRLP
+	}
+	if len(b) < offset+size {
+		return item, nil, ErrInvalidRLP
+	}
+
+	payload := b[offset : offset+size]
+	item.raw = b[:offset+size]
+	if !item.list {
+		item.data = payload
+		return item, b[offset+size:], nil
+	}
+
+	for len(payload) > 0 {
+		var child rlpItem
+		if child, payload, err = decodeRLP(payload); err != nil {
+			return item, nil, err
+		}
+		item.items = append(item.items, child)
+	}
+	return item, b[offset+size:], nil
+}
+
+// 整数不能有前导零
+func (i rlpItem) bigInt() (*big.Int, error) {
+	if i.list || len(i.data) > 32 || (len(i.data) > 0 && i.data[0] == 0) {
+		return nil, ErrInvalidRLP
+	}
+	return new(big.Int).SetBytes(i.data), nil
+}
+
+func (i rlpItem) uint64() (uint64, error) {
+	if i.list || len(i.data) > 8 || (len(i.data) > 0 && i.data[0] == 0) {
+		return 0, ErrInvalidRLP
+	}
+	var v uint64
+	for _, b := range i.data {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func (i rlpItem) address() (string, error) {
+	if i.list || (len(i.data) != 0 && len(i.data) != 20) {
+		return "", ErrInvalidRLP
+	}
+	if len(i.data) == 0 {
+		return "", nil
+	}
+	return "0x" + hex.EncodeToString(i.data), nil
+}
+
+// 解码 eth_sendRawTransaction 的参数，支持 legacy 与 EIP-2718 类型的交易
+func DecodeRawTransaction(s string) (*RawTransaction, error) {
+	if !isHex(s) {
+		return nil, errors.New("raw transaction must be hex encoded")
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("raw transaction must be hex encoded")
+	}
+
+	tx := &RawTransaction{Raw: b}
+	payload := b
+	// legacy 交易是 RLP 列表，以 0xc0 及以上开头；EIP-2718 类型为 0x01 至 0x7e
+	switch {
+	case b[0] >= 0xc0:
+	case b[0] >= 0x01 && b[0] <= 0x7e:
+		tx.Type, payload = b[0], b[1:]
+	default:
+		return nil, errors.New("invalid transaction type")
+	}
+
+	item, rest, err := decodeRLP(payload)
+	if err != nil {
+		return nil, err
+	}
+	if !item.list || len(rest) > 0 {
+		return nil, ErrInvalidRLP
+	}
+
+	// EIP-4844 网络格式：[tx_payload_body, blobs, commitments, proofs]
+	if tx.Type == TX_TYPE_BLOB && len(item.items) > 0 && item.items[0].list {
+		item = item.items[0]
+		tx.Raw = append([]byte{TX_TYPE_BLOB}, item.raw...)
+	}
+
+	// 各类型交易中字段的位置
+	var (
+		fields = item.items
+		layout []string
+	)
+	switch tx.Type {
+	case TX_TYPE_LEGACY:
+		layout = []string{"nonce", "gasPrice", "gas", "to", "value", "data", "v", "r", "s"}
+	case TX_TYPE_ACCESS:
+		layout = []string{"chainId", "nonce", "gasPrice", "gas", "to", "value", "data", "", "v", "r", "s"}
+	case TX_TYPE_DYNAMICFEE:
+		layout = []string{"chainId", "nonce", "gasTipCap", "gasFeeCap", "gas", "to", "value", "data", "", "v", "r", "s"}
+	case TX_TYPE_BLOB:
+		layout = []string{"chainId", "nonce", "gasTipCap", "gasFeeCap", "gas", "to", "value", "data", "", "", "", "v", "r", "s"}
+	case TX_TYPE_SETCODE:
+		layout = []string{"chainId", "nonce", "gasTipCap", "gasFeeCap", "gas", "to", "value", "data", "", "", "v", "r", "s"}
+	default:
+		return nil, errors.New("unsupported transaction type")
+	}
+	if len(fields) != len(layout) {
+		return nil, ErrInvalidRLP
+	}
+
+	for i, name := range layout {
+		var err error
+		switch name {
+		case "chainId":
+			tx.ChainID, err = fields[i].bigInt()
+		case "nonce":
+			tx.Nonce, err = fields[i].uint64()
+		case "gasPrice":
+			tx.GasPrice, err = fields[i].bigInt()
+		case "gasTipCap":
+			tx.GasTipCap, err = fields[i].bigInt()
+		case "gasFeeCap":
+			tx.GasFeeCap, err = fields[i].bigInt()
+		case "gas":
+			tx.Gas, err = fields[i].uint64()
+		case "to":
+			tx.To, err = fields[i].address()
+		case "value":
+			tx.Value, err = fields[i].bigInt()
+		case "data":
+			if fields[i].list {
+				err = ErrInvalidRLP
+			}
+			tx.Data = fields[i].data
+		case "v":
+			tx.V, err = fields[i].bigInt()
+		case "r":
+			tx.R, err = fields[i].bigInt()
+		case "s":
+			tx.S, err = fields[i].bigInt()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// EIP-155: v = chainId * 2 + 35/36
+	if tx.Type == TX_TYPE_LEGACY && tx.V.Cmp(big.NewInt(35)) >= 0 {
+		tx.ChainID = new(big.Int).Div(new(big.Int).Sub(tx.V, big.NewInt(35)), big.NewInt(2))
+	}
+
+	// 签名的数据为去掉 v、r、s 的字段，EIP-155 的交易追加 chainId, 0, 0
+	unsigned := []byte{}
+	for i := range fields[:len(fields)-3] {
+		unsigned = append(unsigned, fields[i].raw...)
+	}
+	if tx.Type == TX_TYPE_LEGACY {
+		if tx.ChainID != nil {
+			unsigned = append(unsigned, encodeRLPBytes(tx.ChainID.Bytes())...)
+			unsigned = append(unsigned, 0x80, 0x80)
+		}
+		tx.unsigned = encodeRLPList(unsigned)
+	} else {
+		tx.unsigned = append([]byte{tx.Type}, encodeRLPList(unsigned)...)
+	}
+
+	return tx, nil
+}
+
+func encodeRLPLength(offset byte, n int) []byte {
+	if n <= 55 {
+		return []byte{offset + byte(n)}
+	}
+	b := new(big.Int).SetInt64(int64(n)).Bytes()
+	return append([]byte{offset + 55 + byte(len(b))}, b...)
+}
+
+func encodeRLPBytes(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return b
+	}
+	return append(encodeRLPLength(0x80, len(b)), b...)
+}
+
+func encodeRLPList(payload []byte) []byte {
+	return append(encodeRLPLength(0xc0, len(payload)), payload...)
+}
+
+// 以太坊使用的 Keccak-256 哈希
+func Keccak256(b []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// 交易的哈希，0x 开头的小写十六进制
+func (tx *RawTransaction) Hash() string {
+	return "0x" + hex.EncodeToString(Keccak256(tx.Raw))
+}
+
+// secp256k1 的阶的一半，EIP-2 要求 s 不能大于该值
+var secp256k1HalfN = new(big.Int).Rsh(secp256k1.S256().N, 1)
+
+// 从签名中恢复发送者的地址，签名无效时返回错误
+func (tx *RawTransaction) Sender() (string, error) {
+	var recovery *big.Int
+	switch {
+	case tx.Type != TX_TYPE_LEGACY:
+		recovery = tx.V
+	case tx.ChainID != nil:
+		recovery = new(big.Int).Sub(tx.V, new(big.Int).Add(new(big.Int).Lsh(tx.ChainID, 1), big.NewInt(35)))
+	default:
+		recovery = new(big.Int).Sub(tx.V, big.NewInt(27))
+	}
+	if !recovery.IsUint64() || recovery.Uint64() > 1 {
+		return "", errors.New("invalid signature v")
+	}
+	if tx.R.Sign() <= 0 || tx.S.Sign() <= 0 || tx.R.Cmp(secp256k1.S256().N) >= 0 || tx.S.Cmp(secp256k1HalfN) > 0 {
+		return "", errors.New("invalid signature r, s")
+	}
+
+	// [27 + recovery, r, s]
+	sig := make([]byte, 65)
+	sig[0] = 27 + byte(recovery.Uint64())
+	tx.R.FillBytes(sig[1:33])
+	tx.S.FillBytes(sig[33:65])
+
+	pub, _, err := ecdsa.RecoverCompact(sig, Keccak256(tx.unsigned))
+	if err != nil {
+		return "", err
+	}
+	return "0x" + hex.EncodeToString(Keccak256(pub.SerializeUncompressed()[1:])[12:]), nil
+}
@@ -0,0 +1,210 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// EIP-155 中示例使用的私钥 0x4646...46 与其地址
+var (
+	testKey     = secp256k1.PrivKeyFromBytes(bytes.Repeat([]byte{0x46}, 32))
+	testAddress = "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f"
+	testTo      = "0x3535353535353535353535353535353535353535"
+)
+
+// 测试中独立实现的 RLP 编码，用于构造交易
+func rlpString(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return b
+	}
+	return append(rlpHeader(0x80, len(b)), b...)
+}
+
+func rlpUint(n uint64) []byte {
+	return rlpString(new(big.Int).SetUint64(n).Bytes())
+}
+
+func rlpList(items ...[]byte) []byte {
+	payload := bytes.Join(items, nil)
+	return append(rlpHeader(0xc0, len(payload)), payload...)
+}
+
+func rlpHeader(offset byte, n int) []byte {
+	if n <= 55 {
+		return []byte{offset + byte(n)}
+	}
+	l := new(big.Int).SetInt64(int64(n)).Bytes()
+	return append([]byte{offset + 55 + byte(len(l))}, l...)
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// 签名并返回 recovery id 与 r、s 的编码
+func sign(digest []byte) (uint64, []byte, []byte) {
+	sig := ecdsa.SignCompact(testKey, digest, false)
+	return uint64(sig[0] - 27), rlpString(new(big.Int).SetBytes(sig[1:33]).Bytes()), rlpString(new(big.Int).SetBytes(sig[33:65]).Bytes())
+}
+
+func hash(b []byte) string {
+	return "0x" + hex.EncodeToString(Keccak256(b))
+}
+
+type rawTxVector struct {
+	name string
+	raw  []byte
+	// 交易的哈希不包含 EIP-4844 网络格式中的 blobs
+	hash    string
+	typ     uint8
+	chainId int64
+}
+
+func rawTxVectors() []rawTxVector {
+	var (
+		to      = rlpString(mustHex(testTo[2:]))
+		value   = rlpUint(1e18)
+		gasTip  = rlpUint(1e9)
+		gasFee  = rlpUint(30e9)
+		chainId = rlpUint(1)
+		vectors = []rawTxVector{}
+	)
+
+	// EIP-155 规范中的示例交易
+	eip155 := mustHex("f86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a76400008025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83")
+	vectors = append(vectors, rawTxVector{"eip155 spec", eip155, hash(eip155), TX_TYPE_LEGACY, 1})
+
+	// legacy，未使用 EIP-155
+	fields := [][]byte{rlpUint(9), rlpUint(20e9), rlpUint(21000), to, value, rlpString(nil)}
+	rec, r, s := sign(Keccak256(rlpList(fields...)))
+	raw := rlpList(append(fields, rlpUint(27+rec), r, s)...)
+	vectors = append(vectors, rawTxVector{"legacy", raw, hash(raw), TX_TYPE_LEGACY, 0})
+
+	// EIP-2930
+	fields = [][]byte{chainId, rlpUint(1), rlpUint(20e9), rlpUint(30000), to, value, rlpString([]byte{0x12, 0x34}),
+		rlpList(rlpList(rlpString(mustHex(testTo[2:])), rlpList(rlpString(make([]byte, 32)))))}
+	rec, r, s = sign(Keccak256(append([]byte{TX_TYPE_ACCESS}, rlpList(fields...)...)))
+	raw = append([]byte{TX_TYPE_ACCESS}, rlpList(append(fields, rlpUint(rec), r, s)...)...)
+	vectors = append(vectors, rawTxVector{"eip2930", raw, hash(raw), TX_TYPE_ACCESS, 1})
+
+	// EIP-1559
+	fields = [][]byte{chainId, rlpUint(2), gasTip, gasFee, rlpUint(21000), to, value, rlpString(nil), rlpList()}
+	rec, r, s = sign(Keccak256(append([]byte{TX_TYPE_DYNAMICFEE}, rlpList(fields...)...)))
+	raw = append([]byte{TX_TYPE_DYNAMICFEE}, rlpList(append(fields, rlpUint(rec), r, s)...)...)
+	vectors = append(vectors, rawTxVector{"eip1559", raw, hash(raw), TX_TYPE_DYNAMICFEE, 1})
+
+	// EIP-4844 网络格式 [tx_payload_body, blobs, commitments, proofs]
+	versioned := append([]byte{0x01}, bytes.Repeat([]byte{0xab}, 31)...)
+	fields = [][]byte{chainId, rlpUint(3), gasTip, gasFee, rlpUint(21000), to, rlpUint(0), rlpString(nil), rlpList(), rlpUint(1), rlpList(rlpString(versioned))}
+	rec, r, s = sign(Keccak256(append([]byte{TX_TYPE_BLOB}, rlpList(fields...)...)))
+	body := rlpList(append(fields, rlpUint(rec), r, s)...)
+	raw = append([]byte{TX_TYPE_BLOB}, rlpList(body, rlpList(rlpString(make([]byte, 128))), rlpList(rlpString(make([]byte, 48))), rlpList(rlpString(make([]byte, 48))))...)
+	vectors = append(vectors, rawTxVector{"eip4844 network", raw, hash(append([]byte{TX_TYPE_BLOB}, body...)), TX_TYPE_BLOB, 1})
+
+	// EIP-7702
+	auth := rlpList(chainId, rlpString(mustHex(testTo[2:])), rlpUint(0), rlpUint(1), rlpUint(1), rlpUint(1))
+	fields = [][]byte{chainId, rlpUint(4), gasTip, gasFee, rlpUint(60000), to, rlpUint(0), rlpString(nil), rlpList(), rlpList(auth)}
+	rec, r, s = sign(Keccak256(append([]byte{TX_TYPE_SETCODE}, rlpList(fields...)...)))
+	raw = append([]byte{TX_TYPE_SETCODE}, rlpList(append(fields, rlpUint(rec), r, s)...)...)
+	vectors = append(vectors, rawTxVector{"eip7702", raw, hash(raw), TX_TYPE_SETCODE, 1})
+
+	return vectors
+}
+
+func TestDecodeRawTransaction(t *testing.T) {
+	for _, v := range rawTxVectors() {
+		tx, err := DecodeRawTransaction("0x" + hex.EncodeToString(v.raw))
+		if err != nil {
+			t.Errorf("%s: expected nil, got %v", v.name, err)
+			continue
+		}
+		if tx.Type != v.typ {
+			t.Errorf("%s: expected type %d, got %d", v.name, v.typ, tx.Type)
+		}
+		if (v.chainId == 0) != (tx.ChainID == nil) || (tx.ChainID != nil && tx.ChainID.Int64() != v.chainId) {
+			t.Errorf("%s: expected chain id %d, got %v", v.name, v.chainId, tx.ChainID)
+		}
+		if tx.To != testTo {
+			t.Errorf("%s: expected to %s, got %s", v.name, testTo, tx.To)
+		}
+		if h := tx.Hash(); h != v.hash {
+			t.Errorf("%s: expected hash %s, got %s", v.name, v.hash, h)
+		}
+		if sender, err := tx.Sender(); err != nil || sender != testAddress {
+			t.Errorf("%s: expected sender %s, got %s %v", v.name, testAddress, sender, err)
+		}
+	}
+}
+
+func TestDecodeRawTransactionTampered(t *testing.T) {
+	// 修改 value 后签名不再对应原发送者
+	raw := mustHex("f86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a76400008025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83")
+	raw[30] ^= 0x01
+	tx, err := DecodeRawTransaction("0x" + hex.EncodeToString(raw))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if sender, _ := tx.Sender(); sender == testAddress {
+		t.Errorf("expected a different sender for a tampered transaction")
+	}
+}
+
+func TestDecodeRawTransactionNonCanonical(t *testing.T) {
+	var (
+		to    = rlpString(mustHex(testTo[2:]))
+		value = rlpUint(1e18)
+		r     = rlpString(bytes.Repeat([]byte{0x11}, 32))
+		s     = rlpString(bytes.Repeat([]byte{0x22}, 32))
+	)
+	legacy := func(nonce, gasPrice, value []byte) []byte {
+		return rlpList(nonce, gasPrice, rlpUint(21000), to, value, rlpString(nil), rlpUint(37), r, s)
+	}
+
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		// 小于 0x80 的单个字节使用 0x81 前缀
+		{"single byte as string", legacy([]byte{0x81, 0x09}, rlpUint(20e9), value)},
+		// 不超过 55 字节的字符串使用长格式
+		{"short string in long form", legacy(rlpUint(9), rlpUint(20e9), append([]byte{0xb8, 0x08}, mustHex("0de0b6b3a7640000")...))},
+		// 整数的前导零
+		{"integer with leading zero", legacy(rlpUint(9), rlpString(mustHex("0004a817c800")), value)},
+		{"zero as 0x00", legacy([]byte{0x00}, rlpUint(20e9), value)},
+		// 不超过 55 字节的列表使用长格式
+		{"short list in long form", append([]byte{TX_TYPE_DYNAMICFEE}, rlpList(rlpUint(1), rlpUint(0), rlpUint(1), rlpUint(1), rlpUint(21000), to, value, rlpString(nil), []byte{0xf8, 0x01, 0xc0}, rlpUint(0), r, s)...)},
+		// 长度的前导零
+		{"length with leading zero", append([]byte{0xf9, 0x00, 0x6c}, legacy(rlpUint(9), rlpUint(20e9), value)[2:]...)},
+	}
+
+	// 对照：规范编码可以解码
+	if _, err := DecodeRawTransaction("0x" + hex.EncodeToString(legacy(rlpUint(9), rlpUint(20e9), value))); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, test := range tests {
+		if _, err := DecodeRawTransaction("0x" + hex.EncodeToString(test.raw)); err == nil {
+			t.Errorf("%s: expected invalid rlp", test.name)
+		}
+	}
+}
+
+func TestDecodeRawTransactionType(t *testing.T) {
+	legacy := mustHex("f86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a76400008025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83")
+
+	// 0x00 不是有效的类型，0x7f 至 0xbf 既不是类型也不是 RLP 列表
+	for _, prefix := range []byte{0x00, 0x7f, 0x80, 0xbf} {
+		raw := append([]byte{prefix}, legacy...)
+		if _, err := DecodeRawTransaction("0x" + hex.EncodeToString(raw)); err == nil {
+			t.Errorf("0x%02x: expected invalid transaction type", prefix)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package helpers
 
+import "strconv"
+
 func ToFloat(v any) (float64, bool) {
 	switch v.(type) {
 	case int:
@@ -30,3 +32,20 @@ func ToFloat(v any) (float64, bool) {
 
 	return 0.0, false
 }
+
+// 解析 0x 开头的十六进制数值，如区块高度
+func ParseHexUint64(s string) (uint64, bool) {
+	if len(s) < 3 || (s[:2] != "0x" && s[:2] != "0X") {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s[2:], 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// 格式化为 0x 开头的十六进制数值
+func FormatHexUint64(v uint64) string {
+	return "0x" + strconv.FormatUint(v, 16)
+}
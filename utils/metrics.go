@@ -55,6 +55,23 @@ var TotalCaches = prometheus.NewCounterVec(
 	[]string{"chain", "app", "method", "status"},
 )
 
+// 租户限流模式，0 为 redis，1 为 Redis 不可用时的本地限流
+var RateLimitMode = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: prefix + "rate_limit_mode",
+		Help: "Rate limit mode of tenants, 0 for redis and 1 for local fallback",
+	},
+)
+
+// 被拦截的调用数，by 为拦截的来源，如 firewall、allowlist
+var TotalIntercepts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: prefix + "total_intercepts",
+		Help: "Total number of calls intercepted",
+	},
+	[]string{"chain", "app", "method", "by"},
+)
+
 // 消息数
 var TotalAmqpMessages = prometheus.NewCounterVec(
 	prometheus.CounterOpts{